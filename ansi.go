@@ -0,0 +1,119 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Output with ANSI escape codes (colors): as styled spans of text or with the
+// escapes stripped.
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/lush/vt100"
+)
+
+// how escape codes in output are presented to clients
+const (
+	ansiRaw   = "raw"
+	ansiSpans = "spans"
+	ansiStrip = "strip"
+)
+
+func validAnsiMode(mode string) bool {
+	switch mode {
+	case ansiRaw, ansiSpans, ansiStrip:
+		return true
+	}
+	return false
+}
+
+// ansi mode of a command, raw unless set otherwise
+func (s *server) ansiMode(id liblush.CmdId) string {
+	s.ansilock.Lock()
+	defer s.ansilock.Unlock()
+	if mode, ok := s.ansi[id]; ok {
+		return mode
+	}
+	return ansiRaw
+}
+
+func (s *server) setAnsiMode(id liblush.CmdId, mode string) error {
+	if mode == "" {
+		mode = ansiRaw
+	}
+	if !validAnsiMode(mode) {
+		return fmt.Errorf("unknown ansi mode: %q", mode)
+	}
+	s.ansilock.Lock()
+	defer s.ansilock.Unlock()
+	if mode == ansiRaw {
+		delete(s.ansi, id)
+	} else {
+		s.ansi[id] = mode
+	}
+	return nil
+}
+
+// text of output with all escape codes removed. keeps state between writes
+// so sequences split over multiple writes are removed as well.
+type stripWriter struct {
+	w      io.Writer
+	parser vt100.SpanParser
+}
+
+func (sw *stripWriter) Write(data []byte) (int, error) {
+	var text []byte
+	for _, span := range sw.parser.Parse(data) {
+		text = append(text, span.Text...)
+	}
+	if len(text) > 0 {
+		_, err := sw.w.Write(text)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// writes output as a JSON array of styled spans, prefixed
+type spansWriter struct {
+	w      io.Writer
+	prefix string
+	parser vt100.SpanParser
+}
+
+func (sw *spansWriter) Write(data []byte) (int, error) {
+	spans := sw.parser.Parse(data)
+	if len(spans) > 0 {
+		err := writePrefixedJson(sw.w, sw.prefix, spans)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.ansi = map[liblush.CmdId]string{}
+	})
+}
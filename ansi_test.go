@@ -0,0 +1,80 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestStripWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &stripWriter{w: &buf}
+	w.Write([]byte("\x1b[1mbold\x1b["))
+	w.Write([]byte("0m plain"))
+	if buf.String() != "bold plain" {
+		t.Errorf("Unexpected stripped output: %q", buf.String())
+	}
+}
+
+func TestAnsiMetadata(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "printf",
+		Args:             []string{`\033[31mred\033[0m`},
+		StdoutScrollback: 100,
+		Ansi:             ansiSpans,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := metacmd{c, s}.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.StdoutSpans) != 1 || md.StdoutSpans[0].Text != "red" {
+		t.Errorf("Unexpected spans in metadata: %+v", md.StdoutSpans)
+	}
+	if _, err = newCommand(s, cmdOptions{Cmd: "true", Ansi: "fancy"}); err == nil {
+		t.Errorf("Expected error for unknown ansi mode")
+	}
+}
+
+func TestSubscribeAnsiMode(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{Cmd: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprint(c.Id())
+	// the presentation is a property of the command, shared by all clients
+	if err = wseventSubscribe(s, id+";stdout;spans"); err == nil {
+		t.Errorf("Expected error overriding the ansi mode per subscription")
+	}
+	if err = wseventSubscribe(s, id+";stdout"); err != nil {
+		t.Errorf("Error subscribing: %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Archive of released commands: their metadata and output are written to
+// disk when a client releases them, so the output is not lost once the UI
+// cleans up. Old entries are removed by count, age and total size.
+//
+// Every entry is three files in the archive directory: <key>.json with the
+// metadata, and <key>.stdout and <key>.stderr with the raw output.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/lush/vt100"
+	"github.com/hraban/web"
+)
+
+const (
+	defaultArchiveCount = 1000
+	defaultArchiveAge   = 30 * 24 * time.Hour
+	defaultArchiveSize  = 100 * 1024 * 1024
+	// entries per page in a listing
+	defaultArchivePage = 100
+)
+
+// 0 means no limit
+type archiveLimits struct {
+	Count int
+	Age   time.Duration
+	// bytes on disk
+	Size int64
+}
+
+type archivedCommand struct {
+	Key      string     `json:"key"`
+	Archived time.Time  `json:"archived"`
+	Started  *time.Time `json:"started,omitempty"`
+	Exited   *time.Time `json:"exited,omitempty"`
+	// as sent to clients, without the output
+	Metadata   cmdmetadata `json:"metadata"`
+	StdoutSize int         `json:"stdoutSize"`
+	StderrSize int         `json:"stderrSize"`
+	// all three files
+	size int64
+}
+
+type archive struct {
+	dir    string
+	limits archiveLimits
+	l      sync.Mutex
+	// oldest first
+	entries []*archivedCommand
+}
+
+type archivedByTime []*archivedCommand
+
+func (a archivedByTime) Len() int           { return len(a) }
+func (a archivedByTime) Less(i, j int) bool { return a[i].Archived.Before(a[j].Archived) }
+func (a archivedByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type archiveListing struct {
+	// number of matching entries, not just on this page
+	Total   int                `json:"total"`
+	Entries []*archivedCommand `json:"entries"`
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// open the archive in this directory, creating it if necessary
+func newArchive(dir string, limits archiveLimits) (*archive, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	a := &archive{dir: dir, limits: limits}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entry archivedCommand
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			log.Printf("Skipping corrupt archive entry %s: %v", path, err)
+			continue
+		}
+		entry.size = int64(len(data)) +
+			fileSize(a.outputPath(entry.Key, "stdout")) +
+			fileSize(a.outputPath(entry.Key, "stderr"))
+		a.entries = append(a.entries, &entry)
+	}
+	sort.Sort(archivedByTime(a.entries))
+	a.l.Lock()
+	defer a.l.Unlock()
+	a.prune()
+	return a, nil
+}
+
+func (a *archive) metadataPath(key string) string {
+	return filepath.Join(a.dir, key+".json")
+}
+
+func (a *archive) outputPath(key, stream string) string {
+	return filepath.Join(a.dir, key+"."+stream)
+}
+
+func (a *archive) remove(entry *archivedCommand) {
+	for _, path := range []string{
+		a.metadataPath(entry.Key),
+		a.outputPath(entry.Key, "stdout"),
+		a.outputPath(entry.Key, "stderr"),
+	} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove archived file %s: %v", path, err)
+		}
+	}
+}
+
+// drop the oldest entries until the archive is within its limits. caller
+// must hold the lock.
+func (a *archive) prune() {
+	var total int64
+	for _, entry := range a.entries {
+		total += entry.size
+	}
+	cutoff := time.Now().Add(-a.limits.Age)
+	for len(a.entries) > 0 {
+		oldest := a.entries[0]
+		if !((a.limits.Count > 0 && len(a.entries) > a.limits.Count) ||
+			(a.limits.Age > 0 && oldest.Archived.Before(cutoff)) ||
+			(a.limits.Size > 0 && total > a.limits.Size)) {
+			break
+		}
+		a.remove(oldest)
+		total -= oldest.size
+		a.entries = a.entries[1:]
+	}
+}
+
+func (a *archive) add(entry *archivedCommand, stdout, stderr []byte) error {
+	a.l.Lock()
+	defer a.l.Unlock()
+	entry.StdoutSize = len(stdout)
+	entry.StderrSize = len(stderr)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(a.outputPath(entry.Key, "stdout"), stdout, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(a.outputPath(entry.Key, "stderr"), stderr, 0600)
+	if err != nil {
+		return err
+	}
+	// last: an entry without metadata is not picked up on startup
+	err = ioutil.WriteFile(a.metadataPath(entry.Key), data, 0600)
+	if err != nil {
+		return err
+	}
+	entry.size = int64(len(data) + len(stdout) + len(stderr))
+	a.entries = append(a.entries, entry)
+	a.prune()
+	return nil
+}
+
+func (a *archive) get(key string) *archivedCommand {
+	a.l.Lock()
+	defer a.l.Unlock()
+	for _, entry := range a.entries {
+		if entry.Key == key {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (a *archive) output(entry *archivedCommand, stream string) ([]byte, error) {
+	if stream != "stdout" && stream != "stderr" {
+		return nil, errors.New("no such stream: " + stream)
+	}
+	return ioutil.ReadFile(a.outputPath(entry.Key, stream))
+}
+
+// case insensitive match on the name, the command line or the output
+func (a *archive) matches(entry *archivedCommand, query string) bool {
+	md := entry.Metadata
+	fields := append([]string{md.Name, md.Cmd}, md.Args...)
+	if strings.Contains(strings.ToLower(strings.Join(fields, " ")), query) {
+		return true
+	}
+	for _, stream := range []string{"stdout", "stderr"} {
+		data, err := a.output(entry, stream)
+		if err == nil && bytes.Contains(bytes.ToLower(data), []byte(query)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newest first
+func (a *archive) list(query string, offset, limit int) archiveListing {
+	a.l.Lock()
+	// entries also expire while nothing is added
+	a.prune()
+	entries := make([]*archivedCommand, len(a.entries))
+	copy(entries, a.entries)
+	a.l.Unlock()
+	query = strings.ToLower(query)
+	listing := archiveListing{Entries: []*archivedCommand{}}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if query != "" && !a.matches(entries[i], query) {
+			continue
+		}
+		if listing.Total >= offset && len(listing.Entries) < limit {
+			listing.Entries = append(listing.Entries, entries[i])
+		}
+		listing.Total++
+	}
+	return listing
+}
+
+// write this command to the archive if it has run. called right before it
+// is released.
+func (s *server) archiveCommand(c liblush.Cmd) error {
+	status := c.Status()
+	if status.Exited() == nil && status.Err() == nil {
+		return nil
+	}
+	md, err := metacmd{c, s}.Metadata()
+	if err != nil {
+		return err
+	}
+	md.Stdout, md.Stderr = "", ""
+	md.StdoutSpans, md.StderrSpans = nil, nil
+	md.Screen = nil
+	now := time.Now()
+	entry := &archivedCommand{
+		Key:      fmt.Sprintf("%d-%d", now.UnixNano(), c.Id()),
+		Archived: now,
+		Started:  status.Started(),
+		Exited:   status.Exited(),
+		Metadata: md,
+	}
+	err = s.archive.add(entry, scrollbackBytes(c.Stdout()), scrollbackBytes(c.Stderr()))
+	if err != nil {
+		return err
+	}
+	// not an error if nobody is connected
+	writePrefixedJson(&s.ctrlclients, "archived;", entry)
+	return nil
+}
+
+func getArchive(ctx *web.Context) (*archive, error) {
+	s := ctx.User.(*server)
+	if s.archive == nil {
+		return nil, web.WebError{404, "archive is disabled"}
+	}
+	return s.archive, nil
+}
+
+func getArchived(ctx *web.Context, key string) (*archive, *archivedCommand, error) {
+	a, err := getArchive(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := a.get(key)
+	if entry == nil {
+		return nil, nil, web.WebError{404, "no such archived command: " + key}
+	}
+	return a, entry, nil
+}
+
+// eg GET /archive.json?q=make&offset=100&limit=50
+func handleGetArchive(ctx *web.Context) (archiveListing, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return archiveListing{}, err
+	}
+	a, err := getArchive(ctx)
+	if err != nil {
+		return archiveListing{}, err
+	}
+	offset, limit := 0, defaultArchivePage
+	if str := ctx.Params["offset"]; str != "" {
+		offset, err = strconv.Atoi(str)
+		if err != nil || offset < 0 {
+			return archiveListing{}, web.WebError{400, "invalid offset: " + str}
+		}
+	}
+	if str := ctx.Params["limit"]; str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 0 {
+			return archiveListing{}, web.WebError{400, "invalid limit: " + str}
+		}
+	}
+	ctx.ContentType("json")
+	return a.list(ctx.Params["q"], offset, limit), nil
+}
+
+func handleGetArchivedCmd(ctx *web.Context, key string) (*archivedCommand, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return nil, err
+	}
+	_, entry, err := getArchived(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ctx.ContentType("json")
+	return entry, nil
+}
+
+// output of an archived command as text/plain, with support for Range
+// requests. ?strip=1 removes escape codes.
+//
+// eg GET /archive/1413730000000000000-3/stdout.txt
+func handleGetArchivedOutput(ctx *web.Context, key, streamname string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
+	a, entry, err := getArchived(ctx, key)
+	if err != nil {
+		return err
+	}
+	strip, err := boolParam(ctx, "strip")
+	if err != nil {
+		return err
+	}
+	data, err := a.output(entry, streamname)
+	if err != nil {
+		return web.WebError{404, err.Error()}
+	}
+	if strip {
+		data = vt100.StripEscapes(data)
+	}
+	ctx.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(ctx, ctx.Request, streamname+".txt", entry.Archived, bytes.NewReader(data))
+	return nil
+}
+
+// download of the raw output of an archived command
+func handleGetArchivedRawOutput(ctx *web.Context, key, streamname string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
+	a, entry, err := getArchived(ctx, key)
+	if err != nil {
+		return err
+	}
+	data, err := a.output(entry, streamname)
+	if err != nil {
+		return web.WebError{404, err.Error()}
+	}
+	ctx.Header().Set("Content-Type", "application/octet-stream")
+	ctx.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"lush-%d-%s.bin\"", entry.Metadata.Id, streamname))
+	http.ServeContent(ctx, ctx.Request, streamname+".bin", entry.Archived, bytes.NewReader(data))
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestArchiveReleasedCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lusharchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newServer()
+	s.archive, err = newArchive(dir, archiveLimits{Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range []string{"one", "two", "three"} {
+		c, err := newCommand(s, cmdOptions{
+			Cmd:              "echo",
+			Args:             []string{word},
+			Name:             "say " + word,
+			StdoutScrollback: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.releaseCommand(c.Id()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// never started: nothing worth keeping
+	c, err := newCommand(s, cmdOptions{Cmd: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.releaseCommand(c.Id()); err != nil {
+		t.Fatal(err)
+	}
+	listing := s.archive.list("", 0, 10)
+	if listing.Total != 2 {
+		t.Fatalf("expected 2 entries after pruning, got %d", listing.Total)
+	}
+	newest := listing.Entries[0]
+	if newest.Metadata.Name != "say three" || listing.Entries[1].Metadata.Name != "say two" {
+		t.Errorf("unexpected entries: %q, %q", newest.Metadata.Name, listing.Entries[1].Metadata.Name)
+	}
+	out, err := s.archive.output(newest, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "three\n" {
+		t.Errorf("unexpected archived output: %q", out)
+	}
+	if listing = s.archive.list("THREE", 0, 10); listing.Total != 1 {
+		t.Errorf("expected one match for query, got %d", listing.Total)
+	}
+	// picked up again from disk
+	a, err := newArchive(dir, archiveLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := a.get(newest.Key); entry == nil || entry.StdoutSize != len("three\n") {
+		t.Errorf("archive entry not loaded from disk: %#v", entry)
+	}
+	// only the metadata, stdout and stderr of two entries are left
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 6 {
+		t.Errorf("expected 6 files in archive dir, got %d", len(files))
+	}
+}
+
+func TestArchivePruneAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lusharchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := newArchive(dir, archiveLimits{Age: time.Hour, Size: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &archivedCommand{Key: "1-1", Archived: time.Now().Add(-2 * time.Hour)}
+	if err = a.add(old, []byte("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if a.get("1-1") != nil {
+		t.Errorf("expired entry was kept")
+	}
+	big := &archivedCommand{Key: "2-2", Archived: time.Now()}
+	if err = a.add(big, make([]byte, 100), nil); err != nil {
+		t.Fatal(err)
+	}
+	if a.get("2-2") != nil {
+		t.Errorf("entry over the size limit was kept")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Timestamped output and export to asciinema's asciicast v2 format.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/web"
+)
+
+// terminal size in the asciicast header. the output was not written to a
+// terminal so this is only a hint for the player.
+const (
+	asciicastWidth  = 80
+	asciicastHeight = 24
+)
+
+type chunkJson struct {
+	Time time.Time `json:"time"`
+	Data string    `json:"data"`
+}
+
+// chunks of a stream as UTF-8. they are decoded in order: a character can be
+// split over two writes. one cut off at the end is left out.
+func decodedChunks(s *server, c liblush.Cmd, streamname string) []liblush.Chunk {
+	dec, err := newDecoder(s.streamEncoding(c.Id(), streamname))
+	if err != nil {
+		dec = &utf8Decoder{}
+	}
+	chunks := cmdStream(c, streamname).Chunks()
+	for i := range chunks {
+		chunks[i].Data = dec.decode(chunks[i].Data)
+	}
+	return chunks
+}
+
+func streamChunks(s *server, c liblush.Cmd, streamname string) []chunkJson {
+	chunks := []chunkJson{}
+	for _, chunk := range decodedChunks(s, c, streamname) {
+		chunks = append(chunks, chunkJson{chunk.Time, string(chunk.Data)})
+	}
+	return chunks
+}
+
+func getTimedStream(s *server, idstr, streamname string) (liblush.Cmd, error) {
+	c, err := getCmd(s, idstr)
+	if err != nil {
+		return nil, err
+	}
+	stream := cmdStream(c, streamname)
+	if stream == nil {
+		return nil, errors.New("unknown stream: " + streamname)
+	}
+	if !stream.Timestamps() {
+		return nil, fmt.Errorf("timestamps are off for %s of command %s", streamname, idstr)
+	}
+	return c, nil
+}
+
+// output of a stream with the time every chunk was written. timestamps must be
+// enabled for that stream (stdoutTimestamps / stderrTimestamps).
+//
+//     chunks;3;stdout
+//
+// reply: chunks;{"nid":3,"stream":"stdout","chunks":[{"time":"...","data":"..."},...]}
+func wseventChunks(s *server, options string) error {
+	args := strings.Split(options, ";")
+	if len(args) != 2 {
+		return errors.New("chunks requires 2 args")
+	}
+	c, err := getTimedStream(s, args[0], args[1])
+	if err != nil {
+		return lushError{err}
+	}
+	return writePrefixedJson(&s.ctrlclients, "chunks;", map[string]interface{}{
+		"nid":    c.Id(),
+		"stream": args[1],
+		"chunks": streamChunks(s, c, args[1]),
+	})
+}
+
+func handleGetChunks(ctx *web.Context, idstr, streamname string) ([]chunkJson, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return nil, err
+	}
+	s := ctx.User.(*server)
+	c, err := getTimedStream(s, idstr, streamname)
+	if err != nil {
+		return nil, web.WebError{404, err.Error()}
+	}
+	ctx.ContentType("json")
+	return streamChunks(s, c, streamname), nil
+}
+
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Command   string `json:"command,omitempty"`
+}
+
+// pipes use bare newlines, a terminal needs a carriage return as well
+func crlf(data []byte) string {
+	str := strings.Replace(string(data), "\r\n", "\n", -1)
+	return strings.Replace(str, "\n", "\r\n", -1)
+}
+
+// write stdout and stderr of a command as an asciicast v2 file. both streams
+// are merged in order of writing; streams without timestamps are left out.
+func writeAsciicast(w io.Writer, s *server, c liblush.Cmd) error {
+	var chunks []liblush.Chunk
+	for _, streamname := range []string{"stdout", "stderr"} {
+		chunks = append(chunks, decodedChunks(s, c, streamname)...)
+	}
+	sort.Stable(chunksByTime(chunks))
+	var start time.Time
+	if started := c.Status().Started(); started != nil {
+		start = *started
+	} else if len(chunks) > 0 {
+		start = chunks[0].Time
+	}
+	hdr := asciicastHeader{
+		Version: 2,
+		Width:   asciicastWidth,
+		Height:  asciicastHeight,
+		Title:   c.Name(),
+		Command: strings.Join(c.Argv(), " "),
+	}
+	if !start.IsZero() {
+		hdr.Timestamp = start.Unix()
+	}
+	enc := json.NewEncoder(w)
+	err := enc.Encode(hdr)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		t := chunk.Time.Sub(start).Seconds()
+		if t < 0 {
+			t = 0
+		}
+		err = enc.Encode([]interface{}{t, "o", crlf(chunk.Data)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type chunksByTime []liblush.Chunk
+
+func (c chunksByTime) Len() int           { return len(c) }
+func (c chunksByTime) Less(i, j int) bool { return c[i].Time.Before(c[j].Time) }
+func (c chunksByTime) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// eg GET /3/asciicast.cast (replay with asciinema play)
+func handleGetAsciicast(ctx *web.Context, idstr string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
+	s := ctx.User.(*server)
+	c, err := getCmd(s, idstr)
+	if err != nil {
+		return web.WebError{404, err.Error()}
+	}
+	if !c.Stdout().Timestamps() && !c.Stderr().Timestamps() {
+		return web.WebError{404, "timestamps are off for command " + idstr}
+	}
+	ctx.Header().Set("Content-Type", "application/x-asciicast")
+	ctx.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"lush-%d.cast\"", c.Id()))
+	return writeAsciicast(ctx, s, c)
+}
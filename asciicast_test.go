@@ -0,0 +1,101 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteAsciicast(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "sh",
+		Args:             []string{"-c", "echo out; sleep 0.1; echo err >&2"},
+		StdoutScrollback: 100,
+		StderrScrollback: 100,
+		StdoutTimestamps: true,
+		StderrTimestamps: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = writeAsciicast(&buf, s, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&buf)
+	scanner.Scan()
+	var hdr asciicastHeader
+	err = json.Unmarshal(scanner.Bytes(), &hdr)
+	if err != nil || hdr.Version != 2 || hdr.Timestamp == 0 {
+		t.Fatalf("Unexpected header %q: %v", scanner.Text(), err)
+	}
+	var events [][]interface{}
+	for scanner.Scan() {
+		var ev []interface{}
+		err = json.Unmarshal(scanner.Bytes(), &ev)
+		if err != nil {
+			t.Fatalf("Malformed event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %v", events)
+	}
+	if events[0][2] != "out\r\n" || events[1][2] != "err\r\n" {
+		t.Errorf("Unexpected event data: %v", events)
+	}
+	if events[1][0].(float64) < 0.1 {
+		t.Errorf("Expected second event after the sleep: %v", events)
+	}
+}
+
+func TestStreamChunksSplitCharacter(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "sh",
+		Args:             []string{"-c", `printf 'caf\303'; sleep 0.1; printf '\251\n'`},
+		StdoutScrollback: 100,
+		StdoutTimestamps: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := streamChunks(s, c, "stdout")
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %v", chunks)
+	}
+	if chunks[0].Data+chunks[1].Data != "café\n" {
+		t.Errorf("Unexpected chunks: %q, %q", chunks[0].Data, chunks[1].Data)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Authentication: every HTTP request and websocket connection must carry an
+// access token, either as a bearer token (Authorization: Bearer <token>) or
+// through the signed session cookie set by logging in at /login. Clients can
+// also be let in by address (see roles.go).
+//
+// The cookie and the address are sent by the browser no matter which site
+// made it connect, so websocket connections and posts from other origins are
+// refused unless they carry a bearer token.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hraban/web"
+)
+
+const (
+	sessionCookie = "lushsession"
+	// seconds
+	sessionCookieAge = 30 * 24 * 60 * 60
+	// slows down guessing the token through the login form
+	loginFailureDelay = time.Second
+)
+
+// random token to use when none is configured
+func generateToken() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// require this token from every client. empty disables authentication.
+func (s *server) setToken(token string) {
+	s.token = token
+	// cookies are signed with a key derived from the token: changing the
+	// token logs everybody out
+	sum := sha256.Sum256([]byte("lush session cookie:" + token))
+	s.web.Config.CookieSecret = hex.EncodeToString(sum[:])
+}
+
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// identifies a token in the session cookie without storing the token itself
+func tokenId(token string) string {
+	sum := sha256.Sum256([]byte("lush token id:" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// contents of the (signed) session cookie
+type loginSession struct {
+	tokenid string
+	expires time.Time
+	// random, to revoke this session on logout
+	nonce string
+}
+
+func newLoginSession(token string) (loginSession, error) {
+	nonce, err := generateToken()
+	if err != nil {
+		return loginSession{}, err
+	}
+	return loginSession{
+		tokenid: tokenId(token),
+		expires: time.Now().Add(sessionCookieAge * time.Second),
+		nonce:   nonce,
+	}, nil
+}
+
+func (ses loginSession) String() string {
+	return fmt.Sprintf("%s.%d.%s", ses.tokenid, ses.expires.Unix(), ses.nonce)
+}
+
+func parseSession(value string) (loginSession, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return loginSession{}, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return loginSession{}, false
+	}
+	return loginSession{parts[0], time.Unix(expires, 0), parts[2]}, true
+}
+
+// the session in the cookie of this request, if it is still valid
+func (s *server) requestSession(ctx *web.Context) (loginSession, bool) {
+	value, ok := ctx.GetSecureCookie(sessionCookie)
+	if !ok {
+		return loginSession{}, false
+	}
+	ses, ok := parseSession(value)
+	if !ok || time.Now().After(ses.expires) {
+		return loginSession{}, false
+	}
+	s.revokedlock.Lock()
+	defer s.revokedlock.Unlock()
+	if _, revoked := s.revoked[ses.nonce]; revoked {
+		return loginSession{}, false
+	}
+	return ses, true
+}
+
+// refuse this session from now on, even if somebody kept a copy of the
+// cookie. kept in memory only: after a restart the session is limited by its
+// expiry alone.
+func (s *server) revokeSession(ses loginSession) {
+	s.revokedlock.Lock()
+	defer s.revokedlock.Unlock()
+	now := time.Now()
+	for nonce, expires := range s.revoked {
+		if now.After(expires) {
+			delete(s.revoked, nonce)
+		}
+	}
+	s.revoked[ses.nonce] = ses.expires
+}
+
+// true for websocket connections and posts that a page on another site made
+// the browser send. a missing Origin is not a browser (or a very old one).
+func crossSiteRequest(r *http.Request) bool {
+	if (r.Method == "GET" || r.Method == "HEAD") && !isWebsocket(r) {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return true
+	}
+	return !strings.EqualFold(u.Host, r.Host)
+}
+
+// restrict the session cookie set by SetSecureCookie: never sent along with
+// requests from other sites, never over plain HTTP if we serve HTTPS, and out
+// of reach of scripts.
+func restrictSessionCookie(ctx *web.Context) {
+	attrs := "; SameSite=Strict; HttpOnly"
+	if ctx.Request.TLS != nil {
+		attrs += "; Secure"
+	}
+	cookies := ctx.Header()["Set-Cookie"]
+	for i, c := range cookies {
+		if strings.HasPrefix(c, sessionCookie+"=") {
+			cookies[i] = c + attrs
+		}
+	}
+}
+
+// for pages meant for humans: send them to the login form instead. returns
+// true if the request was handled.
+func redirectIfUnauthenticated(ctx *web.Context) bool {
+	s := ctx.User.(*server)
+	if _, ok := s.identify(ctx); ok {
+		return false
+	}
+	loc := &url.URL{
+		Path:     "/login",
+		RawQuery: url.Values{"next": {ctx.Request.URL.Path}}.Encode(),
+	}
+	ctx.Header().Set("Location", loc.String())
+	ctx.WriteHeader(303)
+	return true
+}
+
+// only redirect to paths on this server after logging in. browsers treat a
+// backslash like a slash: /\evil.com is //evil.com.
+func loginNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return "/"
+	}
+	return next
+}
+
+func renderLogin(ctx *web.Context, code int, errmsg string) error {
+	s := ctx.User.(*server)
+	ctx.ContentType("html")
+	ctx.WriteHeader(code)
+	return s.tmplts.ExecuteTemplate(ctx, "login", struct {
+		Error, Next string
+	}{errmsg, loginNext(ctx.Params["next"])})
+}
+
+func handleGetLogin(ctx *web.Context) error {
+	return renderLogin(ctx, 200, "")
+}
+
+// eg POST /login token=...&next=/3/
+func handlePostLogin(ctx *web.Context) error {
+	s := ctx.User.(*server)
+	token := ctx.Params["token"]
+	if _, ok := s.tokenPrincipal(token); !ok {
+		s.web.Logger.Printf("failed login from %s", remoteAddr(ctx))
+		time.Sleep(loginFailureDelay)
+		return renderLogin(ctx, 401, "Wrong token")
+	}
+	ses, err := newLoginSession(token)
+	if err != nil {
+		return err
+	}
+	ctx.SetSecureCookie(sessionCookie, ses.String(), sessionCookieAge)
+	restrictSessionCookie(ctx)
+	ctx.Header().Set("Location", loginNext(ctx.Params["next"]))
+	ctx.WriteHeader(303)
+	return nil
+}
+
+func handlePostLogout(ctx *web.Context) error {
+	s := ctx.User.(*server)
+	if ses, ok := s.requestSession(ctx); ok {
+		s.revokeSession(ses)
+	}
+	http.SetCookie(ctx, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   ctx.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	ctx.Header().Set("Location", "/login")
+	ctx.WriteHeader(303)
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveTest(s *server, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newServer()
+	s.setToken("sesame")
+	req, _ := http.NewRequest("GET", "/environ.json", nil)
+	if rec := serveTest(s, req); rec.Code != 401 {
+		t.Errorf("expected 401 without credentials, got %d", rec.Code)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	if rec := serveTest(s, req); rec.Code != 401 {
+		t.Errorf("expected 401 with wrong token, got %d", rec.Code)
+	}
+	req.Header.Set("Authorization", "Bearer sesame")
+	if rec := serveTest(s, req); rec.Code != 200 {
+		t.Errorf("expected 200 with bearer token, got %d", rec.Code)
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	rec := serveTest(s, req)
+	if loc := rec.Header().Get("Location"); rec.Code != 303 || !strings.HasPrefix(loc, "/login") {
+		t.Errorf("expected redirect to login page, got %d to %q", rec.Code, loc)
+	}
+	login := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}, "next": {"/3/"}}
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveTest(s, req)
+	}
+	if rec = login("guess"); rec.Code != 401 {
+		t.Errorf("expected 401 for wrong login, got %d", rec.Code)
+	}
+	rec = login("sesame")
+	if loc := rec.Header().Get("Location"); rec.Code != 303 || loc != "/3/" {
+		t.Errorf("expected redirect after login, got %d to %q", rec.Code, loc)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("expected session cookie, got %v", cookies)
+	}
+	req, _ = http.NewRequest("GET", "/environ.json", nil)
+	req.AddCookie(cookies[0])
+	if rec := serveTest(s, req); rec.Code != 200 {
+		t.Errorf("expected 200 with session cookie, got %d", rec.Code)
+	}
+	logout, _ := http.NewRequest("POST", "/logout", nil)
+	logout.AddCookie(cookies[0])
+	serveTest(s, logout)
+	// as if the browser had kept the cookie anyway
+	if rec := serveTest(s, req); rec.Code != 401 {
+		t.Errorf("expected 401 with cookie of logged out session, got %d", rec.Code)
+	}
+	expired := loginSession{tokenId("sesame"), time.Now().Add(-time.Minute), "x"}
+	req, _ = http.NewRequest("GET", "/environ.json", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: expired.String()})
+	if rec := serveTest(s, req); rec.Code != 401 {
+		t.Errorf("expected 401 with expired session, got %d", rec.Code)
+	}
+}
+
+func TestLoginNext(t *testing.T) {
+	for in, expected := range map[string]string{
+		"/3/":              "/3/",
+		"":                 "/",
+		"//evil.com/":      "/",
+		"/\\evil.com/":     "/",
+		"http://evil.com/": "/",
+	} {
+		if out := loginNext(in); out != expected {
+			t.Errorf("%q -> %q, expected %q", in, out, expected)
+		}
+	}
+}
+
+func TestCrossSiteRequest(t *testing.T) {
+	s := newServer()
+	s.setToken("sesame")
+	form := url.Values{"token": {"sesame"}}
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := serveTest(s, req)
+	if c := rec.Header().Get("Set-Cookie"); !strings.Contains(c, "SameSite=Strict") {
+		t.Errorf("session cookie must be SameSite=Strict: %q", c)
+	}
+	cookies := rec.Result().Cookies()
+	setenv := func(origin string) int {
+		form := url.Values{"key": {"LUSHTESTCSRF"}, "value": {"x"}}
+		req, _ := http.NewRequest("POST", "http://lush.example:8081/setenv", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		req.AddCookie(cookies[0])
+		return serveTest(s, req).Code
+	}
+	if code := setenv("http://evil.example"); code != 403 {
+		t.Errorf("expected cross-site post to be refused, got %d", code)
+	}
+	if code := setenv("null"); code != 403 {
+		t.Errorf("expected post from opaque origin to be refused, got %d", code)
+	}
+	if code := setenv("https://lush.example:8081"); code == 403 || code == 401 {
+		t.Errorf("expected same-origin post to be allowed, got %d", code)
+	}
+	req, _ = http.NewRequest("GET", "http://lush.example:8081/ctrl", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "http://evil.example")
+	if !crossSiteRequest(req) {
+		t.Error("expected websocket from other origin to be cross-site")
+	}
+	req.Header.Set("Origin", "http://lush.example:8081")
+	if crossSiteRequest(req) {
+		t.Error("expected websocket from same origin to be allowed")
+	}
+}
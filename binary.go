@@ -0,0 +1,299 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Detection of binary output, which is not sent to clients as text.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/web"
+)
+
+const (
+	// only the start of the output is inspected
+	binarySampleLen = 8192
+	// fraction of bytes that are not valid UTF-8 in binary output
+	binaryInvalidRatio = 0.3
+	// smaller samples are only binary if they contain a NUL byte
+	binaryMinSample = 32
+)
+
+// true if this looks like binary data rather than text in this encoding
+func looksBinary(data []byte, encoding string) bool {
+	if encoding == encodingAuto {
+		encoding = sniffEncoding(data)
+	}
+	switch encoding {
+	case encodingUtf16le, encodingUtf16be:
+		// NUL bytes are normal and every byte sequence decodes
+		return false
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	if encoding == encodingLatin1 || len(data) < binaryMinSample {
+		return false
+	}
+	data = data[:len(data)-incompleteTail(data)]
+	total := len(data)
+	invalid := 0
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			invalid++
+		}
+		data = data[size:]
+	}
+	return float64(invalid) > binaryInvalidRatio*float64(total)
+}
+
+// peeker on a stream that inspects the start of the output
+type binaryDetector struct {
+	sample []byte
+	binary bool
+	// send output to clients even if it is binary
+	forceText bool
+	// current encoding of the stream
+	encoding func() string
+	// called once when binary output is detected
+	onBinary func()
+	l        sync.Mutex
+}
+
+func (bd *binaryDetector) Write(data []byte) (int, error) {
+	bd.l.Lock()
+	defer bd.l.Unlock()
+	n := len(data)
+	if bd.binary || len(bd.sample) >= binarySampleLen {
+		return n, nil
+	}
+	if len(data) > binarySampleLen-len(bd.sample) {
+		data = data[:binarySampleLen-len(bd.sample)]
+	}
+	bd.sample = append(bd.sample, data...)
+	if looksBinary(bd.sample, bd.encoding()) {
+		bd.binary = true
+		bd.sample = nil
+		if bd.onBinary != nil {
+			bd.onBinary()
+		}
+	}
+	return n, nil
+}
+
+// true if output should not be sent to clients as text
+func (bd *binaryDetector) suppress() bool {
+	bd.l.Lock()
+	defer bd.l.Unlock()
+	return bd.binary && !bd.forceText
+}
+
+// drops data while the stream is binary
+type binaryGate struct {
+	bd *binaryDetector
+	w  io.Writer
+}
+
+func (g *binaryGate) Write(data []byte) (int, error) {
+	if g.bd != nil && g.bd.suppress() {
+		return len(data), nil
+	}
+	return g.w.Write(data)
+}
+
+func (g *binaryGate) Close() error {
+	return tryCloseWriter(g.w)
+}
+
+func tryCloseWriter(w io.Writer) error {
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// start looking for binary output on both streams of a new command
+func (s *server) detectBinary(c liblush.Cmd) {
+	s.binarylock.Lock()
+	defer s.binarylock.Unlock()
+	for _, streamname := range []string{"stdout", "stderr"} {
+		streamname := streamname
+		bd := &binaryDetector{
+			encoding: func() string {
+				return s.streamEncoding(c.Id(), streamname)
+			},
+			onBinary: func() {
+				// not an error if nobody is listening
+				notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+					Objname:  cmdId2Json(c.Id()),
+					Propname: streamname + "Binary",
+					Value:    true,
+				})
+			},
+		}
+		s.binary[streamKey{c.Id(), streamname}] = bd
+		// first peeker: output is flagged before anybody else sees it
+		cmdStream(c, streamname).Peeker().AddWriter(newNopWriteCloser(bd))
+	}
+}
+
+func (s *server) getBinaryDetector(id liblush.CmdId, stream string) *binaryDetector {
+	s.binarylock.Lock()
+	defer s.binarylock.Unlock()
+	return s.binary[streamKey{id, stream}]
+}
+
+func (s *server) isBinary(id liblush.CmdId, stream string) bool {
+	bd := s.getBinaryDetector(id, stream)
+	if bd == nil {
+		return false
+	}
+	bd.l.Lock()
+	defer bd.l.Unlock()
+	return bd.binary
+}
+
+func (s *server) forceText(id liblush.CmdId) bool {
+	bd := s.getBinaryDetector(id, "stdout")
+	if bd == nil {
+		return false
+	}
+	bd.l.Lock()
+	defer bd.l.Unlock()
+	return bd.forceText
+}
+
+func (s *server) setForceText(id liblush.CmdId, force bool) {
+	for _, streamname := range []string{"stdout", "stderr"} {
+		if bd := s.getBinaryDetector(id, streamname); bd != nil {
+			bd.l.Lock()
+			bd.forceText = force
+			bd.l.Unlock()
+		}
+	}
+}
+
+func (s *server) releaseBinaryDetectors(id liblush.CmdId) {
+	s.binarylock.Lock()
+	defer s.binarylock.Unlock()
+	delete(s.binary, streamKey{id, "stdout"})
+	delete(s.binary, streamKey{id, "stderr"})
+}
+
+// scrollback of a stream in hexdump -C format
+func hexdump(stream liblush.OutStream) (string, error) {
+	var buf bytes.Buffer
+	dumper := hex.Dumper(&buf)
+	_, err := stream.Scrollback().WriteTo(dumper)
+	if err != nil {
+		return "", err
+	}
+	err = dumper.Close()
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// the scrollback of a stream as a hexdump, for binary output
+//
+//     hexdump;3;stdout
+//
+// reply: hexdump;{"nid":3,"stream":"stdout","dump":"00000000  7f 45 4c 46 ..."}
+func wseventHexdump(s *server, options string) error {
+	args := strings.Split(options, ";")
+	if len(args) != 2 {
+		return errors.New("hexdump requires 2 args")
+	}
+	c, err := getCmd(s, args[0])
+	if err != nil {
+		return err
+	}
+	stream := cmdStream(c, args[1])
+	if stream == nil {
+		return errors.New("unknown stream: " + args[1])
+	}
+	dump, err := hexdump(stream)
+	if err != nil {
+		return err
+	}
+	return writePrefixedJson(&s.ctrlclients, "hexdump;", map[string]interface{}{
+		"nid":    c.Id(),
+		"stream": args[1],
+		"dump":   dump,
+	})
+}
+
+// eg GET /3/stdout.hex
+func handleGetHexdump(ctx *web.Context, idstr, streamname string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
+	_, stream, err := getOutStream(ctx, idstr, streamname)
+	if err != nil {
+		return err
+	}
+	dump, err := hexdump(stream)
+	if err != nil {
+		return err
+	}
+	ctx.ContentType("txt")
+	_, err = ctx.Write([]byte(dump))
+	return err
+}
+
+// raw bytes of the scrollback as a file download. supports Range requests.
+//
+// eg GET /3/stdout.bin
+func handleGetRawOutput(ctx *web.Context, idstr, streamname string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
+	c, stream, err := getOutStream(ctx, idstr, streamname)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	_, err = stream.Scrollback().WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	ctx.Header().Set("Content-Type", "application/octet-stream")
+	ctx.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"lush-%d-%s.bin\"", c.Id(), streamname))
+	serveOutput(ctx, c, streamname+".bin", buf.Bytes())
+	return nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.binary = map[streamKey]*binaryDetector{}
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLooksBinary(t *testing.T) {
+	tests := []struct {
+		data     string
+		encoding string
+		binary   bool
+	}{
+		{"plain text\n", encodingUtf8, false},
+		{"ELF\x00\x01", encodingUtf8, true},
+		{"caf\xe9", encodingUtf8, false},
+		{strings.Repeat("\xff\xfe\x80a", 10), encodingUtf8, true},
+		{strings.Repeat("\xff\xfe\x80a", 10), encodingLatin1, false},
+		{"h\x00i\x00", encodingUtf16le, false},
+		{"h\x00i\x00", encodingAuto, false},
+	}
+	for _, test := range tests {
+		if b := looksBinary([]byte(test.data), test.encoding); b != test.binary {
+			t.Errorf("%q in %s: expected binary %v, got %v", test.data, test.encoding, test.binary, b)
+		}
+	}
+}
+
+func TestBinaryMetadata(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "printf",
+		Args:             []string{`\000\001\002`},
+		StdoutScrollback: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := metacmd{c, s}.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.StdoutBinary || md.Stdout != "" || md.StderrBinary {
+		t.Errorf("Expected binary stdout to be flagged and left out: %+v", md)
+	}
+	dump, err := hexdump(c.Stdout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dump, "00000000  00 01 02") {
+		t.Errorf("Unexpected hexdump: %q", dump)
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Decoding output in other character sets to UTF-8 for clients. The raw bytes
+// are left alone in the scrollback.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// names of supported character sets
+const (
+	encodingAuto    = "auto"
+	encodingUtf8    = "utf-8"
+	encodingLatin1  = "latin-1"
+	encodingUtf16le = "utf-16le"
+	encodingUtf16be = "utf-16be"
+)
+
+// converts a stream of bytes to valid UTF-8. input split at any point
+// decodes the same as the whole. not safe for concurrent use.
+type decoder interface {
+	decode(data []byte) []byte
+	// end of the stream: whatever is held back is invalid
+	flush() []byte
+}
+
+// passes UTF-8 through, holding back characters that are split over writes
+// and replacing invalid bytes with U+FFFD
+type utf8Decoder struct {
+	pending []byte
+}
+
+func (d *utf8Decoder) decode(data []byte) []byte {
+	if len(d.pending) > 0 {
+		data = append(d.pending, data...)
+		d.pending = nil
+	}
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			d.pending = append([]byte(nil), data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			out = append(out, "�"...)
+		} else {
+			out = append(out, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return out
+}
+
+func (d *utf8Decoder) flush() []byte {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	d.pending = nil
+	return []byte("�")
+}
+
+type latin1Decoder struct{}
+
+func (latin1Decoder) decode(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b < utf8.RuneSelf {
+			out = append(out, b)
+		} else {
+			out = append(out, string(rune(b))...)
+		}
+	}
+	return out
+}
+
+func (latin1Decoder) flush() []byte {
+	return nil
+}
+
+type utf16Decoder struct {
+	bigEndian bool
+	// odd byte at the end of the last write
+	pending []byte
+	// high surrogate at the end of the last write
+	high uint16
+}
+
+func (d *utf16Decoder) decode(data []byte) []byte {
+	if len(d.pending) > 0 {
+		data = append(d.pending, data...)
+		d.pending = nil
+	}
+	if len(data)%2 == 1 {
+		d.pending = []byte{data[len(data)-1]}
+		data = data[:len(data)-1]
+	}
+	units := make([]uint16, 0, len(data)/2+1)
+	if d.high != 0 {
+		units = append(units, d.high)
+		d.high = 0
+	}
+	for i := 0; i < len(data); i += 2 {
+		if d.bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	if n := len(units); n > 0 && utf16.IsSurrogate(rune(units[n-1])) && units[n-1] < 0xdc00 {
+		d.high = units[n-1]
+		units = units[:n-1]
+	}
+	var buf bytes.Buffer
+	for _, r := range utf16.Decode(units) {
+		buf.WriteRune(r)
+	}
+	return buf.Bytes()
+}
+
+func (d *utf16Decoder) flush() []byte {
+	if len(d.pending) == 0 && d.high == 0 {
+		return nil
+	}
+	d.pending = nil
+	d.high = 0
+	return []byte("�")
+}
+
+// guesses the encoding from the first write: a byte order mark, NUL bytes in
+// every other position (UTF-16 text in the ASCII range), valid UTF-8 or else
+// Latin-1.
+type autoDecoder struct {
+	chosen decoder
+}
+
+func sniffEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return encodingUtf8
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return encodingUtf16le
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return encodingUtf16be
+	}
+	var evenNuls, oddNuls int
+	for i, b := range data {
+		if b == 0 {
+			if i%2 == 0 {
+				evenNuls++
+			} else {
+				oddNuls++
+			}
+		}
+	}
+	pairs := len(data) / 2
+	switch {
+	case pairs > 0 && oddNuls*2 > pairs && evenNuls == 0:
+		return encodingUtf16le
+	case pairs > 0 && evenNuls*2 > pairs && oddNuls == 0:
+		return encodingUtf16be
+	}
+	// a character cut off at the end does not make it invalid
+	if utf8.Valid(data[:len(data)-incompleteTail(data)]) {
+		return encodingUtf8
+	}
+	return encodingLatin1
+}
+
+// length of an incomplete UTF-8 sequence at the end of data
+func incompleteTail(data []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+func (d *autoDecoder) decode(data []byte) []byte {
+	if d.chosen == nil {
+		if len(data) == 0 {
+			return nil
+		}
+		d.chosen, _ = newDecoder(sniffEncoding(data))
+	}
+	return d.chosen.decode(data)
+}
+
+func (d *autoDecoder) flush() []byte {
+	if d.chosen == nil {
+		return nil
+	}
+	return d.chosen.flush()
+}
+
+// decoder for this character set, UTF-8 if empty
+func newDecoder(encoding string) (decoder, error) {
+	switch encoding {
+	case "", encodingUtf8:
+		return &utf8Decoder{}, nil
+	case encodingLatin1:
+		return latin1Decoder{}, nil
+	case encodingUtf16le:
+		return &utf16Decoder{}, nil
+	case encodingUtf16be:
+		return &utf16Decoder{bigEndian: true}, nil
+	case encodingAuto:
+		return &autoDecoder{}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding: %q", encoding)
+}
+
+// decodes everything before forwarding it. the encoding is looked up on every
+// write: it can be changed while the command runs.
+type decodingWriter struct {
+	encoding func() string
+	w        io.Writer
+	// decoder for the encoding seen last
+	current string
+	dec     decoder
+}
+
+func newDecodingWriter(encoding func() string, w io.Writer) *decodingWriter {
+	return &decodingWriter{encoding: encoding, w: w}
+}
+
+func (dw *decodingWriter) Write(data []byte) (int, error) {
+	if enc := dw.encoding(); dw.dec == nil || enc != dw.current {
+		dec, err := newDecoder(enc)
+		if err != nil {
+			return 0, err
+		}
+		// the old decoder gives up what it held back
+		dw.Close()
+		dw.current, dw.dec = enc, dec
+	}
+	text := dw.dec.decode(data)
+	if len(text) > 0 {
+		_, err := dw.w.Write(text)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// called when the command exits. does not close the underlying writer: the
+// command can be run again.
+func (dw *decodingWriter) Close() error {
+	if dw.dec == nil {
+		return nil
+	}
+	if text := dw.dec.flush(); len(text) > 0 {
+		dw.w.Write(text)
+	}
+	return nil
+}
+
+func (s *server) releaseStreamEncodings(id liblush.CmdId) {
+	s.encodingslock.Lock()
+	defer s.encodingslock.Unlock()
+	delete(s.encodings, streamKey{id, "stdout"})
+	delete(s.encodings, streamKey{id, "stderr"})
+}
+
+func (s *server) streamEncoding(id liblush.CmdId, stream string) string {
+	s.encodingslock.Lock()
+	defer s.encodingslock.Unlock()
+	if enc, ok := s.encodings[streamKey{id, stream}]; ok {
+		return enc
+	}
+	return encodingUtf8
+}
+
+// character set of a stream, UTF-8 if empty
+func (s *server) setStreamEncoding(id liblush.CmdId, stream, encoding string) error {
+	if _, err := newDecoder(encoding); err != nil {
+		return err
+	}
+	s.encodingslock.Lock()
+	defer s.encodingslock.Unlock()
+	if encoding == "" || encoding == encodingUtf8 {
+		delete(s.encodings, streamKey{id, stream})
+	} else {
+		s.encodings[streamKey{id, stream}] = encoding
+	}
+	return nil
+}
+
+// scrollback of a stream as UTF-8 text
+func (s *server) decodedScrollback(c liblush.Cmd, stream string) (string, error) {
+	raw, offset := cmdStream(c, stream).Scrollback().Snapshot()
+	enc := s.streamEncoding(c.Id(), stream)
+	// once the scrollback has wrapped it can start halfway a UTF-16 unit
+	if offset%2 == 1 && len(raw) > 0 {
+		if enc == encodingAuto {
+			if guess := sniffEncoding(raw[1:]); guess == encodingUtf16le || guess == encodingUtf16be {
+				enc = guess
+			}
+		}
+		if enc == encodingUtf16le || enc == encodingUtf16be {
+			raw = raw[1:]
+		}
+	}
+	dec, err := newDecoder(enc)
+	if err != nil {
+		return "", err
+	}
+	// a character cut off at the end might still be completed: leave it out
+	return string(dec.decode(raw)), nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.encodings = map[streamKey]string{}
+	})
+}
@@ -0,0 +1,132 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// feed input to a fresh decoder one byte at a time
+func decodeBytewise(t *testing.T, encoding string, input []byte) string {
+	dec, err := newDecoder(encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	for i := range input {
+		out = append(out, dec.decode(input[i:i+1])...)
+	}
+	return string(append(out, dec.flush()...))
+}
+
+func TestDecoders(t *testing.T) {
+	tests := []struct {
+		encoding string
+		input    []byte
+		expected string
+	}{
+		{encodingUtf8, []byte("h\xc3\xa9 \xf0\x9f\x98\x80"), "hé 😀"},
+		{encodingUtf8, []byte("bad\xff\xc3"), "bad��"},
+		{encodingLatin1, []byte("caf\xe9"), "café"},
+		{encodingUtf16le, []byte("h\x00\xe9\x00=\xd8\x00\xde"), "hé😀"},
+		{encodingUtf16be, []byte("\x00h\x00\xe9\xd8=\xde\x00"), "hé😀"},
+	}
+	for _, test := range tests {
+		if out := decodeBytewise(t, test.encoding, test.input); out != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.encoding, test.expected, out)
+		}
+	}
+	if _, err := newDecoder("ebcdic"); err == nil {
+		t.Errorf("Expected error for unknown encoding")
+	}
+}
+
+func TestSniffEncoding(t *testing.T) {
+	tests := map[string]string{
+		"plain ascii":               encodingUtf8,
+		"caf\xc3\xa9 cut \xe2\x82":  encodingUtf8,
+		"caf\xe9!":                  encodingLatin1,
+		"\xff\xfeh\x00":             encodingUtf16le,
+		"h\x00e\x00l\x00l\x00o\x00": encodingUtf16le,
+		"\x00h\x00e\x00l\x00l\x00o": encodingUtf16be,
+		"\xef\xbb\xbfwith bom \xff": encodingUtf8,
+	}
+	for input, expected := range tests {
+		if enc := sniffEncoding([]byte(input)); enc != expected {
+			t.Errorf("%q: expected %s, got %s", input, expected, enc)
+		}
+	}
+}
+
+func TestDecodingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	dw := newDecodingWriter(func() string { return encodingAuto }, &buf)
+	dw.Write([]byte("caf\xe9 "))
+	dw.Write([]byte("\xe0 la carte"))
+	dw.Close()
+	if buf.String() != "café à la carte" {
+		t.Errorf("Unexpected decoded output: %q", buf.String())
+	}
+}
+
+func TestDecodingWriterEncodingChange(t *testing.T) {
+	var buf bytes.Buffer
+	enc := encodingLatin1
+	dw := newDecodingWriter(func() string { return enc }, &buf)
+	dw.Write([]byte("caf\xe9 "))
+	enc = encodingUtf16le
+	dw.Write([]byte("o\x00k\x00"))
+	if buf.String() != "café ok" {
+		t.Errorf("Unexpected output after changing the encoding: %q", buf.String())
+	}
+}
+
+func TestDecodedScrollbackWrapped(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "true",
+		StdoutScrollback: 5,
+		StdoutEncoding:   encodingUtf16le,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first byte no longer fits
+	c.Stdout().Scrollback().Write([]byte("h\x00i\x00!\x00"))
+	text, err := s.decodedScrollback(c, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "i!" {
+		t.Errorf("Unexpected scrollback: %q", text)
+	}
+	// nothing kept at all
+	c.Stdout().Scrollback().Resize(0)
+	c.Stdout().Scrollback().Write([]byte("x"))
+	for _, enc := range []string{encodingUtf16le, encodingAuto} {
+		s.setStreamEncoding(c.Id(), "stdout", enc)
+		text, err = s.decodedScrollback(c, "stdout")
+		if err != nil || text != "" {
+			t.Errorf("Unexpected empty scrollback (%s): %q, %v", enc, text, err)
+		}
+	}
+}
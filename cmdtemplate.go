@@ -0,0 +1,407 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Saved command templates: named commands or pipelines with typed
+// placeholders, stored on disk so they can be shared.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// {{name}} in the cmd or args of a template is replaced by the value of
+// parameter "name"
+var placeholderRegexp = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+type templateParam struct {
+	Name string `json:"name"`
+	// string, file, enum or int
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	// value used when instantiating without one. empty means the parameter is
+	// required.
+	Default string `json:"default,omitempty"`
+	// allowed values of an enum
+	Choices []string `json:"choices,omitempty"`
+}
+
+type templateCmd struct {
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+	// name of the instantiated command (default: its argv)
+	Name string `json:"name,omitempty"`
+}
+
+type cmdTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      []templateParam `json:"params"`
+	// more than one command makes a pipeline: the stdout of every command is
+	// connected to the stdin of the next.
+	Cmds []templateCmd `json:"cmds"`
+}
+
+// check a value for this parameter
+func (p templateParam) check(value string) error {
+	switch p.Type {
+	case "string":
+		return nil
+	case "file":
+		if value == "" {
+			return fmt.Errorf("%s: empty file path", p.Name)
+		}
+		return nil
+	case "int":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%s: not an integer: %q", p.Name, value)
+		}
+		return nil
+	case "enum":
+		for _, choice := range p.Choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: must be one of %q, got %q", p.Name, p.Choices, value)
+	}
+	return fmt.Errorf("%s: unknown parameter type: %q", p.Name, p.Type)
+}
+
+func (t *cmdTemplate) validate() error {
+	if t.Name == "" {
+		return errors.New("template needs a name")
+	}
+	if len(t.Cmds) == 0 {
+		return errors.New("template needs at least one command")
+	}
+	declared := map[string]bool{}
+	for _, p := range t.Params {
+		if p.Name == "" {
+			return errors.New("template parameter needs a name")
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("duplicate parameter: %s", p.Name)
+		}
+		declared[p.Name] = true
+		switch p.Type {
+		case "string", "file", "int":
+		case "enum":
+			if len(p.Choices) == 0 {
+				return fmt.Errorf("%s: enum without choices", p.Name)
+			}
+		default:
+			return fmt.Errorf("%s: unknown parameter type: %q", p.Name, p.Type)
+		}
+		if p.Default != "" {
+			if err := p.check(p.Default); err != nil {
+				return fmt.Errorf("illegal default value: %v", err)
+			}
+		}
+	}
+	for _, c := range t.Cmds {
+		if c.Cmd == "" {
+			return errors.New("empty command in template")
+		}
+		for _, word := range append([]string{c.Cmd}, c.Args...) {
+			for _, m := range placeholderRegexp.FindAllStringSubmatch(word, -1) {
+				if !declared[m[1]] {
+					return fmt.Errorf("undeclared parameter in %q: %s", word, m[1])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// argv of every command in the template with these parameter values filled
+// in. missing values are taken from the defaults.
+func (t *cmdTemplate) argvs(values map[string]string) ([][]string, error) {
+	resolved := map[string]string{}
+	for _, p := range t.Params {
+		v, ok := values[p.Name]
+		if !ok {
+			if p.Default == "" {
+				return nil, fmt.Errorf("missing value for parameter %s", p.Name)
+			}
+			v = p.Default
+		}
+		if err := p.check(v); err != nil {
+			return nil, err
+		}
+		resolved[p.Name] = v
+	}
+	for name := range values {
+		if _, ok := resolved[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter: %s", name)
+		}
+	}
+	subst := func(word string) string {
+		return placeholderRegexp.ReplaceAllStringFunc(word, func(m string) string {
+			return resolved[m[2:len(m)-2]]
+		})
+	}
+	argvs := make([][]string, len(t.Cmds))
+	for i, c := range t.Cmds {
+		argv := []string{subst(c.Cmd)}
+		for _, arg := range c.Args {
+			argv = append(argv, subst(arg))
+		}
+		argvs[i] = argv
+	}
+	return argvs, nil
+}
+
+// templates are stored as a JSON array in a single file. the file is read
+// again for every operation so changes by other people sharing it are picked
+// up straight away.
+type templateStore struct {
+	path string
+	l    sync.Mutex
+}
+
+func defaultTemplatesPath() string {
+	return filepath.Join(homeDir(), ".lush", "templates.json")
+}
+
+func (ts *templateStore) load() (map[string]*cmdTemplate, error) {
+	templates := map[string]*cmdTemplate{}
+	data, err := ioutil.ReadFile(ts.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return templates, nil
+		}
+		return nil, err
+	}
+	var list []*cmdTemplate
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt templates file %s: %v", ts.path, err)
+	}
+	for _, t := range list {
+		templates[t.Name] = t
+	}
+	return templates, nil
+}
+
+func sortedTemplates(templates map[string]*cmdTemplate) []*cmdTemplate {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*cmdTemplate, len(names))
+	for i, name := range names {
+		list[i] = templates[name]
+	}
+	return list
+}
+
+func (ts *templateStore) save(templates map[string]*cmdTemplate) error {
+	data, err := json.MarshalIndent(sortedTemplates(templates), "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(ts.path), 0755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first to never leave a half-written file
+	tmp := ts.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, ts.path)
+}
+
+func (ts *templateStore) List() ([]*cmdTemplate, error) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	templates, err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	return sortedTemplates(templates), nil
+}
+
+func (ts *templateStore) Get(name string) (*cmdTemplate, error) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	templates, err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	t := templates[name]
+	if t == nil {
+		return nil, fmt.Errorf("no such template: %s", name)
+	}
+	return t, nil
+}
+
+// add a template or replace the one with the same name
+func (ts *templateStore) Put(t *cmdTemplate) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	templates, err := ts.load()
+	if err != nil {
+		return err
+	}
+	templates[t.Name] = t
+	return ts.save(templates)
+}
+
+func (ts *templateStore) Delete(name string) error {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	templates, err := ts.load()
+	if err != nil {
+		return err
+	}
+	if templates[name] == nil {
+		return fmt.Errorf("no such template: %s", name)
+	}
+	delete(templates, name)
+	return ts.save(templates)
+}
+
+// list all templates
+// eg templates;
+func wseventTemplates(s *server, _ string) error {
+	list, err := s.templates.List()
+	if err != nil {
+		return lushError{err}
+	}
+	return writePrefixedJson(&s.ctrlclients, "templates;", list)
+}
+
+// create or update a template
+// eg savetemplate;{"name":"logs","params":[{"name":"host","type":"string"}],"cmds":[{"cmd":"ssh","args":["{{host}}","tail","/var/log/syslog"]}]}
+func wseventSavetemplate(s *server, templateJSON string) error {
+	var t cmdTemplate
+	err := json.Unmarshal([]byte(templateJSON), &t)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	err = s.templates.Put(&t)
+	if err != nil {
+		return lushError{fmt.Errorf("failed to save template: %v", err)}
+	}
+	return wseventTemplates(s, "")
+}
+
+// eg deltemplate;logs
+func wseventDeltemplate(s *server, name string) error {
+	err := s.templates.Delete(name)
+	if err != nil {
+		return lushError{err}
+	}
+	return wseventTemplates(s, "")
+}
+
+// create the commands described by a template. generates a newcmd event for
+// every command, followed by:
+//
+//     instantiated;{"name":"logs","cmds":[4,5]}
+//
+// the commands belong to the client that instantiated them.
+//
+// eg instantiate;{"name":"logs","params":{"host":"web1"},"start":true}
+func wseventInstantiate(s *server, client wsClient, reqJSON string) error {
+	var req struct {
+		Name     string
+		Params   map[string]string
+		Start    bool
+		UserData interface{}
+	}
+	err := json.Unmarshal([]byte(reqJSON), &req)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	t, err := s.templates.Get(req.Name)
+	if err != nil {
+		return lushError{err}
+	}
+	argvs, err := t.argvs(req.Params)
+	if err != nil {
+		return lushError{fmt.Errorf("cannot instantiate %s: %v", t.Name, err)}
+	}
+	cmds := make([]liblush.Cmd, len(argvs))
+	ids := make([]liblush.CmdId, len(argvs))
+	for i, argv := range argvs {
+		name := t.Cmds[i].Name
+		if name == "" {
+			name = strings.Join(argv, " ")
+		}
+		cmds[i], err = newCommand(s, cmdOptions{
+			Cmd:              argv[0],
+			Args:             argv[1:],
+			Name:             name,
+			StdoutScrollback: defaultScrollback,
+			StderrScrollback: defaultScrollback,
+			UserData:         req.UserData,
+			owner:            client.principal.name,
+		})
+		if err != nil {
+			return err
+		}
+		ids[i] = cmds[i].Id()
+		if i > 0 {
+			err = wseventConnect(s, fmt.Sprintf(`{"from":%d,"to":%d,"stream":"stdout"}`, ids[i-1], ids[i]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if req.Start {
+		// start the end of the pipeline first so nobody writes to a command
+		// that is not running yet
+		for i := len(cmds) - 1; i >= 0; i-- {
+			if err := cmds[i].Start(); err != nil && cmds[i].Status().Err() == nil {
+				return lushError{fmt.Errorf("Couldn't start command: %v", err)}
+			}
+		}
+	}
+	return writePrefixedJson(&s.ctrlclients, "instantiated;", map[string]interface{}{
+		"name": t.Name,
+		"cmds": ids,
+	})
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.templates = &templateStore{path: defaultTemplatesPath()}
+	})
+}
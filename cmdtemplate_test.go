@@ -0,0 +1,125 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testTemplate() *cmdTemplate {
+	return &cmdTemplate{
+		Name: "grep",
+		Params: []templateParam{
+			{Name: "pattern", Type: "string"},
+			{Name: "file", Type: "file", Default: "/var/log/syslog"},
+			{Name: "count", Type: "int", Default: "10"},
+			{Name: "case", Type: "enum", Choices: []string{"-i", "-s"}, Default: "-s"},
+		},
+		Cmds: []templateCmd{
+			{Cmd: "grep", Args: []string{"{{case}}", "{{pattern}}", "{{file}}"}},
+			{Cmd: "tail", Args: []string{"-n{{count}}"}},
+		},
+	}
+}
+
+func TestTemplateValidate(t *testing.T) {
+	tmpl := testTemplate()
+	if err := tmpl.validate(); err != nil {
+		t.Errorf("unexpected error validating template: %v", err)
+	}
+	tmpl.Cmds[1].Args = []string{"{{lines}}"}
+	if err := tmpl.validate(); err == nil {
+		t.Errorf("expected error for undeclared parameter")
+	}
+	tmpl = testTemplate()
+	tmpl.Params[2].Default = "ten"
+	if err := tmpl.validate(); err == nil {
+		t.Errorf("expected error for illegal int default")
+	}
+	tmpl = testTemplate()
+	tmpl.Params[0].Type = "float"
+	if err := tmpl.validate(); err == nil {
+		t.Errorf("expected error for unknown parameter type")
+	}
+}
+
+func TestTemplateArgvs(t *testing.T) {
+	tmpl := testTemplate()
+	argvs, err := tmpl.argvs(map[string]string{"pattern": "kernel panic", "count": "3"})
+	if err != nil {
+		t.Fatalf("unexpected error instantiating template: %v", err)
+	}
+	expected := [][]string{
+		{"grep", "-s", "kernel panic", "/var/log/syslog"},
+		{"tail", "-n3"},
+	}
+	if !reflect.DeepEqual(argvs, expected) {
+		t.Errorf("expected %q, got %q", expected, argvs)
+	}
+	if _, err = tmpl.argvs(map[string]string{}); err == nil {
+		t.Errorf("expected error for missing required parameter")
+	}
+	if _, err = tmpl.argvs(map[string]string{"pattern": "x", "case": "-v"}); err == nil {
+		t.Errorf("expected error for illegal enum value")
+	}
+	if _, err = tmpl.argvs(map[string]string{"pattern": "x", "foo": "bar"}); err == nil {
+		t.Errorf("expected error for unknown parameter")
+	}
+}
+
+func TestTemplateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lushtemplates")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ts := &templateStore{path: filepath.Join(dir, "sub", "templates.json")}
+	list, err := ts.List()
+	if err != nil || len(list) != 0 {
+		t.Errorf("expected empty list from missing file, got %v (%v)", list, err)
+	}
+	err = ts.Put(testTemplate())
+	if err != nil {
+		t.Fatalf("failed to save template: %v", err)
+	}
+	// somebody else sharing the same file
+	other := &templateStore{path: ts.path}
+	tmpl, err := other.Get("grep")
+	if err != nil {
+		t.Fatalf("failed to load saved template: %v", err)
+	}
+	if !reflect.DeepEqual(tmpl, testTemplate()) {
+		t.Errorf("template changed by saving: %#v", tmpl)
+	}
+	if err = ts.Put(&cmdTemplate{Name: "broken"}); err == nil {
+		t.Errorf("expected error saving invalid template")
+	}
+	if err = other.Delete("grep"); err != nil {
+		t.Errorf("failed to delete template: %v", err)
+	}
+	if _, err = ts.Get("grep"); err == nil {
+		t.Errorf("expected error getting deleted template")
+	}
+}
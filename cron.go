@@ -0,0 +1,162 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parsed crontab time specification. every field is a bitset of the values
+// that match.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// if both day of month and day of week are restricted (i.e. not *), a day
+	// matches if either does. that's how cron does it.
+	domStar, dowStar bool
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parse one field of a crontab line, e.g. "1-10/2,30". returns the bitset and
+// whether the field was an unrestricted "*".
+func parseCronField(field string, min, max int) (uint64, bool, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangestr := part
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, false, fmt.Errorf("illegal step in %q", part)
+			}
+			rangestr = part[:i]
+		}
+		lo, hi := min, max
+		if rangestr != "*" {
+			bounds := strings.SplitN(rangestr, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, false, fmt.Errorf("illegal value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, false, fmt.Errorf("illegal value in %q", part)
+				}
+			} else if step != 1 {
+				// 5/15 means 5-max/15
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, false, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, field == "*", nil
+}
+
+// parse a standard five field crontab time specification (minute hour
+// day-of-month month day-of-week) or one of the @shorthands (@daily, ...)
+func parseCron(line string) (*cronSpec, error) {
+	if full, ok := cronShorthands[line]; ok {
+		line = full
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		return nil, errors.New("cron spec needs 5 fields: minute hour dom month dow")
+	}
+	var spec cronSpec
+	var err error
+	if spec.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.dom, spec.domStar, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if spec.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.dow, spec.dowStar, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// both 0 and 7 are sunday
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	return &spec, nil
+}
+
+func (spec *cronSpec) dayMatches(t time.Time) bool {
+	dom := spec.dom&(1<<uint(t.Day())) != 0
+	dow := spec.dow&(1<<uint(t.Weekday())) != 0
+	if spec.domStar || spec.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// first time strictly after t that matches this spec. zero time if none is
+// found within five years (e.g. 30 february).
+func (spec *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if spec.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,70 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func cronNext_testaux(t *testing.T, spec, from, expected string) {
+	const layout = "2006-01-02 15:04"
+	c, err := parseCron(spec)
+	if err != nil {
+		t.Errorf("%q: unexpected parse error: %v", spec, err)
+		return
+	}
+	start, _ := time.Parse(layout, from)
+	next := c.Next(start)
+	if s := next.Format(layout); s != expected {
+		t.Errorf("%q after %s: got %s, expected %s", spec, from, s, expected)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	cronNext_testaux(t, "* * * * *", "2014-03-01 12:00", "2014-03-01 12:01")
+	cronNext_testaux(t, "*/15 * * * *", "2014-03-01 12:07", "2014-03-01 12:15")
+	cronNext_testaux(t, "30 2 * * *", "2014-03-01 12:00", "2014-03-02 02:30")
+	cronNext_testaux(t, "0 9-17/4 * * *", "2014-03-01 13:00", "2014-03-01 17:00")
+	cronNext_testaux(t, "@monthly", "2014-12-15 00:00", "2015-01-01 00:00")
+	// 2014-03-01 was a saturday
+	cronNext_testaux(t, "0 0 * * 1", "2014-03-01 00:00", "2014-03-03 00:00")
+	cronNext_testaux(t, "0 0 * * 7", "2014-03-01 00:00", "2014-03-02 00:00")
+	// either the 10th or a monday
+	cronNext_testaux(t, "0 0 10 * 1", "2014-03-04 00:00", "2014-03-10 00:00")
+	cronNext_testaux(t, "0 0 29 2 *", "2014-03-01 00:00", "2016-02-29 00:00")
+}
+
+func TestCronParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q: expected parse error", spec)
+		}
+	}
+}
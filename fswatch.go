@@ -0,0 +1,269 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Re-run a command when files in a directory change.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// time without changes before re-running, when not specified
+const defaultDebounce = 300 * time.Millisecond
+
+// recursive directory watcher (implementation is platform specific)
+type fsWatcher interface {
+	// paths of changed files
+	Events() <-chan string
+	Close() error
+}
+
+type fsTrigger struct {
+	cmd  liblush.Cmd
+	dir  string
+	glob string
+	// wait until there were no changes for this long
+	debounce time.Duration
+	// stop a still running previous instance instead of waiting for it
+	kill        bool
+	watcher     fsWatcher
+	l           sync.Mutex
+	lastTrigger string
+	runs        int
+	// held while a run is set up, so unfswatch can wait for it
+	runl    sync.Mutex
+	stopped bool
+}
+
+type fsTriggerInfo struct {
+	Dir  string `json:"dir"`
+	Glob string `json:"glob"`
+	Kill bool   `json:"kill"`
+	// file that caused the most recent run
+	LastTrigger string `json:"lastTrigger"`
+	Runs        int    `json:"runs"`
+}
+
+func (t *fsTrigger) info() fsTriggerInfo {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return fsTriggerInfo{
+		Dir:         t.dir,
+		Glob:        t.glob,
+		Kill:        t.kill,
+		LastTrigger: t.lastTrigger,
+		Runs:        t.runs,
+	}
+}
+
+// a glob without a path separator matches the file name in any directory,
+// otherwise it matches the path relative to the watched directory.
+func (t *fsTrigger) matches(path string) bool {
+	if !strings.ContainsRune(t.glob, filepath.Separator) {
+		ok, _ := filepath.Match(t.glob, filepath.Base(path))
+		return ok
+	}
+	rel, err := filepath.Rel(t.dir, path)
+	if err != nil {
+		return false
+	}
+	ok, _ := filepath.Match(t.glob, rel)
+	return ok
+}
+
+func (t *fsTrigger) loop(s *server) {
+	events := t.watcher.Events()
+	for path := range events {
+		if !t.matches(path) {
+			continue
+		}
+		// wait until things calm down
+		quiet := time.After(t.debounce)
+	debounce:
+		for {
+			select {
+			case p, ok := <-events:
+				if !ok {
+					return
+				}
+				if t.matches(p) {
+					path = p
+					quiet = time.After(t.debounce)
+				}
+			case <-quiet:
+				break debounce
+			}
+		}
+		t.rerun(s, path)
+	}
+}
+
+func (t *fsTrigger) rerun(s *server, path string) {
+	if s.session.GetCommand(t.cmd.Id()) == nil {
+		// released
+		s.unfswatch(t.cmd.Id(), t)
+		return
+	}
+	if isRunning(t.cmd) {
+		if t.kill {
+			t.cmd.Signal(StopSignal)
+		}
+		t.cmd.Wait()
+	}
+	t.runl.Lock()
+	if t.stopped {
+		t.runl.Unlock()
+		return
+	}
+	err := t.cmd.Reset()
+	if err != nil {
+		t.runl.Unlock()
+		s.web.Logger.Printf("fswatch %d: %v", t.cmd.Id(), err)
+		return
+	}
+	t.cmd.Stdout().Scrollback().Clear()
+	t.cmd.Stderr().Scrollback().Clear()
+	t.cmd.Start()
+	t.runl.Unlock()
+	t.l.Lock()
+	t.lastTrigger = path
+	t.runs++
+	t.l.Unlock()
+	notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(t.cmd.Id()),
+		Propname: "fswatch",
+		Value:    t.info(),
+	})
+}
+
+func (s *server) getFswatch(id liblush.CmdId) *fsTrigger {
+	s.fswatcheslock.Lock()
+	defer s.fswatcheslock.Unlock()
+	return s.fswatches[id]
+}
+
+// stop re-running a command on file changes. if t is not nil only stop if
+// that is still the active trigger.
+func (s *server) unfswatch(id liblush.CmdId, t *fsTrigger) bool {
+	s.fswatcheslock.Lock()
+	cur := s.fswatches[id]
+	if cur == nil || (t != nil && cur != t) {
+		s.fswatcheslock.Unlock()
+		return false
+	}
+	cur.watcher.Close()
+	delete(s.fswatches, id)
+	s.fswatcheslock.Unlock()
+	// a run that is being set up right now still starts, none after that
+	cur.runl.Lock()
+	cur.stopped = true
+	cur.runl.Unlock()
+	return true
+}
+
+// re-create and start a command whenever a file matching glob changes in dir
+// (or a subdirectory). progress is reported as updates of the fswatch
+// property.
+//
+// eg fswatch;{"nid":3,"dir":"src","glob":"*.go","debounce":0.5,"kill":true}
+func wseventFswatch(s *server, optionsJSON string) error {
+	var options struct {
+		Id       liblush.CmdId `json:"nid"`
+		Dir      string
+		Glob     string
+		Debounce float64
+		Kill     bool
+	}
+	err := json.Unmarshal([]byte(optionsJSON), &options)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	c := s.session.GetCommand(options.Id)
+	if c == nil {
+		return fmt.Errorf("no such command: %d", options.Id)
+	}
+	if options.Dir == "" {
+		options.Dir = "."
+	}
+	if options.Glob == "" {
+		options.Glob = "*"
+	}
+	if _, err = filepath.Match(options.Glob, ""); err != nil {
+		return lushError{fmt.Errorf("illegal glob %q: %v", options.Glob, err)}
+	}
+	dir, err := filepath.Abs(options.Dir)
+	if err != nil {
+		return lushError{err}
+	}
+	t := &fsTrigger{
+		cmd:      c,
+		dir:      dir,
+		glob:     options.Glob,
+		debounce: time.Duration(options.Debounce * float64(time.Second)),
+		kill:     options.Kill,
+	}
+	if t.debounce <= 0 {
+		t.debounce = defaultDebounce
+	}
+	s.fswatcheslock.Lock()
+	defer s.fswatcheslock.Unlock()
+	if s.fswatches[c.Id()] != nil {
+		return lushError{fmt.Errorf("command %d already watches files", c.Id())}
+	}
+	t.watcher, err = newFsWatcher(dir)
+	if err != nil {
+		return lushError{fmt.Errorf("cannot watch %s: %v", dir, err)}
+	}
+	s.fswatches[c.Id()] = t
+	go t.loop(s)
+	return notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(c.Id()),
+		Propname: "fswatch",
+		Value:    t.info(),
+	})
+}
+
+// eg unfswatch;3
+func wseventUnfswatch(s *server, idstr string) error {
+	id, _ := liblush.ParseCmdId(idstr)
+	if !s.unfswatch(id, nil) {
+		return lushError{errors.New("command does not watch files: " + idstr)}
+	}
+	return notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(id),
+		Propname: "fswatch",
+		Value:    nil,
+	})
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.fswatches = map[liblush.CmdId]*fsTrigger{}
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// recursive directory watcher using inotify
+type inotifyWatcher struct {
+	f      *os.File
+	events chan string
+	stop   chan bool
+	// watch descriptor -> directory
+	dirs map[int32]string
+}
+
+func (w *inotifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.stop)
+	// also interrupts the read loop
+	return w.f.Close()
+}
+
+// watch this directory and all its subdirectories (except hidden ones)
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(int(w.f.Fd()), path, inotifyMask)
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) loop() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + syscall.SizeofInotifyEvent
+			off = nameStart + int(ev.Len)
+			name := strings.TrimRight(string(buf[nameStart:off]), "\x00")
+			dir, ok := w.dirs[ev.Wd]
+			if !ok || name == "" {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if ev.Mask&syscall.IN_ISDIR != 0 {
+				if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					w.addTree(path)
+				}
+				continue
+			}
+			select {
+			case w.events <- path:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+func newFsWatcher(dir string) (fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		// non-blocking: reads go through the runtime poller, so Close
+		// interrupts them
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan string),
+		stop:   make(chan bool),
+		dirs:   map[int32]string{},
+	}
+	err = w.addTree(dir)
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.loop()
+	return w, nil
+}
@@ -0,0 +1,113 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const fsPollInterval = time.Second
+
+// poor man's recursive directory watcher: compare modification times every
+// second
+type pollWatcher struct {
+	root   string
+	events chan string
+	stop   chan bool
+}
+
+func (w *pollWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.stop)
+	return nil
+}
+
+func (w *pollWatcher) scan() map[string]time.Time {
+	mtimes := map[string]time.Time{}
+	filepath.Walk(w.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			if path != w.root && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mtimes[path] = fi.ModTime()
+		return nil
+	})
+	return mtimes
+}
+
+func (w *pollWatcher) loop() {
+	defer close(w.events)
+	old := w.scan()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(fsPollInterval):
+		}
+		cur := w.scan()
+		var changed []string
+		for path, mtime := range cur {
+			if oldtime, ok := old[path]; !ok || !oldtime.Equal(mtime) {
+				changed = append(changed, path)
+			}
+		}
+		for path := range old {
+			if _, ok := cur[path]; !ok {
+				changed = append(changed, path)
+			}
+		}
+		for _, path := range changed {
+			select {
+			case w.events <- path:
+			case <-w.stop:
+				return
+			}
+		}
+		old = cur
+	}
+}
+
+func newFsWatcher(dir string) (fsWatcher, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	w := &pollWatcher{
+		root:   dir,
+		events: make(chan string),
+		stop:   make(chan bool),
+	}
+	go w.loop()
+	return w, nil
+}
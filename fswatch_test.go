@@ -0,0 +1,98 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lushfswatch")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create subdir: %v", err)
+	}
+	w, err := newFsWatcher(dir)
+	if err != nil {
+		t.Fatalf("failed to watch %s: %v", dir, err)
+	}
+	defer w.Close()
+	expected := filepath.Join(dir, "sub", "main.go")
+	err = ioutil.WriteFile(expected, []byte("package main\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	select {
+	case path := <-w.Events():
+		if path != expected {
+			t.Errorf("expected change in %s, got %s", expected, path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no event for changed file")
+	}
+}
+
+func TestFsTriggerMatches(t *testing.T) {
+	trig := &fsTrigger{dir: "/src", glob: "*.go"}
+	if !trig.matches("/src/lib/foo.go") {
+		t.Errorf("*.go should match files in subdirectories")
+	}
+	if trig.matches("/src/foo.go.orig") {
+		t.Errorf("*.go should not match foo.go.orig")
+	}
+	trig.glob = filepath.Join("lib", "*.go")
+	if !trig.matches("/src/lib/foo.go") || trig.matches("/src/foo.go") {
+		t.Errorf("lib/*.go should only match files in lib")
+	}
+}
+
+func TestFswatchRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lushfswatch")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{Cmd: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody is connected to be notified
+	wseventFswatch(s, fmt.Sprintf(`{"nid":%d,"dir":%q}`, c.Id(), dir))
+	if s.getFswatch(c.Id()) == nil {
+		t.Fatal("command does not watch files")
+	}
+	if err = s.releaseCommand(c.Id()); err != nil {
+		t.Fatal(err)
+	}
+	if s.getFswatch(c.Id()) != nil {
+		t.Error("released command still watches files")
+	}
+}
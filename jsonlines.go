@@ -0,0 +1,349 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Structured output: split a stream in lines, parse every line as a JSON
+// object and keep the most recent ones in a buffer that can be queried.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/web"
+)
+
+// number of records returned by a query when not specified
+const defaultRecordsPage = 100
+
+// longer lines are counted as invalid and skipped, so a stream without
+// newlines can't grow the buffer forever
+const maxRecordLine = 1024 * 1024
+
+type jsonRecord struct {
+	// sequence number of this record in the stream, starting at 1
+	Seq  int                    `json:"seq"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// peeker of an output stream that parses json lines
+type recordBuffer struct {
+	key   streamKey
+	limit int
+	// incomplete last line
+	partial []byte
+	// the rest of the current line is skipped: it is too long
+	skipping bool
+	records  []jsonRecord
+	// number of records ever parsed
+	seq int
+	// lines that were not a JSON object
+	invalid int
+	// called for every new record
+	onRecord func(jsonRecord)
+	l        sync.Mutex
+}
+
+func newRecordBuffer(key streamKey, limit int, onRecord func(jsonRecord)) *recordBuffer {
+	return &recordBuffer{key: key, limit: limit, onRecord: onRecord}
+}
+
+func (rb *recordBuffer) parseLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var data map[string]interface{}
+	if json.Unmarshal(line, &data) != nil || data == nil {
+		rb.invalid++
+		return
+	}
+	rb.seq++
+	rec := jsonRecord{Seq: rb.seq, Time: time.Now(), Data: data}
+	rb.records = append(rb.records, rec)
+	if len(rb.records) > rb.limit {
+		rb.records = rb.records[len(rb.records)-rb.limit:]
+	}
+	if rb.onRecord != nil {
+		rb.onRecord(rec)
+	}
+}
+
+// never fails: a failing peeker would be removed from the stream
+func (rb *recordBuffer) Write(data []byte) (int, error) {
+	rb.l.Lock()
+	defer rb.l.Unlock()
+	n := len(data)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		switch {
+		case rb.skipping:
+			rb.skipping = false
+		case len(rb.partial)+i > maxRecordLine:
+			rb.invalid++
+		case len(rb.partial) > 0:
+			rb.parseLine(append(rb.partial, data[:i]...))
+		default:
+			rb.parseLine(data[:i])
+		}
+		rb.partial = nil
+		data = data[i+1:]
+	}
+	if rb.skipping {
+		return n, nil
+	}
+	if len(rb.partial)+len(data) > maxRecordLine {
+		rb.invalid++
+		rb.partial = nil
+		rb.skipping = true
+		return n, nil
+	}
+	rb.partial = append(rb.partial, data...)
+	return n, nil
+}
+
+// called when the command exits: a last line without newline is a record,
+// too. the buffer stays attached in case the command is run again.
+func (rb *recordBuffer) Close() error {
+	rb.l.Lock()
+	defer rb.l.Unlock()
+	rb.parseLine(rb.partial)
+	rb.partial = nil
+	rb.skipping = false
+	return nil
+}
+
+func (rb *recordBuffer) resize(limit int) {
+	rb.l.Lock()
+	defer rb.l.Unlock()
+	rb.limit = limit
+	if len(rb.records) > limit {
+		rb.records = rb.records[len(rb.records)-limit:]
+	}
+}
+
+// true if every field in the filter equals that of the record. strings are
+// compared as is, other values by their JSON encoding (e.g. "3", "true").
+func matchRecord(rec jsonRecord, filter map[string]string) bool {
+	for field, value := range filter {
+		v, ok := rec.Data[field]
+		if !ok {
+			return false
+		}
+		if str, ok := v.(string); ok {
+			if str != value {
+				return false
+			}
+			continue
+		}
+		enc, _ := json.Marshal(v)
+		if string(enc) != value {
+			return false
+		}
+	}
+	return true
+}
+
+type recordsPage struct {
+	Id     liblush.CmdId `json:"nid"`
+	Stream string        `json:"stream"`
+	// number of matching records in the buffer
+	Total   int          `json:"total"`
+	Offset  int          `json:"offset"`
+	Invalid int          `json:"invalid"`
+	Records []jsonRecord `json:"records"`
+}
+
+// matching records, oldest first
+func (rb *recordBuffer) query(filter map[string]string, offset, limit int) recordsPage {
+	rb.l.Lock()
+	defer rb.l.Unlock()
+	page := recordsPage{
+		Id:      rb.key.id,
+		Stream:  rb.key.stream,
+		Offset:  offset,
+		Invalid: rb.invalid,
+		Records: []jsonRecord{},
+	}
+	for _, rec := range rb.records {
+		if !matchRecord(rec, filter) {
+			continue
+		}
+		if page.Total >= offset && len(page.Records) < limit {
+			page.Records = append(page.Records, rec)
+		}
+		page.Total++
+	}
+	return page
+}
+
+func (s *server) getRecordBuffer(id liblush.CmdId, stream string) *recordBuffer {
+	s.recordslock.Lock()
+	defer s.recordslock.Unlock()
+	return s.records[streamKey{id, stream}]
+}
+
+// size of the record buffer of this stream, 0 if it is not parsed
+func (s *server) recordsLimit(id liblush.CmdId, stream string) int {
+	rb := s.getRecordBuffer(id, stream)
+	if rb == nil {
+		return 0
+	}
+	rb.l.Lock()
+	defer rb.l.Unlock()
+	return rb.limit
+}
+
+// start parsing a stream as JSON lines, keeping the last limit records. 0
+// stops parsing and discards the buffer.
+func (s *server) setRecordBuffer(c liblush.Cmd, streamname string, limit int) error {
+	stream := cmdStream(c, streamname)
+	if stream == nil {
+		return errors.New("unknown stream: " + streamname)
+	}
+	if limit < 0 {
+		return errors.New("record buffer size must not be negative")
+	}
+	key := streamKey{c.Id(), streamname}
+	s.recordslock.Lock()
+	defer s.recordslock.Unlock()
+	rb := s.records[key]
+	switch {
+	case rb != nil && limit == 0:
+		stream.Peeker().RemoveWriter(rb)
+		delete(s.records, key)
+	case rb != nil:
+		rb.resize(limit)
+	case limit > 0:
+		rb = newRecordBuffer(key, limit, func(rec jsonRecord) {
+			// not an error if nobody is listening
+			writePrefixedJson(&s.ctrlclients, "record;", map[string]interface{}{
+				"nid":    key.id,
+				"stream": key.stream,
+				"record": rec,
+			})
+		})
+		s.records[key] = rb
+		stream.Peeker().AddWriter(rb)
+	}
+	return nil
+}
+
+func (s *server) releaseRecordBuffers(id liblush.CmdId) {
+	s.recordslock.Lock()
+	defer s.recordslock.Unlock()
+	delete(s.records, streamKey{id, "stdout"})
+	delete(s.records, streamKey{id, "stderr"})
+}
+
+type recordsQuery struct {
+	Id     liblush.CmdId `json:"nid"`
+	Stream string
+	Offset int
+	Limit  int
+	Filter map[string]string
+}
+
+func (s *server) queryRecords(q recordsQuery) (recordsPage, error) {
+	rb := s.getRecordBuffer(q.Id, q.Stream)
+	if rb == nil {
+		return recordsPage{}, fmt.Errorf("%s of command %d is not parsed as JSON lines", q.Stream, q.Id)
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultRecordsPage
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	return rb.query(q.Filter, q.Offset, q.Limit), nil
+}
+
+// page through the parsed records of a stream. records are enabled per stream
+// with the stdoutRecords / stderrRecords command options.
+//
+//     records;{"nid":3,"stream":"stdout","offset":0,"limit":100,"filter":{"level":"error"}}
+//
+// reply: records;{"nid":3,"stream":"stdout","total":12,"offset":0,"invalid":0,"records":[{"seq":4,"time":"...","data":{...}},...]}
+func wseventRecords(s *server, queryJSON string) error {
+	var q recordsQuery
+	err := json.Unmarshal([]byte(queryJSON), &q)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	page, err := s.queryRecords(q)
+	if err != nil {
+		return lushError{err}
+	}
+	return writePrefixedJson(&s.ctrlclients, "records;", page)
+}
+
+// same as the records ws event. offset and limit are query parameters, all
+// other parameters filter on fields.
+func handleGetRecords(ctx *web.Context, idstr, streamname string) (recordsPage, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return recordsPage{}, err
+	}
+	s := ctx.User.(*server)
+	id, _ := liblush.ParseCmdId(idstr)
+	if s.session.GetCommand(id) == nil {
+		return recordsPage{}, web.WebError{404, "no such command: " + idstr}
+	}
+	q := recordsQuery{
+		Id:     id,
+		Stream: streamname,
+		Filter: map[string]string{},
+	}
+	for key, value := range ctx.Params {
+		var err error
+		switch key {
+		case "offset":
+			q.Offset, err = strconv.Atoi(value)
+		case "limit":
+			q.Limit, err = strconv.Atoi(value)
+		default:
+			q.Filter[key] = value
+		}
+		if err != nil {
+			return recordsPage{}, web.WebError{400, fmt.Sprintf("%s: %v", key, err)}
+		}
+	}
+	page, err := s.queryRecords(q)
+	if err != nil {
+		return recordsPage{}, web.WebError{404, err.Error()}
+	}
+	ctx.ContentType("json")
+	return page, nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.records = map[streamKey]*recordBuffer{}
+	})
+}
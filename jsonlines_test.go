@@ -0,0 +1,72 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecordBuffer(t *testing.T) {
+	var got []int
+	rb := newRecordBuffer(streamKey{1, "stdout"}, 3, func(rec jsonRecord) {
+		got = append(got, rec.Seq)
+	})
+	rb.Write([]byte(`{"level":"info","n":1}` + "\n" + `not json` + "\n" + `{"lev`))
+	rb.Write([]byte(`el":"error","n":2}` + "\n\n" + `[1,2]` + "\n"))
+	rb.Write([]byte(`{"level":"error","n":3,"ok":true}` + "\n" + `{"level":"info","n":4}`))
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 records before close, got %v", got)
+	}
+	rb.Close()
+	if len(got) != 4 {
+		t.Fatalf("Expected last line to be parsed on close, got %v", got)
+	}
+	page := rb.query(nil, 0, 10)
+	if page.Total != 3 || page.Invalid != 2 || page.Records[0].Seq != 2 {
+		t.Errorf("Unexpected page after truncating buffer: %+v", page)
+	}
+	page = rb.query(map[string]string{"level": "error"}, 1, 10)
+	if page.Total != 2 || len(page.Records) != 1 || page.Records[0].Data["n"] != 3.0 {
+		t.Errorf("Unexpected filtered page: %+v", page)
+	}
+	page = rb.query(map[string]string{"ok": "true", "n": "3"}, 0, 10)
+	if page.Total != 1 {
+		t.Errorf("Expected non-string fields to match by JSON encoding: %+v", page)
+	}
+}
+
+func TestRecordBufferLongLine(t *testing.T) {
+	rb := newRecordBuffer(streamKey{1, "stdout"}, 10, nil)
+	chunk := bytes.Repeat([]byte("x"), maxRecordLine/2)
+	for i := 0; i < 5; i++ {
+		rb.Write(chunk)
+	}
+	if len(rb.partial) > maxRecordLine {
+		t.Errorf("Partial line grew to %d bytes", len(rb.partial))
+	}
+	// the end of the long line is not a record of its own
+	rb.Write([]byte(`{"n":0}` + "\n" + `{"n":1}` + "\n"))
+	page := rb.query(nil, 0, 10)
+	if page.Total != 1 || page.Invalid != 1 || page.Records[0].Data["n"] != 1.0 {
+		t.Errorf("Unexpected page after long line: %+v", page)
+	}
+}
@@ -34,12 +34,16 @@ type CmdStatus interface {
 	Started() *time.Time
 	// When the command stopped, nil if still running / not started
 	Exited() *time.Time
+	// When the command became ready (see Cmd.SetReadinessProbe), nil if not
+	// (yet). Without a probe a command is ready as soon as it is started.
+	Ready() *time.Time
 	Success() bool
 	// nil iff Success() == true
 	Err() error
 	// Called with this status as an argument on every update. If the callback
-	// returns a non-nil error it will not be called for future updates.
-	NotifyChange(func(CmdStatus) error)
+	// returns a non-nil error it will not be called for future updates. The
+	// returned function unregisters it right away.
+	NotifyChange(func(CmdStatus) error) (remove func())
 }
 
 // Circular fifo buffer.
@@ -55,6 +59,11 @@ type Ringbuffer interface {
 	Write(data []byte) (int, error)
 	// Write the entire contents to this io.Writer
 	WriteTo(w io.Writer) (int64, error)
+	// Forget all contents (the size does not change)
+	Clear()
+	// Copy of the contents and the offset of the first byte in the stream:
+	// the number of bytes written since the last Clear that no longer fit
+	Snapshot() ([]byte, int64)
 }
 
 // Output stream of a command
@@ -81,14 +90,41 @@ type OutStream interface {
 	// something different, but that's life.
 	Peeker() *FlexibleMultiWriter
 	Scrollback() Ringbuffer
+	// Write the scrollback to w and add it as a peeker, without any output
+	// slipping through in between
+	Follow(w io.Writer) error
+	// Remember when every chunk of output was written. Off by default.
+	SetTimestamps(bool)
+	Timestamps() bool
+	// Most recent chunks of output with the time they were written, oldest
+	// first. Only as much as fits in the scrollback buffer is kept, so the
+	// first chunk can be cut short. Empty if timestamps are off.
+	Chunks() []Chunk
 }
 
-// Input stream of a command.  Writes to this stream block until the command is
-// started and fail if it has exited
+// Output written to a stream in one go
+type Chunk struct {
+	Time time.Time
+	Data []byte
+}
+
+// Input stream of a command.  Writes before the command is started are queued
+// and flushed in order once it runs. Writes fail if the command has exited.
+// Once the queue is full Write blocks until the command starts, like a pipe
+// would (this is what other commands piping into it want).
 type InStream interface {
 	io.WriteCloser
+	// Like Write, but fails with ErrStdinQueueFull instead of blocking when
+	// the queue is full. For writes on behalf of clients.
+	WriteQueued([]byte) (int, error)
 	// Command this stream belongs to (never nil)
 	Cmd() Cmd
+	// Maximum number of bytes held for a command that has not been started
+	// yet (default DefaultStdinQueueLimit).
+	SetQueueLimit(int)
+	QueueLimit() int
+	// Bytes written but not yet handed to the process
+	Queued() int
 }
 
 // A shell command state similar to os/exec.Cmd
@@ -100,12 +136,29 @@ type Cmd interface {
 	Argv() []string
 	// Error to call this after command has started
 	SetArgv([]string) error
+	// Set an environment variable for this command only (on top of the
+	// session environment). Error to call this after command has started.
+	Setenv(key, value string) error
 	// Run command and wait for it to exit
 	Run() error
-	// Start the command in the background. Follow by Wait() to get exit status
+	// Start the command in the background. Follow by Wait() to get exit status.
+	// Output streams connected to a command whose stdin has since been closed
+	// (e.g. by a previous run of this one) are disconnected first.
 	Start() error
 	// Block until command is complete return exit status
 	Wait() error
+	// Start the command in the background as soon as all deps are ready.
+	// Returns immediately. If they are not all ready within the timeout, or
+	// one of them exits before becoming ready, this command is not started
+	// and its status is set to an error.
+	StartAfter(deps []Cmd, timeout time.Duration) error
+	// Condition for this command to be considered ready once it started (nil
+	// to remove). Only affects future starts.
+	SetReadinessProbe(Probe)
+	// Prepare a command that has exited to be started again, as a fresh
+	// process with the same argv and environment. Id, name, userdata,
+	// listeners and scrollback are kept. Error if the command is running.
+	Reset() error
 	Stdin() InStream
 	Stdout() OutStream
 	Stderr() OutStream
@@ -116,9 +169,23 @@ type Cmd interface {
 	Signal(os.Signal) error
 }
 
+// Status of a command from an earlier session, see Session.RestoreCommand.
+// The zero value is a command that was never started.
+type PastStatus struct {
+	Started *time.Time
+	// must be set if Started is
+	Exited *time.Time
+	// empty if the command succeeded
+	Err string
+}
+
 type Session interface {
 	Chdir(dir string) error
 	NewCommand(name string, arg ...string) Cmd
+	// Recreate a command from an earlier session with the same id and
+	// status. A command that had exited can only be run again after a
+	// Reset(). Fails if the id is taken. Ids of new commands will be higher.
+	RestoreCommand(id CmdId, status PastStatus, argv []string) (Cmd, error)
 	GetCommand(id CmdId) Cmd
 	GetCommandIds() []CmdId
 	ReleaseCommand(id CmdId) error
@@ -26,7 +26,10 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // command life-time phases
@@ -50,13 +53,21 @@ type cmd struct {
 	id      CmdId
 	execCmd *exec.Cmd
 	status  cmdstatus
-	// Released when command finishes
-	done   sync.WaitGroup
-	stdout *richpipe
-	stderr *richpipe
-	stdin  InStream
-	name   string
-	user   interface{}
+	// closed when the current run finishes, replaced by Reset
+	done chan struct{}
+	// guards done, and execCmd while Reset replaces it: listeners of the
+	// previous run may still be reading the argv
+	donelock sync.Mutex
+	stdout   *richpipe
+	stderr   *richpipe
+	stdin    *lightpipe
+	name     string
+	user     interface{}
+	probe    Probe
+	// StartAfter is waiting for dependencies (atomic, 1 if so)
+	waiting int32
+	// released from the session (atomic, 1 if so)
+	released int32
 }
 
 func (c *cmd) Id() CmdId {
@@ -72,12 +83,14 @@ func (c *cmd) SetName(name string) {
 }
 
 func (c *cmd) Argv() []string {
+	c.donelock.Lock()
+	defer c.donelock.Unlock()
 	// copy
 	return append([]string{}, c.execCmd.Args...)
 }
 
 func (c *cmd) SetArgv(argv []string) error {
-	if c.status.started != nil {
+	if c.status.Started() != nil {
 		return errors.New("cannot change arguments after command has started")
 	}
 	if len(argv) == 0 {
@@ -87,6 +100,21 @@ func (c *cmd) SetArgv(argv []string) error {
 	return nil
 }
 
+func (c *cmd) Setenv(key, value string) error {
+	if c.status.Started() != nil {
+		return errors.New("cannot change environment after command has started")
+	}
+	prefix := key + "="
+	for i, kv := range c.execCmd.Env {
+		if strings.HasPrefix(kv, prefix) {
+			c.execCmd.Env[i] = prefix + value
+			return nil
+		}
+	}
+	c.execCmd.Env = append(c.execCmd.Env, prefix+value)
+	return nil
+}
+
 func (c *cmd) Run() error {
 	var err error
 	err = c.Start()
@@ -101,18 +129,48 @@ func (c *cmd) Start() error {
 	if wasStarted(c) {
 		return errors.New("command has already been started")
 	}
+	if atomic.LoadInt32(&c.released) != 0 {
+		// e.g. by StartAfter, when it was released while waiting
+		return errors.New("command has been released")
+	}
+	if atomic.LoadInt32(&c.waiting) != 0 {
+		return errors.New("command is waiting for its dependencies")
+	}
 	// Lookup the executable
 	p, err := exec.LookPath(c.execCmd.Args[0])
 	if err != nil {
 		p = c.execCmd.Args[0]
 	}
 	c.execCmd.Path = p
+	// the previous run closed the stdin of the command it was piped into.
+	// unless that one has been reset since, writing to it would fail and
+	// lose the output.
+	for _, out := range []*richpipe{c.stdout, c.stderr} {
+		if in, ok := out.GetListener().(*lightpipe); ok && in.isClosed() {
+			out.SetListener(Devnull)
+		}
+	}
+	var probewait func(<-chan struct{}) error
+	if ap, ok := c.probe.(attachedProbe); ok {
+		var detach func()
+		probewait, detach = ap.attach(c)
+		defer func() {
+			if err != nil {
+				detach()
+			}
+		}()
+	}
 	err = c.execCmd.Start()
 	if err != nil {
 		c.status.setErr(err)
 		return err
 	}
-	c.status.startNow()
+	c.stdin.start()
+	c.status.startNow(c.probe == nil)
+	done := c.doneChan()
+	if c.probe != nil {
+		go c.runProbe(c.probe, probewait, done, c.status.Started())
+	}
 	// TODO: cute, but needs some unit tests.
 	// also, schizos are always pair programming :D
 	// ... or D:
@@ -122,17 +180,95 @@ func (c *cmd) Start() error {
 		c.stdout.Close()
 		c.stderr.Close()
 		c.status.exitNow()
-		c.done.Done()
+		close(done)
+	}()
+	return nil
+}
+
+// wait is the probe's Wait if it was attached before starting. done and
+// started identify the run this probe is for.
+func (c *cmd) runProbe(p Probe, wait func(<-chan struct{}) error, done <-chan struct{}, started *time.Time) {
+	if wait == nil {
+		wait = func(stop <-chan struct{}) error {
+			return p.Wait(c, stop)
+		}
+	}
+	if wait(done) == nil {
+		c.status.readyNow(started)
+	}
+}
+
+func (c *cmd) SetReadinessProbe(p Probe) {
+	c.probe = p
+}
+
+func (c *cmd) StartAfter(deps []Cmd, timeout time.Duration) error {
+	if wasStarted(c) || !atomic.CompareAndSwapInt32(&c.waiting, 0, 1) {
+		return errors.New("command has already been started")
+	}
+	go func() {
+		err := waitReady(deps, timeout)
+		atomic.StoreInt32(&c.waiting, 0)
+		if err != nil {
+			c.status.setErr(err)
+			return
+		}
+		// errors end up in the status
+		c.Start()
 	}()
 	return nil
 }
 
 func (c *cmd) Wait() error {
-	if c.status.started == nil {
+	// before checking the status: a Reset in between leaves this the channel
+	// of the run that was started
+	done := c.doneChan()
+	if c.status.Started() == nil {
 		return errors.New("must start command before calling Wait()")
 	}
-	c.done.Wait()
-	return c.status.err
+	<-done
+	return c.status.Err()
+}
+
+func (c *cmd) Reset() error {
+	if isRunning(c) {
+		return errors.New("cannot reset running command")
+	}
+	if !wasStarted(c) {
+		// nothing to reset
+		return nil
+	}
+	execCmd := &exec.Cmd{
+		Args: c.execCmd.Args,
+		Env:  c.execCmd.Env,
+		Dir:  c.execCmd.Dir,
+	}
+	pw, err := execCmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+	if c.execCmd.Process != nil {
+		c.execCmd.Process.Release()
+	}
+	// same lightpipe object: other commands may be piping to it
+	c.stdin.reset(pw)
+	execCmd.Stdout = c.stdout
+	execCmd.Stderr = c.stderr
+	c.donelock.Lock()
+	c.execCmd = execCmd
+	if c.status.Started() != nil {
+		// a command that failed to start never closed its channel: reuse it
+		c.done = make(chan struct{})
+	}
+	c.donelock.Unlock()
+	c.status.reset()
+	return nil
+}
+
+func (c *cmd) doneChan() chan struct{} {
+	c.donelock.Lock()
+	defer c.donelock.Unlock()
+	return c.done
 }
 
 func (c *cmd) Stdin() InStream {
@@ -163,12 +299,12 @@ func (c *cmd) SetUserData(data interface{}) {
 // race sensitive.
 // TODO: refactor that code and remove this function
 func isRunning(c *cmd) bool {
-	return c.status.started != nil && c.status.exited == nil
+	return c.status.running()
 }
 
 // race &c
 func wasStarted(c *cmd) bool {
-	return c.status.started != nil || c.status.err != nil
+	return c.status.wasStarted()
 }
 
 func (c *cmd) Signal(sig os.Signal) error {
@@ -186,6 +322,7 @@ func (c *cmd) release() error {
 	if isRunning(c) {
 		return errors.New("cannot free running command")
 	}
+	atomic.StoreInt32(&c.released, 1)
 	var firsterr error
 	// set the firsterror to this one if not already set
 	recerr := func(e error) {
@@ -196,7 +333,11 @@ func (c *cmd) release() error {
 	if c.execCmd.Process != nil {
 		recerr(c.execCmd.Process.Release())
 	}
-	for _, cl := range []io.Closer{c.stdin, c.stdout, c.stderr} {
+	c.status.clearListeners()
+	if c.stdin != nil {
+		recerr(c.stdin.release())
+	}
+	for _, cl := range []io.Closer{c.stdout, c.stderr} {
 		if cl != nil {
 			recerr(cl.Close())
 		}
@@ -235,12 +376,12 @@ func newcmd(id CmdId, execCmd *exec.Cmd) (*cmd, error) {
 		stderr:  newRichPipe(Devnull, 1000),
 	}
 	// by doing this here it is guaranteed you can start writing to a new
-	// command's stdin, even before it is started.
+	// command's stdin, even before it is started (up to the queue limit).
 	c.stdin = newLightPipe(c, pw)
 	c.execCmd.Stdout = c.stdout
 	c.execCmd.Stderr = c.stderr
 	c.name = c.execCmd.Path
-	c.done.Add(1)
+	c.done = make(chan struct{})
 	return c, nil
 }
 
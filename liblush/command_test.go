@@ -268,3 +268,207 @@ func TestCommandIllegalAPIUse(t *testing.T) {
 		t.Errorf("expected error sending signal after .Wait()")
 	}
 }
+
+func TestCommandReset(t *testing.T) {
+	var b bytes.Buffer
+	c := newcmdPanicOnError(0, exec.Command("echo", "again"))
+	c.Stdout().SetListener(&b)
+	var err error
+	if err = c.Reset(); err != nil {
+		t.Errorf("unexpected error resetting unstarted command: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		err = c.Run()
+		if err != nil {
+			t.Fatalf("error running command (run %d): %v", i, err)
+		}
+		if err = c.Reset(); err != nil {
+			t.Fatalf("error resetting command (run %d): %v", i, err)
+		}
+		if c.Status().Started() != nil || c.Status().Exited() != nil {
+			t.Errorf("status not reset: %#v", c.Status())
+		}
+	}
+	if b.String() != "again\nagain\nagain\n" {
+		t.Errorf("unexpected output from reset command: %q", b.String())
+	}
+	c = newcmdPanicOnError(0, exec.Command("cecinestpasuncommand"))
+	if err = c.Start(); err == nil {
+		t.Fatalf("expected error starting nonexistent command")
+	}
+	if err = c.Reset(); err != nil {
+		t.Errorf("unexpected error resetting failed command: %v", err)
+	}
+	if c.Status().Err() != nil {
+		t.Errorf("error status not reset: %v", c.Status().Err())
+	}
+	c.SetArgv([]string{"echo"})
+	if err = c.Run(); err != nil {
+		t.Errorf("error running reset command: %v", err)
+	}
+}
+
+// echo hi | cat, run twice
+func TestCommandPipeReset(t *testing.T) {
+	a := newcmdPanicOnError(0, exec.Command("echo", "hi"))
+	b := newcmdPanicOnError(1, exec.Command("cat"))
+	a.Stdout().SetListener(b.Stdin())
+	var out bytes.Buffer
+	b.Stdout().SetListener(&out)
+	for i := 0; i < 2; i++ {
+		if err := startAll(b, a); err != nil {
+			t.Fatalf("error starting pipeline (run %d): %v", i, err)
+		}
+		if err := waitAll(a, b); err != nil {
+			t.Fatalf("error running pipeline (run %d): %v", i, err)
+		}
+		// upstream first: the order must not matter
+		for _, c := range []*cmd{a, b} {
+			if err := c.Reset(); err != nil {
+				t.Fatalf("error resetting command (run %d): %v", i, err)
+			}
+		}
+	}
+	if out.String() != "hi\nhi\n" {
+		t.Errorf("unexpected output from reset pipeline: %q", out.String())
+	}
+	// only rerun echo: cat is gone, the output ends up in the scrollback
+	if err := startAll(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAll(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Run(); err != nil {
+		t.Fatalf("error rerunning command piped to an exited one: %v", err)
+	}
+	if a.Stdout().GetListener() != Devnull {
+		t.Error("command still piped to a closed stdin")
+	}
+	buf := make([]byte, 20)
+	if n := a.Stdout().Scrollback().Last(buf); string(buf[:n]) != "hi\nhi\nhi\nhi\n" {
+		t.Errorf("unexpected scrollback: %q", buf[:n])
+	}
+}
+
+// others may still be waiting for a previous run when a command is reset
+func TestCommandResetWhileWaiting(t *testing.T) {
+	c := newcmdPanicOnError(0, exec.Command("true"))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		if err := c.Start(); err != nil {
+			t.Fatalf("error starting command (run %d): %v", i, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Wait()
+		}()
+		c.Wait()
+		if err := c.Reset(); err != nil {
+			t.Fatalf("error resetting command (run %d): %v", i, err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestCommandSetenv(t *testing.T) {
+	var b bytes.Buffer
+	execcmd := exec.Command("sh", "-c", "echo $LUSHA $LUSHB")
+	execcmd.Env = []string{"LUSHA=session", "LUSHB=session"}
+	c := newcmdPanicOnError(0, execcmd)
+	c.Stdout().SetListener(&b)
+	c.Setenv("LUSHB", "cmd")
+	err := c.Run()
+	if err != nil {
+		t.Fatalf("error running command: %v", err)
+	}
+	if b.String() != "session cmd\n" {
+		t.Errorf("unexpected output from command: %q", b.String())
+	}
+	if err = c.Setenv("LUSHA", "late"); err == nil {
+		t.Errorf("expected error calling .Setenv() after .Start()")
+	}
+}
+
+func TestCommandStdinQueue(t *testing.T) {
+	var b bytes.Buffer
+	c := newcmdPanicOnError(0, exec.Command("cat"))
+	c.Stdout().SetListener(&b)
+	for _, s := range []string{"hello ", "world\n"} {
+		if _, err := c.Stdin().Write([]byte(s)); err != nil {
+			t.Fatalf("error writing to stdin of unstarted command: %v", err)
+		}
+	}
+	if n := c.Stdin().Queued(); n != 12 {
+		t.Errorf("expected 12 queued bytes, got %d", n)
+	}
+	// cat only exits once the queued close reaches it
+	if err := c.Stdin().Close(); err != nil {
+		t.Fatalf("error closing stdin of unstarted command: %v", err)
+	}
+	if err := c.Run(); err != nil {
+		t.Fatalf("error running command: %v", err)
+	}
+	if b.String() != "hello world\n" {
+		t.Errorf("unexpected output from command: %q", b.String())
+	}
+	if n := c.Stdin().Queued(); n != 0 {
+		t.Errorf("expected empty queue after run, got %d bytes", n)
+	}
+	c = newcmdPanicOnError(1, exec.Command("cat"))
+	c.Stdin().SetQueueLimit(4)
+	n, err := c.Stdin().WriteQueued([]byte("toolong"))
+	if err != ErrStdinQueueFull {
+		t.Errorf("expected full queue error, got %v", err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 bytes queued, got %d", n)
+	}
+	c.release()
+	// piped writes wait for the command instead
+	b.Reset()
+	c = newcmdPanicOnError(2, exec.Command("cat"))
+	c.Stdout().SetListener(&b)
+	c.Stdin().SetQueueLimit(4)
+	written := make(chan error)
+	go func() {
+		_, err := c.Stdin().Write([]byte("toolong"))
+		written <- err
+	}()
+	select {
+	case err = <-written:
+		t.Fatalf("write beyond the queue limit did not block: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err = c.Start(); err != nil {
+		t.Fatalf("error starting command: %v", err)
+	}
+	if err = <-written; err != nil {
+		t.Errorf("error from blocked write: %v", err)
+	}
+	c.Stdin().Close()
+	c.Wait()
+	if b.String() != "toolong" {
+		t.Errorf("unexpected output after blocked write: %q", b.String())
+	}
+}
+
+func TestCommandNotifyChangeRemove(t *testing.T) {
+	c := newcmdPanicOnError(0, exec.Command("true"))
+	calls := 0
+	remove := c.Status().NotifyChange(func(CmdStatus) error {
+		calls++
+		return nil
+	})
+	remove()
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Errorf("removed listener was called %d times", calls)
+	}
+}
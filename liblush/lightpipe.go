@@ -21,20 +21,97 @@
 package liblush
 
 import (
+	"errors"
 	"io"
+	"sync"
 )
 
-// io.Pipe clone with reference to Cmd
+// Default number of bytes a command's stdin will queue before it is started
+const DefaultStdinQueueLimit = 64 * 1024
+
+var ErrStdinQueueFull = errors.New("stdin queue full")
+
+// io.Pipe clone with reference to Cmd. Until the command is started, writes
+// are queued in memory (up to a limit) and flushed in order once it runs.
+// Beyond the limit Write blocks, WriteQueued fails.
 type lightpipe struct {
 	w   io.WriteCloser
 	cmd Cmd
+	// protects all fields below, but not writes to w. when both locks are
+	// needed, wl is taken first.
+	l sync.Mutex
+	// signalled when blocked writers should look again: the command started,
+	// stdin was closed or released
+	cond     *sync.Cond
+	started  bool
+	released bool
+	queue    []byte
+	limit    int
+	// bytes taken from the queue that are still being written to w
+	flushing int
+	// Close() was called before the command started
+	closeQueued bool
+	// stdin was closed or released, until the next reset
+	closed bool
+	// serializes writes to w, including the flush of the queue
+	wl sync.Mutex
 }
 
+// Like a pipe: blocks while the queue is full until the command starts
+// reading
 func (p *lightpipe) Write(data []byte) (int, error) {
-	return p.w.Write(data)
+	return p.write(data, true)
+}
+
+func (p *lightpipe) WriteQueued(data []byte) (int, error) {
+	return p.write(data, false)
+}
+
+func (p *lightpipe) write(data []byte, block bool) (int, error) {
+	queued := 0
+	p.l.Lock()
+	for !p.started {
+		if p.closeQueued || p.released {
+			p.l.Unlock()
+			return queued, errors.New("write to closed stdin")
+		}
+		room := p.limit - len(p.queue)
+		if room < 0 {
+			room = 0
+		}
+		if len(data) <= room {
+			p.queue = append(p.queue, data...)
+			p.l.Unlock()
+			return queued + len(data), nil
+		}
+		p.queue = append(p.queue, data[:room]...)
+		queued += room
+		data = data[room:]
+		if !block {
+			p.l.Unlock()
+			return queued, ErrStdinQueueFull
+		}
+		p.cond.Wait()
+	}
+	p.l.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	n, err := p.w.Write(data)
+	return queued + n, err
 }
 
 func (p *lightpipe) Close() error {
+	p.l.Lock()
+	p.closed = true
+	if !p.started {
+		p.closeQueued = true
+		p.cond.Broadcast()
+		p.l.Unlock()
+		return nil
+	}
+	p.l.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
 	return p.w.Close()
 }
 
@@ -42,9 +119,93 @@ func (p *lightpipe) Cmd() Cmd {
 	return p.cmd
 }
 
+func (p *lightpipe) SetQueueLimit(n int) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.limit = n
+}
+
+func (p *lightpipe) QueueLimit() int {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.limit
+}
+
+func (p *lightpipe) Queued() int {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return len(p.queue) + p.flushing
+}
+
+// Called once the command is running: write the queue to the process in the
+// background and pass all subsequent writes straight through.
+func (p *lightpipe) start() {
+	// released by the flushing goroutine, making later writes wait their turn
+	p.wl.Lock()
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.started = true
+	p.cond.Broadcast()
+	queue, closeQueued := p.queue, p.closeQueued
+	p.queue = nil
+	p.closeQueued = false
+	p.flushing = len(queue)
+	w := p.w
+	go func() {
+		defer p.wl.Unlock()
+		if len(queue) > 0 {
+			// an error here means the process quit before reading its input,
+			// which is no different from what a regular pipe would do
+			w.Write(queue)
+		}
+		if closeQueued {
+			w.Close()
+		}
+		p.l.Lock()
+		p.flushing = 0
+		p.l.Unlock()
+	}()
+}
+
+// Replace the underlying writer and go back to queueing (for Cmd.Reset)
+func (p *lightpipe) reset(w io.WriteCloser) {
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.w.Close()
+	p.w = w
+	p.started = false
+	p.queue = nil
+	p.closeQueued = false
+	p.closed = false
+}
+
+// nothing written to this pipe will reach the command anymore (until it is
+// reset)
+func (p *lightpipe) isClosed() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.closed || p.released
+}
+
+// Close the underlying writer immediately, dropping anything still queued
+func (p *lightpipe) release() error {
+	p.l.Lock()
+	p.queue = nil
+	p.closeQueued = false
+	p.released = true
+	p.cond.Broadcast()
+	p.l.Unlock()
+	return p.w.Close()
+}
+
 func newLightPipe(c Cmd, w io.WriteCloser) *lightpipe {
-	return &lightpipe{
-		cmd: c,
-		w:   w,
+	p := &lightpipe{
+		cmd:   c,
+		w:     w,
+		limit: DefaultStdinQueueLimit,
 	}
+	p.cond = sync.NewCond(&p.l)
+	return p
 }
@@ -0,0 +1,206 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package liblush
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// how often to check polling probes
+const probeInterval = 100 * time.Millisecond
+
+// Readiness condition of a running command
+type Probe interface {
+	// Block until the command is ready (return nil) or until stop is closed
+	// (return non-nil)
+	Wait(c Cmd, stop <-chan struct{}) error
+}
+
+// call ready every probeInterval until it returns true
+func poll(stop <-chan struct{}, ready func() bool) error {
+	for !ready() {
+		select {
+		case <-stop:
+			return errors.New("probe stopped")
+		case <-time.After(probeInterval):
+		}
+	}
+	return nil
+}
+
+type tcpProbe string
+
+// Ready when addr (host:port) accepts TCP connections
+func TCPProbe(addr string) Probe {
+	return tcpProbe(addr)
+}
+
+func (p tcpProbe) Wait(c Cmd, stop <-chan struct{}) error {
+	return poll(stop, func() bool {
+		conn, err := net.DialTimeout("tcp", string(p), time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+type httpProbe string
+
+// Ready when a GET request to url returns a 2xx status code
+func HTTPProbe(url string) Probe {
+	return httpProbe(url)
+}
+
+func (p httpProbe) Wait(c Cmd, stop <-chan struct{}) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	return poll(stop, func() bool {
+		resp, err := client.Get(string(p))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 300
+	})
+}
+
+type outputProbe struct {
+	re *regexp.Regexp
+}
+
+// Ready when re matches the output of the command (stdout or stderr)
+func OutputProbe(re *regexp.Regexp) Probe {
+	return outputProbe{re}
+}
+
+// how much output is kept around for matching across writes
+const outputProbeWindow = 4096
+
+// scans everything written to it for a regexp
+type matchWriter struct {
+	re *regexp.Regexp
+	// called on every match
+	found func()
+	buf   []byte
+	l     sync.Mutex
+}
+
+func (w *matchWriter) Write(data []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.buf = append(w.buf, data...)
+	if w.re.Match(w.buf) {
+		w.found()
+	}
+	if len(w.buf) > outputProbeWindow {
+		w.buf = append([]byte{}, w.buf[len(w.buf)-outputProbeWindow:]...)
+	}
+	return len(data), nil
+}
+
+// probes that must be watching before the command starts
+type attachedProbe interface {
+	// start watching c. wait blocks like Probe.Wait, detach stops watching
+	// if wait is never called.
+	attach(c Cmd) (wait func(stop <-chan struct{}) error, detach func())
+}
+
+func (p outputProbe) attach(c Cmd) (func(<-chan struct{}) error, func()) {
+	matched := make(chan struct{})
+	var once sync.Once
+	found := func() {
+		once.Do(func() { close(matched) })
+	}
+	streams := []OutStream{c.Stdout(), c.Stderr()}
+	writers := make([]*matchWriter, len(streams))
+	for i, stream := range streams {
+		writers[i] = &matchWriter{re: p.re, found: found}
+		stream.Peeker().AddWriter(writers[i])
+	}
+	detach := func() {
+		for i, stream := range streams {
+			stream.Peeker().RemoveWriter(writers[i])
+		}
+	}
+	wait := func(stop <-chan struct{}) error {
+		defer detach()
+		select {
+		case <-matched:
+			return nil
+		case <-stop:
+			return errors.New("probe stopped")
+		}
+	}
+	return wait, detach
+}
+
+// Only output written after this is called can match. A command attaches its
+// probe right before starting, so output from previous runs (still in the
+// scrollback) never counts.
+func (p outputProbe) Wait(c Cmd, stop <-chan struct{}) error {
+	wait, _ := p.attach(c)
+	return wait(stop)
+}
+
+// block until all commands are ready
+func waitReady(deps []Cmd, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for _, d := range deps {
+		if err := waitDepReady(d, deadline, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitDepReady(d Cmd, deadline <-chan time.Time, timeout time.Duration) error {
+	changed := make(chan struct{}, 1)
+	// installed before the first check: no change can slip through
+	remove := d.Status().NotifyChange(func(CmdStatus) error {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	defer remove()
+	for {
+		status := d.Status()
+		if status.Ready() != nil {
+			return nil
+		}
+		if status.Exited() != nil || (status.Started() == nil && status.Err() != nil) {
+			return fmt.Errorf("dependency %s exited before it was ready", d.Name())
+		}
+		select {
+		case <-deadline:
+			return fmt.Errorf("dependency %s not ready after %v", d.Name(), timeout)
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package liblush
+
+import (
+	"net"
+	"os/exec"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// wait max 5 seconds for the command to become ready
+func waitForReady(c Cmd) bool {
+	for i := 0; i < 50 && c.Status().Ready() == nil; i++ {
+		time.Sleep(probeInterval)
+	}
+	return c.Status().Ready() != nil
+}
+
+func TestProbeOutput(t *testing.T) {
+	c := newcmdPanicOnError(0, exec.Command("sh", "-c", "echo starting; sleep 0.3; echo listening on 8080; sleep 0.3"))
+	c.SetReadinessProbe(OutputProbe(regexp.MustCompile(`listening on \d+`)))
+	err := c.Start()
+	if err != nil {
+		t.Fatalf("error starting command: %v", err)
+	}
+	if c.Status().Ready() != nil {
+		t.Errorf("command ready before probe matched")
+	}
+	if !waitForReady(c) {
+		t.Errorf("command not ready after matching output")
+	}
+	c.Wait()
+}
+
+func TestProbeOutputAfterReset(t *testing.T) {
+	c := newcmdPanicOnError(0, exec.Command("echo", "listening on 8080"))
+	c.SetReadinessProbe(OutputProbe(regexp.MustCompile(`listening on \d+`)))
+	if err := c.Run(); err != nil {
+		t.Fatalf("error running command: %v", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatalf("error resetting command: %v", err)
+	}
+	c.SetArgv([]string{"sleep", "0.5"})
+	if err := c.Start(); err != nil {
+		t.Fatalf("error restarting command: %v", err)
+	}
+	time.Sleep(2 * probeInterval)
+	if c.Status().Ready() != nil {
+		t.Errorf("output of the previous run made the command ready")
+	}
+	c.Wait()
+}
+
+func TestProbeTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	c := newcmdPanicOnError(0, exec.Command("sleep", "1"))
+	c.SetReadinessProbe(TCPProbe(l.Addr().String()))
+	c.Start()
+	if !waitForReady(c) {
+		t.Errorf("command not ready while port accepts connections")
+	}
+	c.Wait()
+}
+
+func TestStartAfter(t *testing.T) {
+	dep := newcmdPanicOnError(0, exec.Command("sleep", "1"))
+	dep.SetReadinessProbe(OutputProbe(regexp.MustCompile("never")))
+	c := newcmdPanicOnError(1, exec.Command("echo"))
+	err := c.StartAfter([]Cmd{dep}, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error from StartAfter: %v", err)
+	}
+	if err = c.Start(); err == nil {
+		t.Errorf("expected error starting a command waiting for dependencies")
+	}
+	dep.Start()
+	time.Sleep(500 * time.Millisecond)
+	if c.Status().Started() != nil {
+		t.Errorf("command started although dependency was not ready")
+	}
+	if c.Status().Err() == nil {
+		t.Errorf("expected error status after dependency timeout")
+	}
+	dep.Wait()
+	// without a probe a command is ready when it starts
+	dep = newcmdPanicOnError(2, exec.Command("sleep", "1"))
+	c = newcmdPanicOnError(3, exec.Command("echo"))
+	c.StartAfter([]Cmd{dep}, 5*time.Second)
+	dep.Start()
+	if !waitForReady(c) {
+		t.Errorf("command not started after dependency was ready")
+	}
+	if err = c.Wait(); err != nil {
+		t.Errorf("error running dependent command: %v", err)
+	}
+	dep.Wait()
+}
+
+func TestStartAfterRelease(t *testing.T) {
+	dep := newcmdPanicOnError(0, exec.Command("sleep", "1"))
+	c := newcmdPanicOnError(1, exec.Command("echo"))
+	c.StartAfter([]Cmd{dep}, 5*time.Second)
+	dep.Start()
+	if !waitForReady(c) {
+		t.Fatalf("command not started after dependency was ready")
+	}
+	c.Wait()
+	dep.status.l.Lock()
+	if n := len(dep.status.listeners); n != 0 {
+		t.Errorf("dependency still has %d listeners after the wait", n)
+	}
+	dep.status.l.Unlock()
+	// released while waiting: never started
+	c = newcmdPanicOnError(2, exec.Command("echo"))
+	later := newcmdPanicOnError(3, exec.Command("true"))
+	c.StartAfter([]Cmd{later}, 5*time.Second)
+	if err := c.release(); err != nil {
+		t.Fatal(err)
+	}
+	later.Run()
+	time.Sleep(100 * time.Millisecond)
+	if c.Status().Started() != nil {
+		t.Errorf("released command was started")
+	}
+	dep.Wait()
+}
@@ -23,6 +23,7 @@ package liblush
 import (
 	"io"
 	"sync"
+	"time"
 )
 
 // this girl just couples a scrollback buffer to a flexible multiwriter thats
@@ -33,7 +34,11 @@ type richpipe struct {
 	peeker   FlexibleMultiWriter
 	// Most recently written bytes
 	fifo Ringbuffer
-	l    sync.Mutex
+	// chunks in the fifo with their time of writing (if timestamps are on)
+	timestamps bool
+	chunks     []Chunk
+	chunkbytes int
+	l          sync.Mutex
 }
 
 func (p *richpipe) Write(data []byte) (int, error) {
@@ -50,9 +55,58 @@ func (p *richpipe) Write(data []byte) (int, error) {
 	}
 	p.peeker.Write(data)
 	p.fifo.Write(data)
+	if p.timestamps {
+		p.recordChunk(data)
+	}
 	return n, err
 }
 
+// store a copy of this chunk and forget the oldest data that no longer fits in
+// the fifo. caller must hold the lock.
+func (p *richpipe) recordChunk(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	p.chunks = append(p.chunks, Chunk{
+		Time: time.Now(),
+		Data: append([]byte(nil), data...),
+	})
+	p.chunkbytes += len(data)
+	size := p.fifo.Size()
+	for p.chunkbytes > size {
+		excess := p.chunkbytes - size
+		if first := p.chunks[0].Data; len(first) > excess {
+			p.chunks[0].Data = first[excess:]
+			p.chunkbytes = size
+		} else {
+			p.chunks = p.chunks[1:]
+			p.chunkbytes -= len(first)
+		}
+	}
+}
+
+func (p *richpipe) SetTimestamps(on bool) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.timestamps = on
+	if !on {
+		p.chunks = nil
+		p.chunkbytes = 0
+	}
+}
+
+func (p *richpipe) Timestamps() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.timestamps
+}
+
+func (p *richpipe) Chunks() []Chunk {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return append([]Chunk{}, p.chunks...)
+}
+
 func (p *richpipe) SetListener(w io.Writer) {
 	p.listener = w
 }
@@ -88,8 +142,34 @@ func (p *richpipe) Close() error {
 	return err
 }
 
+// the fifo as seen from outside: clearing it forgets the chunks too, they
+// describe the same output
+type scrollback struct {
+	Ringbuffer
+	p *richpipe
+}
+
+func (sb scrollback) Clear() {
+	sb.p.l.Lock()
+	defer sb.p.l.Unlock()
+	sb.Ringbuffer.Clear()
+	sb.p.chunks = nil
+	sb.p.chunkbytes = 0
+}
+
 func (p *richpipe) Scrollback() Ringbuffer {
-	return p.fifo
+	return scrollback{p.fifo, p}
+}
+
+func (p *richpipe) Follow(w io.Writer) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+	_, err := p.fifo.WriteTo(w)
+	if err != nil {
+		return err
+	}
+	p.peeker.AddWriter(w)
+	return nil
 }
 
 func newRichPipe(listener io.Writer, fifosize int) *richpipe {
@@ -111,3 +111,46 @@ func TestRichpipeListenerError(t *testing.T) {
 		t.Errorf("Unexpected contents in scrollback buffer: %q", string(buf))
 	}
 }
+
+func TestRichpipeChunks(t *testing.T) {
+	p := newRichPipe(Devnull, 10)
+	fmt.Fprint(p, "untimed")
+	p.SetTimestamps(true)
+	fmt.Fprint(p, "abcdef")
+	fmt.Fprint(p, "ghij")
+	chunks := p.Chunks()
+	if len(chunks) != 2 || string(chunks[0].Data) != "abcdef" {
+		t.Fatalf("Unexpected chunks: %q", chunks)
+	}
+	if chunks[1].Time.Before(chunks[0].Time) {
+		t.Errorf("Chunks out of order: %v", chunks)
+	}
+	// does not fit in the scrollback anymore
+	fmt.Fprint(p, "klm")
+	chunks = p.Chunks()
+	if len(chunks) != 3 || string(chunks[0].Data) != "def" {
+		t.Errorf("Expected oldest chunk to be cut short: %q", chunks)
+	}
+	p.Scrollback().Clear()
+	if len(p.Chunks()) != 0 {
+		t.Errorf("Chunks left after clearing the scrollback: %q", p.Chunks())
+	}
+	fmt.Fprint(p, "new")
+	p.SetTimestamps(false)
+	if len(p.Chunks()) != 0 {
+		t.Errorf("Chunks left after turning timestamps off")
+	}
+}
+
+func TestRichpipeFollow(t *testing.T) {
+	p := newRichPipe(Devnull, 100)
+	fmt.Fprint(p, "before ")
+	var b bytes.Buffer
+	if err := p.Follow(&b); err != nil {
+		t.Fatalf("Error following pipe: %v", err)
+	}
+	fmt.Fprint(p, "after")
+	if b.String() != "before after" {
+		t.Errorf("Unexpected followed output: %q", b.String())
+	}
+}
@@ -32,6 +32,8 @@ type ringbuf_unsafe struct {
 	head int
 	// num clean bytes ever written to this slice
 	seen int
+	// num bytes written since the last clear, survives resizing
+	written int64
 }
 
 func imin(i int, rest ...int) int {
@@ -92,6 +94,7 @@ func (r *ringbuf_unsafe) Write(p []byte) (n int, err error) {
 	defer func() {
 		if err == nil {
 			r.seen += n
+			r.written += int64(n)
 		}
 	}()
 	overflow := len(p) - len(r.buf)
@@ -112,6 +115,18 @@ func (r *ringbuf_unsafe) Write(p []byte) (n int, err error) {
 	return
 }
 
+func (r *ringbuf_unsafe) Clear() {
+	r.head = 0
+	r.seen = 0
+	r.written = 0
+}
+
+func (r *ringbuf_unsafe) Snapshot() ([]byte, int64) {
+	b := make([]byte, r.Size())
+	b = b[:r.Last(b)]
+	return b, r.written - int64(len(b))
+}
+
 func (r *ringbuf_unsafe) WriteTo(w io.Writer) (int64, error) {
 	// not efficient but very simple
 	b := make([]byte, r.Size())
@@ -150,6 +165,18 @@ func (rs *ringbuf_safe) Write(data []byte) (int, error) {
 	return rs.ringbuf_unsafe.Write(data)
 }
 
+func (rs *ringbuf_safe) Clear() {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	rs.ringbuf_unsafe.Clear()
+}
+
+func (rs *ringbuf_safe) Snapshot() ([]byte, int64) {
+	rs.l.Lock()
+	defer rs.l.Unlock()
+	return rs.ringbuf_unsafe.Snapshot()
+}
+
 func (rs *ringbuf_safe) WriteTo(w io.Writer) (int64, error) {
 	rs.l.Lock()
 	defer rs.l.Unlock()
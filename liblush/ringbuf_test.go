@@ -198,3 +198,42 @@ func TestRingbuf_WriteTo(t *testing.T) {
 		t.Error("WriteTo buffer should be empty:", target.Bytes())
 	}
 }
+
+func TestRingbuf_Clear(t *testing.T) {
+	r := newRingbuf(5)
+	r.Write([]byte{0, 1, 2, 3, 4, 5, 6})
+	r.Clear()
+	buf := make([]byte, 20)
+	if n := r.Last(buf); n != 0 {
+		t.Errorf("Read %d bytes from cleared ringbuf", n)
+	}
+	r.Write([]byte{7, 8})
+	n := r.Last(buf)
+	if !bytes.Equal(buf[:n], []byte{7, 8}) {
+		t.Error("Unexpected ringbuf contents after clearing:", buf[:n])
+	}
+	if r.Size() != 5 {
+		t.Error("Clear changed ringbuf size:", r.Size())
+	}
+}
+
+func TestRingbuf_Snapshot(t *testing.T) {
+	r := newRingbuf(5)
+	r.Write([]byte{0, 1, 2, 3, 4, 5, 6})
+	data, offset := r.Snapshot()
+	if !bytes.Equal(data, []byte{2, 3, 4, 5, 6}) || offset != 2 {
+		t.Errorf("Unexpected snapshot: %v at %d", data, offset)
+	}
+	// resizing keeps the position in the stream
+	r.Resize(3)
+	data, offset = r.Snapshot()
+	if !bytes.Equal(data, []byte{4, 5, 6}) || offset != 4 {
+		t.Errorf("Unexpected snapshot after resize: %v at %d", data, offset)
+	}
+	r.Clear()
+	r.Write([]byte{7})
+	data, offset = r.Snapshot()
+	if !bytes.Equal(data, []byte{7}) || offset != 0 {
+		t.Errorf("Unexpected snapshot after clearing: %v at %d", data, offset)
+	}
+}
@@ -21,6 +21,7 @@
 package liblush
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -32,6 +33,7 @@ import (
 type session struct {
 	lastid      int64
 	cmds        map[CmdId]*cmd
+	cmdslock    sync.RWMutex
 	environ     map[string]string
 	environlock sync.RWMutex
 }
@@ -51,12 +53,60 @@ func (s *session) NewCommand(name string, arg ...string) Cmd {
 	}
 	s.environlock.RUnlock()
 	c := newcmdPanicOnError(s.newid(), execcmd)
+	s.cmdslock.Lock()
 	s.cmds[c.id] = c
+	s.cmdslock.Unlock()
 	return c
 }
 
+func (s *session) RestoreCommand(id CmdId, status PastStatus, argv []string) (Cmd, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("empty argv")
+	}
+	if status.Started != nil && status.Exited == nil {
+		return nil, errors.New("cannot restore a running command")
+	}
+	s.cmdslock.Lock()
+	defer s.cmdslock.Unlock()
+	if s.cmds[id] != nil {
+		return nil, fmt.Errorf("command id already in use: %d", id)
+	}
+	execcmd := &exec.Cmd{
+		Args: argv,
+	}
+	s.environlock.RLock()
+	for k, v := range s.environ {
+		execcmd.Env = append(execcmd.Env, k+"="+v)
+	}
+	s.environlock.RUnlock()
+	c, err := newcmd(id, execcmd)
+	if err != nil {
+		return nil, err
+	}
+	c.status.started = status.Started
+	c.status.exited = status.Exited
+	if status.Started != nil {
+		c.status.ready = status.Started
+		// like a command that ran and exited
+		close(c.done)
+	}
+	if status.Err != "" {
+		c.status.err = errors.New(status.Err)
+	}
+	for {
+		last := atomic.LoadInt64(&s.lastid)
+		if int64(id) <= last || atomic.CompareAndSwapInt64(&s.lastid, last, int64(id)) {
+			break
+		}
+	}
+	s.cmds[id] = c
+	return c, nil
+}
+
 func (s *session) GetCommand(id CmdId) Cmd {
+	s.cmdslock.RLock()
 	c := s.cmds[id]
+	s.cmdslock.RUnlock()
 	if c == nil {
 		return nil
 	}
@@ -64,6 +114,8 @@ func (s *session) GetCommand(id CmdId) Cmd {
 }
 
 func (s *session) GetCommandIds() []CmdId {
+	s.cmdslock.RLock()
+	defer s.cmdslock.RUnlock()
 	ids := make([]CmdId, len(s.cmds))
 	i := 0
 	for id := range s.cmds {
@@ -74,7 +126,9 @@ func (s *session) GetCommandIds() []CmdId {
 }
 
 func (s *session) ReleaseCommand(id CmdId) error {
+	s.cmdslock.RLock()
 	c := s.cmds[id]
+	s.cmdslock.RUnlock()
 	if c == nil {
 		return fmt.Errorf("no such command: %d", id)
 	}
@@ -82,7 +136,9 @@ func (s *session) ReleaseCommand(id CmdId) error {
 	if err != nil {
 		return err
 	}
+	s.cmdslock.Lock()
 	delete(s.cmds, id)
+	s.cmdslock.Unlock()
 	// are there some cyclic or pending references or can we trust the GC on
 	// this one? I don't really feel like figuring that out right now so Ill
 	// just mark it TODO.
@@ -0,0 +1,104 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package liblush
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionRestoreCommand(t *testing.T) {
+	s := NewSession()
+	started := time.Now().Add(-time.Minute)
+	exited := started.Add(time.Second)
+	c, err := s.RestoreCommand(5, PastStatus{
+		Started: &started,
+		Exited:  &exited,
+		Err:     "exit status 1",
+	}, []string{"echo", "again"})
+	if err != nil {
+		t.Fatalf("failed to restore command: %v", err)
+	}
+	if s.GetCommand(5) != c {
+		t.Errorf("restored command not found by id")
+	}
+	st := c.Status()
+	if st.Started() == nil || !st.Exited().Equal(exited) || st.Err() == nil {
+		t.Errorf("status not restored: %#v", st)
+	}
+	if err = c.Wait(); err == nil || err.Error() != "exit status 1" {
+		t.Errorf("expected restored error from Wait(), got %v", err)
+	}
+	if err = c.Start(); err == nil {
+		t.Errorf("expected error starting exited command without reset")
+	}
+	var b bytes.Buffer
+	c.Stdout().SetListener(&b)
+	if err = c.Reset(); err != nil {
+		t.Fatalf("failed to reset restored command: %v", err)
+	}
+	if err = c.Run(); err != nil {
+		t.Fatalf("failed to run restored command: %v", err)
+	}
+	if b.String() != "again\n" {
+		t.Errorf("unexpected output from restored command: %q", b.String())
+	}
+	if _, err = s.RestoreCommand(5, PastStatus{}, []string{"echo"}); err == nil {
+		t.Errorf("expected error restoring command with existing id")
+	}
+	if _, err = s.RestoreCommand(6, PastStatus{Started: &started}, []string{"echo"}); err == nil {
+		t.Errorf("expected error restoring running command")
+	}
+	if id := s.NewCommand("echo").Id(); id != 6 {
+		t.Errorf("expected new command to follow restored ids, got %d", id)
+	}
+}
+
+// run with -race
+func TestSessionConcurrentCommands(t *testing.T) {
+	s := NewSession()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c := s.NewCommand("echo")
+				s.GetCommandIds()
+				s.GetCommand(c.Id())
+				if err := s.ReleaseCommand(c.Id()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	for j := 0; j < 50; j++ {
+		for _, id := range s.GetCommandIds() {
+			s.GetCommand(id)
+		}
+	}
+	wg.Wait()
+	if ids := s.GetCommandIds(); len(ids) != 0 {
+		t.Errorf("expected all commands to be released, got %v", ids)
+	}
+}
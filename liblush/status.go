@@ -21,6 +21,7 @@
 package liblush
 
 import (
+	"sync"
 	"time"
 )
 
@@ -29,71 +30,165 @@ import (
 // to have a nil or non-nil error, in combination with nil or non-nil started,
 // nil or non-nil exited, ...? this should be defined.
 type cmdstatus struct {
+	// guards all fields. never held while calling listeners: they are free to
+	// inspect the status.
+	l         sync.Mutex
 	started   *time.Time
 	exited    *time.Time
+	ready     *time.Time
 	err       error
-	listeners []func(CmdStatus) error
+	listeners []*statusListener
 }
 
-func (s *cmdstatus) startNow() {
+type statusListener struct {
+	f func(CmdStatus) error
+}
+
+// ready means the command is ready as soon as it is started (i.e. it has no
+// readiness probe)
+func (s *cmdstatus) startNow(ready bool) {
+	s.l.Lock()
 	if s.started != nil {
+		s.l.Unlock()
 		panic("re-starting status not allowed")
 	}
 	t := time.Now()
 	s.started = &t
+	if ready {
+		s.ready = &t
+	}
+	s.l.Unlock()
+	s.changed()
+}
+
+// only if the run that started at started is still going
+func (s *cmdstatus) readyNow(started *time.Time) {
+	s.l.Lock()
+	if s.started != started || s.ready != nil || s.exited != nil {
+		s.l.Unlock()
+		return
+	}
+	t := time.Now()
+	s.ready = &t
+	s.l.Unlock()
 	s.changed()
 }
 
 func (s *cmdstatus) exitNow() {
+	s.l.Lock()
 	if s.exited != nil {
+		s.l.Unlock()
 		panic("status can only be exited once")
 	}
 	t := time.Now()
 	s.exited = &t
+	s.l.Unlock()
 	s.changed()
 }
 
 func (s *cmdstatus) Started() *time.Time {
+	s.l.Lock()
+	defer s.l.Unlock()
 	return s.started
 }
 
 func (s *cmdstatus) Exited() *time.Time {
+	s.l.Lock()
+	defer s.l.Unlock()
 	return s.exited
 }
 
+func (s *cmdstatus) Ready() *time.Time {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.ready
+}
+
 func (s *cmdstatus) Success() bool {
-	return s.err == nil
+	return s.Err() == nil
 }
 
 func (s *cmdstatus) Err() error {
+	s.l.Lock()
+	defer s.l.Unlock()
 	return s.err
 }
 
 func (s *cmdstatus) setErr(e error) {
+	s.l.Lock()
 	if s.err != nil {
+		s.l.Unlock()
 		panic("cannot reset error state of command")
 	}
-	if e != nil {
-		s.err = e
-		s.changed()
+	if e == nil {
+		s.l.Unlock()
+		return
+	}
+	s.err = e
+	s.l.Unlock()
+	s.changed()
+}
+
+// started and not exited
+func (s *cmdstatus) running() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.started != nil && s.exited == nil
+}
+
+// started, or failed trying
+func (s *cmdstatus) wasStarted() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.started != nil || s.err != nil
+}
+
+func (s *cmdstatus) NotifyChange(f func(CmdStatus) error) func() {
+	sl := &statusListener{f}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.listeners = append(s.listeners, sl)
+	return func() {
+		s.removeListener(sl)
 	}
 }
 
-func (s *cmdstatus) NotifyChange(f func(CmdStatus) error) {
-	s.listeners = append(s.listeners, f)
+func (s *cmdstatus) clearListeners() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.listeners = nil
 }
 
 // call this whenever the status has changed to notify the listeners
 func (s *cmdstatus) changed() {
-	for i := 0; i < len(s.listeners); i++ {
-		err := s.listeners[i](s)
-		if err != nil {
-			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
-			i--
+	s.l.Lock()
+	listeners := append([]*statusListener{}, s.listeners...)
+	s.l.Unlock()
+	for _, sl := range listeners {
+		if sl.f(s) != nil {
+			s.removeListener(sl)
 		}
 	}
-	if s.Exited() != nil {
-		// no more state changes are expected
-		s.listeners = nil
+}
+
+func (s *cmdstatus) removeListener(sl *statusListener) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for i, x := range s.listeners {
+		if x == sl {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
 	}
 }
+
+// back to the state of a command that has not been started yet
+func (s *cmdstatus) reset() {
+	s.l.Lock()
+	s.started = nil
+	s.exited = nil
+	s.ready = nil
+	s.err = nil
+	s.l.Unlock()
+	s.changed()
+}
@@ -0,0 +1,92 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+// above this many (lines in old * lines in new), after stripping common head
+// and tail, don't bother finding the minimal diff: everything changed.
+const maxDiffCells = 1000000
+
+type lineChange struct {
+	// "add" or "del"
+	Op string `json:"op"`
+	// line number (0 based) in the new text for additions, in the old text
+	// for deletions
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// line changes that turn a into b, based on their longest common subsequence
+func diffLines(a, b []string) []lineChange {
+	var changes []lineChange
+	// common head and tail are by far the most common case, and cheap
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head &&
+		a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	olda := a[head : len(a)-tail]
+	newb := b[head : len(b)-tail]
+	n, m := len(olda), len(newb)
+	if n*m > maxDiffCells {
+		for i, line := range olda {
+			changes = append(changes, lineChange{"del", head + i, line})
+		}
+		for j, line := range newb {
+			changes = append(changes, lineChange{"add", head + j, line})
+		}
+		return changes
+	}
+	// lcs[i][j] is the length of the LCS of olda[i:] and newb[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if olda[i] == newb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && olda[i] == newb[j]:
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, lineChange{"del", head + i, olda[i]})
+			i++
+		default:
+			changes = append(changes, lineChange{"add", head + j, newb[j]})
+			j++
+		}
+	}
+	return changes
+}
@@ -0,0 +1,51 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func diffLines_testaux(t *testing.T, a, b string, expected ...lineChange) {
+	changes := diffLines(strings.Split(a, "\n"), strings.Split(b, "\n"))
+	if len(changes) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("%q -> %q: got %v, expected %v", a, b, changes, expected)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diffLines_testaux(t, "a\nb\nc", "a\nb\nc")
+	diffLines_testaux(t, "a\nb\nc", "a\nx\nc",
+		lineChange{"del", 1, "b"},
+		lineChange{"add", 1, "x"})
+	diffLines_testaux(t, "a\nb\nc", "a\nb\nc\nd",
+		lineChange{"add", 3, "d"})
+	diffLines_testaux(t, "a\nb\nc\nd", "b\nd",
+		lineChange{"del", 0, "a"},
+		lineChange{"del", 2, "c"})
+	diffLines_testaux(t, "x\na\nb\ny", "x\nb\na\nb\ny",
+		lineChange{"add", 1, "b"})
+}
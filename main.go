@@ -23,15 +23,104 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	s := newServer()
 	listenaddr := flag.String("l", "localhost:8081", "listen address")
-	flag.BoolVar(&s.everybodyMaster, "everybodymaster", false,
-		"grant every incoming connection full privileges. when false only the first connection is a master")
+	token := flag.String("token", os.Getenv("LUSH_TOKEN"),
+		"access token or password required from clients (default $LUSH_TOKEN, or generated)")
+	noauth := flag.Bool("noauth", false,
+		"grant every incoming connection full privileges without logging in")
+	rolespath := flag.String("roles", "",
+		"JSON file with extra roles, access tokens and address rules")
+	rcpath := flag.String("rc", "", "startup file evaluated for the session (default ~/.lushrc)")
+	flag.StringVar(&s.templates.path, "templates", s.templates.path,
+		"file with saved command templates (share it to share templates)")
+	statepath := flag.String("state", defaultStatePath(),
+		"file the session is saved to and restored from (empty to disable)")
+	stateinterval := flag.Duration("stateinterval", 30*time.Second,
+		"how often the session state is saved")
+	archivedir := flag.String("archive", "",
+		"directory released commands are archived to (empty to disable)")
+	var limits archiveLimits
+	flag.IntVar(&limits.Count, "archivecount", defaultArchiveCount,
+		"maximum number of archived commands (0 for no limit)")
+	flag.DurationVar(&limits.Age, "archiveage", defaultArchiveAge,
+		"archived commands older than this are removed (0 for no limit)")
+	flag.Int64Var(&limits.Size, "archivesize", defaultArchiveSize,
+		"maximum total size of the archive in bytes (0 for no limit)")
+	usetls := flag.Bool("tls", true, "serve HTTPS and wss (strongly recommended)")
+	var tlsopts tlsOptions
+	flag.StringVar(&tlsopts.CertFile, "cert", "",
+		"TLS certificate file (default: self-signed, kept in ~/.lush/cert.pem)")
+	flag.StringVar(&tlsopts.KeyFile, "key", "", "TLS private key file for -cert")
+	flag.DurationVar(&tlsopts.HSTS, "hsts", 365*24*time.Hour,
+		"max-age of the Strict-Transport-Security header (0 to disable)")
+	flag.StringVar(&tlsopts.RedirectAddr, "redirect", "",
+		"also listen for plain HTTP on this address and redirect it to HTTPS")
 	flag.Parse()
-	err := s.web.Run(*listenaddr)
+	if (tlsopts.CertFile == "") != (tlsopts.KeyFile == "") {
+		log.Fatal("-cert and -key must be given together")
+	}
+	if *noauth {
+		log.Print("Authentication is disabled: anybody who can connect has full access")
+	} else {
+		if *token == "" {
+			var err error
+			*token, err = generateToken()
+			if err != nil {
+				log.Fatal("Failed to generate access token: ", err)
+			}
+			log.Print("Access token: ", *token)
+		}
+		s.setToken(*token)
+	}
+	if *rolespath != "" {
+		err := s.loadAccessConfig(*rolespath)
+		if err != nil {
+			log.Fatal("Failed to load roles: ", err)
+		}
+	}
+	if *archivedir != "" {
+		var err error
+		s.archive, err = newArchive(*archivedir, limits)
+		if err != nil {
+			log.Fatalf("Failed to open archive %s: %v", *archivedir, err)
+		}
+	}
+	if *statepath != "" {
+		err := s.restoreState(*statepath)
+		if err != nil {
+			log.Print("Failed to restore session: ", err)
+		}
+		go s.saveStatePeriodically(*statepath, *stateinterval)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			if err := s.saveState(*statepath); err != nil {
+				log.Print("Failed to save session: ", err)
+			}
+			os.Exit(0)
+		}()
+	}
+	if *rcpath == "" {
+		s.loadRcFile(defaultRcPath(), false)
+	} else {
+		s.loadRcFile(*rcpath, true)
+	}
+	var err error
+	if *usetls {
+		err = s.runTLS(*listenaddr, tlsopts)
+	} else {
+		log.Print("TLS is disabled: all traffic, including the access token, is sent in the clear")
+		err = s.web.Run(*listenaddr)
+	}
 	if err != nil {
 		log.Fatalf("Failed to listen on %s: %v", *listenaddr, err)
 	}
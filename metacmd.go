@@ -24,16 +24,27 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/hraban/lush/liblush"
+	"github.com/hraban/lush/vt100"
 )
 
 // wrapper type for custom extensions of a Cmd object
-type metacmd struct{ liblush.Cmd }
+type metacmd struct {
+	liblush.Cmd
+	s *server
+}
 
 type statusJson struct {
 	Code   int    `json:"code"`
 	ErrStr string `json:"err"`
+	// number of times a supervised command was restarted
+	Restarts int `json:"restarts,omitempty"`
+	// when the command became ready (see readiness probes)
+	Ready *time.Time `json:"ready,omitempty"`
+	// the command was running when lush was stopped (see restoreState)
+	Lost bool `json:"lost,omitempty"`
 }
 
 type cmdmetadata struct {
@@ -47,9 +58,33 @@ type cmdmetadata struct {
 	StderrtoId       liblush.CmdId `json:"stderrto,omitempty"`
 	StdoutScrollback int           `json:"stdoutScrollback"`
 	StderrScrollback int           `json:"stderrScrollback"`
+	StdoutRecords    int           `json:"stdoutRecords,omitempty"`
+	StderrRecords    int           `json:"stderrRecords,omitempty"`
+	StdoutTimestamps bool          `json:"stdoutTimestamps,omitempty"`
+	StderrTimestamps bool          `json:"stderrTimestamps,omitempty"`
 	UserData         interface{}   `json:"userdata"`
 	Stdout           string        `json:"stdout"`
 	Stderr           string        `json:"stderr"`
+	// nil unless the command is supervised
+	Supervise *superviseInfo `json:"supervise,omitempty"`
+	// current screen, if the output is fed to a terminal emulator
+	Screen *vt100.Screen `json:"screen,omitempty"`
+	// how escape codes are presented: raw, spans or strip. in spans mode
+	// the scrollback is also included as spans, in strip mode Stdout and
+	// Stderr are stripped.
+	Ansi        string       `json:"ansi"`
+	StdoutSpans []vt100.Span `json:"stdoutSpans,omitempty"`
+	StderrSpans []vt100.Span `json:"stderrSpans,omitempty"`
+	// character sets of the output. Stdout and Stderr are always UTF-8.
+	StdoutEncoding string `json:"stdoutEncoding"`
+	StderrEncoding string `json:"stderrEncoding"`
+	// binary output is left out of Stdout and Stderr unless ForceText is
+	// set (see the hexdump event)
+	StdoutBinary bool `json:"stdoutBinary,omitempty"`
+	StderrBinary bool `json:"stderrBinary,omitempty"`
+	ForceText    bool `json:"forceText,omitempty"`
+	// client that created the command, if any
+	Owner string `json:"owner,omitempty"`
 }
 
 // if this writer is the instream of a command return that
@@ -65,6 +100,24 @@ func pipedcmd(outs liblush.OutStream) liblush.Cmd {
 	return iscmd(outs.GetListener())
 }
 
+// identifies one output stream of a command
+type streamKey struct {
+	id     liblush.CmdId
+	stream string
+}
+
+// stream of a command by name (stdout or stderr), nil if there is no such
+// stream
+func cmdStream(c liblush.Cmd, name string) liblush.OutStream {
+	switch name {
+	case "stdout":
+		return c.Stdout()
+	case "stderr":
+		return c.Stderr()
+	}
+	return nil
+}
+
 func cmdstatus2int(s liblush.CmdStatus) (i int) {
 	// not very pretty then again this entire integer status thing is bollocks
 	// anyway might as well abuse it all the way
@@ -89,8 +142,10 @@ func cmdstatus2int(s liblush.CmdStatus) (i int) {
 
 func cmdstatus2json(s liblush.CmdStatus) (sjson statusJson) {
 	sjson.Code = cmdstatus2int(s)
+	sjson.Ready = s.Ready()
 	if err := s.Err(); err != nil {
 		sjson.ErrStr = err.Error()
+		sjson.Lost = sjson.ErrStr == errLost.Error()
 	}
 	return
 }
@@ -115,6 +170,10 @@ func (mc metacmd) Metadata() (data cmdmetadata, err error) {
 	data.UserData = mc.UserData()
 	data.StdoutScrollback = mc.Stdout().Scrollback().Size()
 	data.StderrScrollback = mc.Stderr().Scrollback().Size()
+	data.StdoutTimestamps = mc.Stdout().Timestamps()
+	data.StderrTimestamps = mc.Stderr().Timestamps()
+	data.StdoutRecords = mc.s.recordsLimit(mc.Id(), "stdout")
+	data.StderrRecords = mc.s.recordsLimit(mc.Id(), "stderr")
 	if cmd := pipedcmd(mc.Stdout()); cmd != nil {
 		data.StdouttoId = cmd.Id()
 	}
@@ -122,17 +181,49 @@ func (mc metacmd) Metadata() (data cmdmetadata, err error) {
 		data.StderrtoId = cmd.Id()
 	}
 	data.Status = cmdstatus2json(mc.Status())
-	data.Stdout, err = stringifyWriterTo(mc.Stdout().Scrollback())
+	if sup := mc.s.getSupervisor(mc.Id()); sup != nil {
+		info := sup.info()
+		data.Supervise = &info
+		data.Status.Restarts = info.Restarts
+	}
+	if term := mc.s.getTerminal(mc.Id()); term != nil {
+		screen := term.Screen()
+		data.Screen = &screen
+	}
+	data.Owner = mc.s.owner(mc.Id())
+	data.StdoutEncoding = mc.s.streamEncoding(mc.Id(), "stdout")
+	data.StderrEncoding = mc.s.streamEncoding(mc.Id(), "stderr")
+	data.Stdout, err = mc.s.decodedScrollback(mc, "stdout")
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve stdout scrollback for %d: %v",
 			mc.Id(), err)
 		return
 	}
-	data.Stderr, err = stringifyWriterTo(mc.Stderr().Scrollback())
+	data.Stderr, err = mc.s.decodedScrollback(mc, "stderr")
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve stderr scrollback for %d: %v",
 			mc.Id(), err)
 		return
 	}
+	data.StdoutBinary = mc.s.isBinary(mc.Id(), "stdout")
+	data.StderrBinary = mc.s.isBinary(mc.Id(), "stderr")
+	data.ForceText = mc.s.forceText(mc.Id())
+	if data.StdoutBinary && !data.ForceText {
+		data.Stdout = ""
+	}
+	if data.StderrBinary && !data.ForceText {
+		data.Stderr = ""
+	}
+	data.Ansi = mc.s.ansiMode(mc.Id())
+	switch data.Ansi {
+	case ansiStrip:
+		data.Stdout = string(vt100.StripEscapes([]byte(data.Stdout)))
+		data.Stderr = string(vt100.StripEscapes([]byte(data.Stderr)))
+	case ansiSpans:
+		var parser vt100.SpanParser
+		data.StdoutSpans = parser.Parse([]byte(data.Stdout))
+		parser = vt100.SpanParser{}
+		data.StderrSpans = parser.Parse([]byte(data.Stderr))
+	}
 	return
 }
@@ -0,0 +1,227 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Plain text download of command output.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/lush/vt100"
+	"github.com/hraban/web"
+)
+
+// writes through to an http response, flushing after every write so the
+// client sees output as it is produced
+type flushWriter struct {
+	w io.Writer
+	// nil if the response can't be flushed
+	f http.Flusher
+}
+
+// the Flusher is not promoted through web.Context: ask its ResponseWriter
+func newFlushWriter(ctx *web.Context) flushWriter {
+	f, _ := ctx.ResponseWriter.(http.Flusher)
+	return flushWriter{ctx, f}
+}
+
+func (fw flushWriter) Write(data []byte) (int, error) {
+	n, err := fw.w.Write(data)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// bytes a follower may fall behind on top of the scrollback before it is
+// dropped
+const followBufferSize = 1024 * 1024
+
+// output waiting to be sent to a follower. writing never blocks the command:
+// once more than limit bytes are waiting the rest is dropped.
+type followBuffer struct {
+	l        sync.Mutex
+	buf      []byte
+	limit    int
+	overflow bool
+	// signalled after every write
+	ready chan struct{}
+}
+
+func newFollowBuffer(limit int) *followBuffer {
+	return &followBuffer{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+func (fb *followBuffer) Write(data []byte) (int, error) {
+	fb.l.Lock()
+	if len(fb.buf)+len(data) > fb.limit {
+		fb.overflow = true
+	} else if !fb.overflow {
+		fb.buf = append(fb.buf, data...)
+	}
+	fb.l.Unlock()
+	select {
+	case fb.ready <- struct{}{}:
+	default:
+	}
+	return len(data), nil
+}
+
+// the command exiting does not end the response: the handler drains the
+// buffer first
+func (fb *followBuffer) Close() error {
+	return nil
+}
+
+// everything waiting, and whether output was dropped
+func (fb *followBuffer) take() ([]byte, bool) {
+	fb.l.Lock()
+	defer fb.l.Unlock()
+	data := fb.buf
+	fb.buf = nil
+	return data, fb.overflow
+}
+
+// stream scrollback and everything written after it until the command exits
+// or the client goes away. a client that falls too far behind is dropped.
+func followOutput(ctx *web.Context, c liblush.Cmd, stream liblush.OutStream, strip bool) error {
+	exited := make(chan struct{})
+	var once sync.Once
+	remove := c.Status().NotifyChange(func(status liblush.CmdStatus) error {
+		if status.Exited() != nil {
+			once.Do(func() { close(exited) })
+			return errors.New("command exited")
+		}
+		return nil
+	})
+	defer remove()
+	var gone <-chan bool
+	if cn, ok := ctx.ResponseWriter.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	var w io.Writer = newFlushWriter(ctx)
+	if strip {
+		w = &stripWriter{w: w}
+	}
+	fb := newFollowBuffer(stream.Scrollback().Size() + followBufferSize)
+	err := stream.Follow(fb)
+	if err != nil {
+		return err
+	}
+	defer stream.Peeker().RemoveWriter(fb)
+	if c.Status().Exited() != nil {
+		once.Do(func() { close(exited) })
+	}
+	for {
+		var done bool
+		select {
+		case <-fb.ready:
+		case <-exited:
+			// everything written before the exit is in the buffer
+			done = true
+		case <-gone:
+			return nil
+		}
+		data, overflow := fb.take()
+		if overflow {
+			// the client is not reading
+			return nil
+		}
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				return nil
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func getOutStream(ctx *web.Context, idstr, streamname string) (liblush.Cmd, liblush.OutStream, error) {
+	s := ctx.User.(*server)
+	id, _ := liblush.ParseCmdId(idstr)
+	c := s.session.GetCommand(id)
+	if c == nil {
+		return nil, nil, web.WebError{404, "no such command: " + idstr}
+	}
+	stream := cmdStream(c, streamname)
+	if stream == nil {
+		return nil, nil, web.WebError{404, "no such stream: " + streamname}
+	}
+	return c, stream, nil
+}
+
+// serve output with support for Range requests
+func serveOutput(ctx *web.Context, c liblush.Cmd, name string, data []byte) {
+	// output of a running command is never fresh
+	var modtime time.Time
+	if exited := c.Status().Exited(); exited != nil {
+		modtime = *exited
+	}
+	http.ServeContent(ctx, ctx.Request, name, modtime, bytes.NewReader(data))
+}
+
+// the scrollback of a stream as text/plain. supports Range requests. with
+// ?follow=1 the response continues with new output until the command exits,
+// like tail -f. range headers are ignored in follow mode. ?strip=1 removes
+// escape codes (colors &c).
+//
+// eg GET /3/stdout.txt
+func handleGetOutput(ctx *web.Context, idstr, streamname string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
+	c, stream, err := getOutStream(ctx, idstr, streamname)
+	if err != nil {
+		return err
+	}
+	strip, err := boolParam(ctx, "strip")
+	if err != nil {
+		return err
+	}
+	follow, err := boolParam(ctx, "follow")
+	if err != nil {
+		return err
+	}
+	ctx.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if follow {
+		ctx.Header().Set("Cache-Control", "no-cache")
+		return followOutput(ctx, c, stream, strip)
+	}
+	var buf bytes.Buffer
+	_, err = stream.Scrollback().WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if strip {
+		data = vt100.StripEscapes(data)
+	}
+	serveOutput(ctx, c, streamname+".txt", data)
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetOutputRange(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "echo",
+		Args:             []string{"hello world"},
+		StdoutScrollback: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("/%d/stdout.txt", c.Id())
+	req, _ := http.NewRequest("GET", url, nil)
+	rec := httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "hello world\n" {
+		t.Errorf("Unexpected response %d: %q", rec.Code, rec.Body.String())
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "12" {
+		t.Errorf("Unexpected Content-Length: %q", cl)
+	}
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Set("Range", "bytes=6-")
+	rec = httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	if rec.Code != 206 || rec.Body.String() != "world\n" {
+		t.Errorf("Unexpected range response %d: %q", rec.Code, rec.Body.String())
+	}
+	req, _ = http.NewRequest("GET", url+"?follow=1", nil)
+	rec = httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	if rec.Body.String() != "hello world\n" {
+		t.Errorf("Unexpected output following exited command: %q", rec.Body.String())
+	}
+}
+
+func TestGetOutputFollow(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "sh",
+		Args:             []string{"-c", "echo one; sleep 0.2; echo two"},
+		StdoutScrollback: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%d/stdout.txt?follow=1", c.Id()), nil)
+	rec := httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	if rec.Body.String() != "one\ntwo\n" {
+		t.Errorf("Unexpected followed output: %q", rec.Body.String())
+	}
+	if !rec.Flushed {
+		t.Errorf("Followed output was never flushed")
+	}
+}
+
+func TestFollowBuffer(t *testing.T) {
+	fb := newFollowBuffer(4)
+	if n, err := fb.Write([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("Unexpected write result: %d, %v", n, err)
+	}
+	if data, overflow := fb.take(); string(data) != "abc" || overflow {
+		t.Errorf("Unexpected buffer: %q, %v", data, overflow)
+	}
+	// a slow client never blocks the command
+	if n, err := fb.Write([]byte("abcde")); n != 5 || err != nil {
+		t.Errorf("Unexpected write result on overflow: %d, %v", n, err)
+	}
+	fb.Write([]byte("a"))
+	if data, overflow := fb.take(); len(data) != 0 || !overflow {
+		t.Errorf("Expected overflow, got %q, %v", data, overflow)
+	}
+}
+
+func TestGetOutputStrip(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "printf",
+		Args:             []string{`\033[1mbold`},
+		StdoutScrollback: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for param, expected := range map[string]string{
+		"strip=1": "bold",
+		"strip=0": "\x1b[1mbold",
+		"":        "\x1b[1mbold",
+	} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/%d/stdout.txt?%s", c.Id(), param), nil)
+		rec := httptest.NewRecorder()
+		s.web.ServeHTTP(rec, req)
+		if rec.Code != 200 || rec.Body.String() != expected {
+			t.Errorf("?%s: unexpected response %d: %q", param, rec.Code, rec.Body.String())
+		}
+	}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%d/stdout.txt?strip=maybe", c.Id()), nil)
+	rec := httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Errorf("Expected 400 for an invalid boolean, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Procfile import: launch and manage the services of a project as a group.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// first PORT handed out to services, as foreman does. every next service gets
+// portStep more.
+const (
+	basePort = 5000
+	portStep = 100
+)
+
+// assigned to the services of a group in order
+var groupColors = []string{
+	"#268bd2", "#859900", "#b58900", "#d33682", "#2aa198", "#cb4b16", "#6c71c4", "#dc322f",
+}
+
+var procfileLineRegexp = regexp.MustCompile(`^([A-Za-z0-9_-]+):\s*(.+)$`)
+
+type procfileEntry struct {
+	Name    string
+	Cmdline string
+}
+
+type groupService struct {
+	Name    string        `json:"name"`
+	Id      liblush.CmdId `json:"nid"`
+	Color   string        `json:"color"`
+	Cmdline string        `json:"cmdline"`
+}
+
+type cmdGroup struct {
+	Name     string         `json:"name"`
+	Dir      string         `json:"dir"`
+	Services []groupService `json:"services"`
+}
+
+// parse "name: command line" entries, one per line
+func parseProcfile(r io.Reader) ([]procfileEntry, error) {
+	var entries []procfileEntry
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := procfileLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: expected \"name: command\"", lineno)
+		}
+		if seen[m[1]] {
+			return nil, fmt.Errorf("line %d: duplicate entry %s", lineno, m[1])
+		}
+		seen[m[1]] = true
+		entries = append(entries, procfileEntry{m[1], m[2]})
+	}
+	return entries, scanner.Err()
+}
+
+// parse KEY=VALUE lines from a .env file. values may be quoted: 'verbatim' or
+// "with \n escapes".
+func parseDotenv(r io.Reader) (map[string]string, error) {
+	env := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineno)
+		}
+		key := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			value = unquoted
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
+
+func readProcfile(dir string) ([]procfileEntry, map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, "Procfile"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	entries, err := parseProcfile(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Procfile: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil, errors.New("empty Procfile")
+	}
+	env := map[string]string{}
+	envf, err := os.Open(filepath.Join(dir, ".env"))
+	if err == nil {
+		defer envf.Close()
+		env, err = parseDotenv(envf)
+		if err != nil {
+			return nil, nil, fmt.Errorf(".env: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return entries, env, nil
+}
+
+// copy of a group, taken under the lock: its services are filled in after
+// the group is created
+func (s *server) getGroup(name string) (*cmdGroup, error) {
+	s.groupslock.Lock()
+	defer s.groupslock.Unlock()
+	g := s.groups[name]
+	if g == nil {
+		return nil, lushError{errors.New("no such group: " + name)}
+	}
+	return g.copy(), nil
+}
+
+func (g *cmdGroup) copy() *cmdGroup {
+	cp := *g
+	cp.Services = append([]groupService(nil), g.Services...)
+	return &cp
+}
+
+// eg groups;
+func wseventGroups(s *server, _ string) error {
+	s.groupslock.Lock()
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]*cmdGroup, len(names))
+	for i, name := range names {
+		groups[i] = s.groups[name].copy()
+	}
+	s.groupslock.Unlock()
+	return writePrefixedJson(&s.ctrlclients, "groups;", groups)
+}
+
+// create a command for every entry in the Procfile in the current directory,
+// with the variables from .env (if any) in its environment. the group is
+// named after the directory unless specified. restart (optional) is a restart
+// policy: always or on-failure.
+//
+// eg procfile;{"name":"myapp","restart":"on-failure","start":true}
+func wseventProcfile(s *server, optionsJSON string) error {
+	var options struct {
+		Name    string
+		Restart string
+		Start   bool
+	}
+	err := json.Unmarshal([]byte(optionsJSON), &options)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	entries, env, err := readProcfile(dir)
+	if err != nil {
+		return lushError{err}
+	}
+	g := &cmdGroup{Name: options.Name, Dir: dir}
+	if g.Name == "" {
+		g.Name = filepath.Base(dir)
+	}
+	s.groupslock.Lock()
+	if s.groups[g.Name] != nil {
+		s.groupslock.Unlock()
+		return lushError{fmt.Errorf("group %s already exists", g.Name)}
+	}
+	// reserve the name
+	s.groups[g.Name] = g
+	s.groupslock.Unlock()
+	var services []groupService
+	for i, e := range entries {
+		svc := groupService{
+			Name:    e.Name,
+			Color:   groupColors[i%len(groupColors)],
+			Cmdline: e.Cmdline,
+		}
+		copts := cmdOptions{
+			Cmd:              shellArgv[0],
+			Args:             append(append([]string{}, shellArgv[1:]...), e.Cmdline),
+			Name:             e.Name,
+			StdoutScrollback: defaultScrollback,
+			StderrScrollback: defaultScrollback,
+			UserData: map[string]interface{}{
+				"group": g.Name,
+				"color": svc.Color,
+			},
+		}
+		if options.Restart != "" {
+			copts.Supervise = &supervisePolicy{Restart: options.Restart}
+		}
+		c, err := newCommand(s, copts)
+		if err != nil {
+			// don't leave the services created so far behind
+			for _, svc := range services {
+				wseventRelease(s, fmt.Sprint(svc.Id))
+			}
+			s.groupslock.Lock()
+			delete(s.groups, g.Name)
+			s.groupslock.Unlock()
+			return err
+		}
+		svc.Id = c.Id()
+		if _, ok := env["PORT"]; !ok {
+			c.Setenv("PORT", strconv.Itoa(basePort+i*portStep))
+		}
+		for k, v := range env {
+			c.Setenv(k, v)
+		}
+		services = append(services, svc)
+	}
+	s.groupslock.Lock()
+	g.Services = services
+	s.groupslock.Unlock()
+	if options.Start {
+		err = wseventStartgroup(s, g.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return wseventGroups(s, "")
+}
+
+// (re)start all services of a group that are not running
+// eg startgroup;myapp
+func wseventStartgroup(s *server, name string) error {
+	g, err := s.getGroup(name)
+	if err != nil {
+		return err
+	}
+	for _, svc := range g.Services {
+		c := s.session.GetCommand(svc.Id)
+		if c == nil || isRunning(c) {
+			continue
+		}
+		c.Reset()
+		err = wseventStart(s, fmt.Sprint(svc.Id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop all running services of a group (and don't restart them)
+// eg stopgroup;myapp
+func wseventStopgroup(s *server, name string) error {
+	g, err := s.getGroup(name)
+	if err != nil {
+		return err
+	}
+	for _, svc := range g.Services {
+		c := s.session.GetCommand(svc.Id)
+		if c == nil {
+			continue
+		}
+		if sup := s.getSupervisor(c.Id()); sup != nil {
+			sup.stop()
+		}
+		if isRunning(c) {
+			err = wseventStop(s, fmt.Sprint(svc.Id))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forget about a group. its commands are left alone.
+// eg delgroup;myapp
+func wseventDelgroup(s *server, name string) error {
+	if _, err := s.getGroup(name); err != nil {
+		return err
+	}
+	s.groupslock.Lock()
+	delete(s.groups, name)
+	s.groupslock.Unlock()
+	return wseventGroups(s, "")
+}
+
+// subscribe all websocket clients to the output of every service in a group,
+// tagged with the name of the service:
+//
+//     groupstream;myapp;web;stdout;...data...
+//
+// eg subscribegroup;myapp
+func wseventSubscribegroup(s *server, name string) error {
+	g, err := s.getGroup(name)
+	if err != nil {
+		return err
+	}
+	for _, svc := range g.Services {
+		c := s.session.GetCommand(svc.Id)
+		if c == nil {
+			continue
+		}
+		for streamname, stream := range map[string]liblush.OutStream{
+			"stdout": c.Stdout(),
+			"stderr": c.Stderr(),
+		} {
+			prefix := "groupstream;" + g.Name + ";" + svc.Name + ";" + streamname + ";"
+			w := newPrefixedWriter(&s.ctrlclients, []byte(prefix))
+			stream.Peeker().AddWriter(newNopWriteCloser(w))
+		}
+	}
+	return nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.groups = map[string]*cmdGroup{}
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcfile(t *testing.T) {
+	entries, err := parseProcfile(strings.NewReader(`# services
+web: bundle exec rails s -p $PORT
+worker:   bundle exec sidekiq
+
+clock-1: ruby clock.rb
+`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing Procfile: %v", err)
+	}
+	expected := []procfileEntry{
+		{"web", "bundle exec rails s -p $PORT"},
+		{"worker", "bundle exec sidekiq"},
+		{"clock-1", "ruby clock.rb"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %q, got %q", expected, entries)
+	}
+	if _, err = parseProcfile(strings.NewReader("web rails s\n")); err == nil {
+		t.Errorf("expected error for line without colon")
+	}
+	if _, err = parseProcfile(strings.NewReader("web: a\nweb: b\n")); err == nil {
+		t.Errorf("expected error for duplicate entry")
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	env, err := parseDotenv(strings.NewReader(`# settings
+DATABASE_URL=postgres://localhost/dev
+export DEBUG=1 # verbose
+GREETING="hello\nworld"
+RAW='$NOT \n expanded'
+EMPTY=
+`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing .env: %v", err)
+	}
+	expected := map[string]string{
+		"DATABASE_URL": "postgres://localhost/dev",
+		"DEBUG":        "1",
+		"GREETING":     "hello\nworld",
+		"RAW":          `$NOT \n expanded`,
+		"EMPTY":        "",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected %q, got %q", expected, env)
+	}
+	if _, err = parseDotenv(strings.NewReader("NOVALUE\n")); err == nil {
+		t.Errorf("expected error for line without =")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Startup file evaluated when the session is created (~/.lushrc or -rc).
+//
+// One directive per line. Empty lines and lines starting with # are ignored.
+// Arguments are separated by whitespace, wrap them in double quotes to include
+// whitespace. $VAR and ${VAR} are expanded from the session environment, a
+// leading ~ to the home directory. E.g.:
+//
+//     setenv GOPATH ~/go
+//     unsetenv PAGER
+//     path $GOPATH/bin /opt/bin
+//     cd ~/src/myproject
+//     alias ll ls -l
+//     bg godoc -http=:6060
+//
+// An error in one line does not stop evaluation of the rest, nor does it stop
+// the server from starting. Errors are logged and sent to every websocket
+// client that connects.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+type rcDirective func(s *server, args []string) error
+
+var rcDirectives = map[string]rcDirective{
+	"setenv":   rcSetenv,
+	"unsetenv": rcUnsetenv,
+	"path":     rcPath,
+	"cd":       rcCd,
+	"alias":    rcAlias,
+	"bg":       rcBg,
+}
+
+func homeDir() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("HOME")
+	}
+	return u.HomeDir
+}
+
+func defaultRcPath() string {
+	return filepath.Join(homeDir(), ".lushrc")
+}
+
+// split a line from the rc file in whitespace separated words. double quotes
+// group words, a backslash escapes the next character inside quotes.
+func splitRcLine(line string) ([]string, error) {
+	var words []string
+	var word []rune
+	inword := false
+	inquote := false
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case inquote && r == '\\':
+			escaped = true
+		case r == '"':
+			inquote = !inquote
+			inword = true
+		case !inquote && (r == ' ' || r == '\t'):
+			if inword {
+				words = append(words, string(word))
+				word = nil
+				inword = false
+			}
+		default:
+			word = append(word, r)
+			inword = true
+		}
+	}
+	if inquote {
+		return nil, errors.New("unterminated double quote")
+	}
+	if inword {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+func expandRcWord(s *server, word string) string {
+	word = os.Expand(word, s.session.Getenv)
+	if word == "~" || strings.HasPrefix(word, "~/") {
+		word = homeDir() + word[1:]
+	}
+	return word
+}
+
+// log an rc file error and tell all (current and future) clients about it
+func rcError(s *server, msg string) {
+	log.Print(msg)
+	s.rcerrors = append(s.rcerrors, msg)
+	writePrefixedJson(&s.ctrlclients, "error;", msg)
+}
+
+// evaluate a single line from an rc file
+func evalRcLine(s *server, line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	words, err := splitRcLine(line)
+	if err != nil {
+		return err
+	}
+	directive := rcDirectives[words[0]]
+	if directive == nil {
+		return fmt.Errorf("unknown directive: %s", words[0])
+	}
+	args := words[1:]
+	for i := range args {
+		args[i] = expandRcWord(s, args[i])
+	}
+	return directive(s, args)
+}
+
+// evaluate the rc file at this path. a non-existing file is only an error if
+// mustExist is true.
+func (s *server) loadRcFile(path string, mustExist bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		if mustExist || !os.IsNotExist(err) {
+			rcError(s, fmt.Sprintf("failed to read rc file: %v", err))
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		err = evalRcLine(s, scanner.Text())
+		if err != nil {
+			rcError(s, fmt.Sprintf("%s:%d: %v", path, lineno, err))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		rcError(s, fmt.Sprintf("failed to read rc file %s: %v", path, err))
+	}
+}
+
+// replace argv[0] by the argv of its alias, if it has one. aliases are not
+// expanded recursively.
+func (s *server) expandAlias(argv []string) []string {
+	alias, ok := s.aliases[argv[0]]
+	if !ok {
+		return argv
+	}
+	return append(append([]string{}, alias...), argv[1:]...)
+}
+
+func rcSetenv(s *server, args []string) error {
+	if len(args) != 2 {
+		return errors.New("setenv requires 2 args")
+	}
+	s.session.Setenv(args[0], args[1])
+	return nil
+}
+
+func rcUnsetenv(s *server, args []string) error {
+	if len(args) != 1 {
+		return errors.New("unsetenv requires 1 arg")
+	}
+	s.session.Unsetenv(args[0])
+	return nil
+}
+
+// append directories to the PATH
+func rcPath(s *server, args []string) error {
+	if len(args) == 0 {
+		return errors.New("path requires at least 1 arg")
+	}
+	return setPath(append(getPath(), args...))
+}
+
+func rcCd(s *server, args []string) error {
+	if len(args) != 1 {
+		return errors.New("cd requires 1 arg")
+	}
+	return s.session.Chdir(args[0])
+}
+
+func rcAlias(s *server, args []string) error {
+	if len(args) < 2 {
+		return errors.New("alias requires a name and a command")
+	}
+	s.aliases[args[0]] = args[1:]
+	return nil
+}
+
+// start a command in the background
+func rcBg(s *server, args []string) error {
+	if len(args) == 0 {
+		return errors.New("bg requires a command")
+	}
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              args[0],
+		Args:             args[1:],
+		Name:             strings.Join(args, " "),
+		StdoutScrollback: defaultScrollback,
+		StderrScrollback: defaultScrollback,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Start()
+}
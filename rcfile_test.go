@@ -0,0 +1,87 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func splitRcLine_testaux(t *testing.T, line string, expected ...string) {
+	words, err := splitRcLine(line)
+	if err != nil {
+		t.Errorf("%q: unexpected error: %v", line, err)
+		return
+	}
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("%q -> %q, expected %q", line, words, expected)
+	}
+}
+
+func TestSplitRcLine(t *testing.T) {
+	splitRcLine_testaux(t, "setenv FOO bar", "setenv", "FOO", "bar")
+	splitRcLine_testaux(t, "  alias\tll   ls -l ", "alias", "ll", "ls", "-l")
+	splitRcLine_testaux(t, `setenv GREETING "hello  world"`, "setenv", "GREETING", "hello  world")
+	splitRcLine_testaux(t, `bg echo "say \"hi\"" ""`, "bg", "echo", `say "hi"`, "")
+	if _, err := splitRcLine(`setenv FOO "bar`); err == nil {
+		t.Errorf("expected error for unterminated quote")
+	}
+}
+
+func TestLoadRcFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "lushrc")
+	if err != nil {
+		t.Fatalf("failed to create temp rc file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# test rc file
+setenv LUSHRCTEST one
+setenv LUSHRCTEST2 ${LUSHRCTEST}two
+
+unsetenv LUSHRCTEST
+alias ll ls -l
+nosuchdirective
+setenv TOO many args
+`)
+	f.Close()
+	s := newServer()
+	s.loadRcFile(f.Name(), true)
+	if v := s.session.Getenv("LUSHRCTEST"); v != "" {
+		t.Errorf("LUSHRCTEST should be unset, is %q", v)
+	}
+	if v := s.session.Getenv("LUSHRCTEST2"); v != "onetwo" {
+		t.Errorf("LUSHRCTEST2: expected %q, got %q", "onetwo", v)
+	}
+	argv := s.expandAlias([]string{"ll", "/tmp"})
+	if !reflect.DeepEqual(argv, []string{"ls", "-l", "/tmp"}) {
+		t.Errorf("unexpected alias expansion: %q", argv)
+	}
+	if len(s.rcerrors) != 2 {
+		t.Errorf("expected 2 rc errors, got %q", s.rcerrors)
+	}
+	s = newServer()
+	s.loadRcFile(f.Name()+".doesnotexist", false)
+	if len(s.rcerrors) != 0 {
+		t.Errorf("missing optional rc file should not be an error: %q", s.rcerrors)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Readiness probes and commands that wait for their dependencies to be ready.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// seconds to wait for dependencies when not specified
+const defaultAfterTimeout = 60
+
+// exactly one condition must be set
+type readyOptions struct {
+	// host:port accepting TCP connections
+	Tcp string `json:"tcp,omitempty"`
+	// URL returning a 2xx status code
+	Http string `json:"http,omitempty"`
+	// regular expression matching stdout or stderr
+	Output string `json:"output,omitempty"`
+}
+
+// start only once these commands are ready
+type afterOptions struct {
+	Deps []liblush.CmdId `json:"deps"`
+	// seconds
+	Timeout float64 `json:"timeout"`
+}
+
+type readiness struct {
+	ready *readyOptions
+	after *afterOptions
+}
+
+func (o *readyOptions) probe() (liblush.Probe, error) {
+	var probe liblush.Probe
+	n := 0
+	if o.Tcp != "" {
+		probe = liblush.TCPProbe(o.Tcp)
+		n++
+	}
+	if o.Http != "" {
+		probe = liblush.HTTPProbe(o.Http)
+		n++
+	}
+	if o.Output != "" {
+		re, err := regexp.Compile(o.Output)
+		if err != nil {
+			return nil, fmt.Errorf("illegal output regexp: %v", err)
+		}
+		probe = liblush.OutputProbe(re)
+		n++
+	}
+	if n != 1 {
+		return nil, errors.New("readiness probe needs exactly one of tcp, http or output")
+	}
+	return probe, nil
+}
+
+func (s *server) getReadiness(id liblush.CmdId) readiness {
+	s.readinesslock.Lock()
+	defer s.readinesslock.Unlock()
+	if r := s.readiness[id]; r != nil {
+		return *r
+	}
+	return readiness{}
+}
+
+func (s *server) updateReadiness(id liblush.CmdId, f func(r *readiness)) {
+	s.readinesslock.Lock()
+	defer s.readinesslock.Unlock()
+	r := s.readiness[id]
+	if r == nil {
+		r = &readiness{}
+		s.readiness[id] = r
+	}
+	f(r)
+	if r.ready == nil && r.after == nil {
+		delete(s.readiness, id)
+	}
+}
+
+// set the readiness condition of a command (nil to remove)
+func (s *server) setReadyProbe(c liblush.Cmd, options *readyOptions) error {
+	var probe liblush.Probe
+	if options != nil {
+		var err error
+		probe, err = options.probe()
+		if err != nil {
+			return err
+		}
+	}
+	c.SetReadinessProbe(probe)
+	s.updateReadiness(c.Id(), func(r *readiness) {
+		r.ready = options
+	})
+	return nil
+}
+
+// set the dependencies of a command (nil to remove)
+func (s *server) setAfter(c liblush.Cmd, options *afterOptions) error {
+	if options != nil {
+		for _, id := range options.Deps {
+			if id == c.Id() {
+				return errors.New("command cannot depend on itself")
+			}
+			if s.session.GetCommand(id) == nil {
+				return fmt.Errorf("no such command: %d", id)
+			}
+		}
+		if options.Timeout <= 0 {
+			options.Timeout = defaultAfterTimeout
+		}
+	}
+	s.updateReadiness(c.Id(), func(r *readiness) {
+		r.after = options
+	})
+	return nil
+}
+
+// start a command, once its dependencies are ready if it has any
+func (s *server) startCmd(c liblush.Cmd) error {
+	after := s.getReadiness(c.Id()).after
+	if after == nil || len(after.Deps) == 0 {
+		return c.Start()
+	}
+	deps := make([]liblush.Cmd, 0, len(after.Deps))
+	for _, id := range after.Deps {
+		dep := s.session.GetCommand(id)
+		if dep == nil {
+			return fmt.Errorf("dependency %d no longer exists", id)
+		}
+		deps = append(deps, dep)
+	}
+	timeout := time.Duration(after.Timeout * float64(time.Second))
+	return c.StartAfter(deps, timeout)
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.readiness = map[liblush.CmdId]*readiness{}
+	})
+}
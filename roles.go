@@ -0,0 +1,339 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Roles: what an authenticated client is allowed to do. Every websocket event
+// and HTTP endpoint requires one permission, a role is a set of permissions.
+// Clients get their role from the token they log in with or, failing that,
+// from their address.
+//
+// The roles viewer, operator and admin exist by default, the token given by
+// -token always has the admin role. More are configured in the roles file
+// (-roles), e.g.:
+//
+//     {
+//         "roles": {"auditor": ["view"]},
+//         "tokens": {"alice": {"token": "s3cret", "role": "operator"}},
+//         "addresses": {"127.0.0.1": "admin", "192.168.1.0/24": "viewer"},
+//         "ownership": true
+//     }
+//
+// With ownership on, only admins and the client that created a command (by
+// token name or address) can start, stop, release or otherwise change it.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/web"
+)
+
+type permission string
+
+const (
+	// see commands, their output and the session
+	permView permission = "view"
+	// create, run, stop and change commands
+	permControl permission = "control"
+	// change the session itself: environment, PATH, templates, exit &c
+	permAdmin permission = "admin"
+)
+
+var defaultRoles = map[string][]permission{
+	"viewer":   {permView},
+	"operator": {permView, permControl},
+	"admin":    {permView, permControl, permAdmin},
+}
+
+type role struct {
+	name        string
+	permissions map[permission]bool
+}
+
+func (r *role) can(p permission) bool {
+	return r != nil && r.permissions[p]
+}
+
+// whoever sent a request
+type principal struct {
+	// token name or client address, "admin" for the -token token
+	name string
+	role *role
+}
+
+func (p principal) can(perm permission) bool {
+	return p.role.can(perm)
+}
+
+type tokenConfig struct {
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// contents of the roles file
+type accessConfig struct {
+	Roles map[string][]permission `json:"roles"`
+	// by name
+	Tokens map[string]tokenConfig `json:"tokens"`
+	// IP address or CIDR network -> role name
+	Addresses map[string]string `json:"addresses"`
+	Ownership bool              `json:"ownership"`
+}
+
+type namedToken struct {
+	name  string
+	token string
+	role  *role
+}
+
+type addressRule struct {
+	net  *net.IPNet
+	role *role
+}
+
+type accessControl struct {
+	roles     map[string]*role
+	tokens    []namedToken
+	addresses []addressRule
+	ownership bool
+}
+
+func newAccessControl(config accessConfig) (*accessControl, error) {
+	ac := &accessControl{
+		roles:     map[string]*role{},
+		ownership: config.Ownership,
+	}
+	addRoles := func(roles map[string][]permission) error {
+		for name, perms := range roles {
+			r := &role{name: name, permissions: map[permission]bool{}}
+			for _, p := range perms {
+				switch p {
+				case permView, permControl, permAdmin:
+					r.permissions[p] = true
+				default:
+					return fmt.Errorf("unknown permission %q in role %s", p, name)
+				}
+			}
+			ac.roles[name] = r
+		}
+		return nil
+	}
+	addRoles(defaultRoles)
+	if err := addRoles(config.Roles); err != nil {
+		return nil, err
+	}
+	for name, tc := range config.Tokens {
+		r := ac.roles[tc.Role]
+		if r == nil {
+			return nil, fmt.Errorf("unknown role %q for token %s", tc.Role, name)
+		}
+		if tc.Token == "" {
+			return nil, fmt.Errorf("empty token for %s", name)
+		}
+		ac.tokens = append(ac.tokens, namedToken{name, tc.Token, r})
+	}
+	for addr, rolename := range config.Addresses {
+		r := ac.roles[rolename]
+		if r == nil {
+			return nil, fmt.Errorf("unknown role %q for address %s", rolename, addr)
+		}
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", addr)
+			}
+			bits := 8 * len(ip)
+			ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		ac.addresses = append(ac.addresses, addressRule{ipnet, r})
+	}
+	return ac, nil
+}
+
+func (s *server) loadAccessConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config accessConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("corrupt roles file %s: %v", path, err)
+	}
+	ac, err := newAccessControl(config)
+	if err != nil {
+		return fmt.Errorf("roles file %s: %v", path, err)
+	}
+	s.access = ac
+	return nil
+}
+
+// the principal logging in with this token
+func (s *server) tokenPrincipal(token string) (principal, bool) {
+	if s.token != "" && tokensEqual(token, s.token) {
+		return principal{"admin", s.access.roles["admin"]}, true
+	}
+	for _, nt := range s.access.tokens {
+		if tokensEqual(token, nt.token) {
+			return principal{nt.name, nt.role}, true
+		}
+	}
+	return principal{}, false
+}
+
+// the principal whose token has this id (see tokenId)
+func (s *server) tokenIdPrincipal(id string) (principal, bool) {
+	if s.token != "" && tokensEqual(id, tokenId(s.token)) {
+		return principal{"admin", s.access.roles["admin"]}, true
+	}
+	for _, nt := range s.access.tokens {
+		if tokensEqual(id, tokenId(nt.token)) {
+			return principal{nt.name, nt.role}, true
+		}
+	}
+	return principal{}, false
+}
+
+// the principal for a client that did not present a token. the most specific
+// matching network wins.
+func (s *server) addressPrincipal(addr string) (principal, bool) {
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if ip == nil {
+		return principal{}, false
+	}
+	var best *addressRule
+	for i, rule := range s.access.addresses {
+		if !rule.net.Contains(ip) {
+			continue
+		}
+		if best == nil || maskSize(rule.net) > maskSize(best.net) {
+			best = &s.access.addresses[i]
+		}
+	}
+	if best == nil {
+		return principal{}, false
+	}
+	return principal{addr, best.role}, true
+}
+
+func maskSize(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// who sent this request, false if nobody we know
+func (s *server) identify(ctx *web.Context) (principal, bool) {
+	auth := ctx.Request.Header.Get("Authorization")
+	bearer := strings.HasPrefix(auth, "Bearer ")
+	if !bearer && crossSiteRequest(ctx.Request) {
+		// not even with authentication disabled: that means anybody who can
+		// connect, not any site the user happens to visit
+		return principal{}, false
+	}
+	if s.token == "" {
+		// authentication is disabled
+		return principal{"anonymous", s.access.roles["admin"]}, true
+	}
+	if bearer {
+		return s.tokenPrincipal(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if ses, ok := s.requestSession(ctx); ok {
+		if p, ok := s.tokenIdPrincipal(ses.tokenid); ok {
+			return p, true
+		}
+	}
+	return s.addressPrincipal(remoteAddr(ctx))
+}
+
+// 401 if the client is not authenticated, 403 if its role lacks perm
+func errorIfNotAllowed(ctx *web.Context, perm permission) error {
+	s := ctx.User.(*server)
+	p, ok := s.identify(ctx)
+	if !ok && crossSiteRequest(ctx.Request) {
+		return web.WebError{403, "cross-site request refused"}
+	}
+	if !ok {
+		ctx.Header().Set("WWW-Authenticate", `Bearer realm="lush"`)
+		return web.WebError{401, "authentication required"}
+	}
+	if !p.can(perm) {
+		return web.WebError{403, fmt.Sprintf("permission denied: %s permission required", perm)}
+	}
+	return nil
+}
+
+// 403 unless the client may change this command (see checkOwner). call after
+// errorIfNotAllowed.
+func errorIfNotOwner(ctx *web.Context, id liblush.CmdId) error {
+	s := ctx.User.(*server)
+	p, _ := s.identify(ctx)
+	if err := s.checkOwner(p, id); err != nil {
+		return web.WebError{403, err.Error()}
+	}
+	return nil
+}
+
+func (s *server) setOwner(id liblush.CmdId, owner string) {
+	s.ownerslock.Lock()
+	defer s.ownerslock.Unlock()
+	s.owners[id] = owner
+}
+
+// empty if the command was not created by a client (rc file, procfile, &c)
+func (s *server) owner(id liblush.CmdId) string {
+	s.ownerslock.Lock()
+	defer s.ownerslock.Unlock()
+	return s.owners[id]
+}
+
+func (s *server) releaseOwner(id liblush.CmdId) {
+	s.ownerslock.Lock()
+	defer s.ownerslock.Unlock()
+	delete(s.owners, id)
+}
+
+// error unless p may change this command
+func (s *server) checkOwner(p principal, id liblush.CmdId) error {
+	if !s.access.ownership || p.can(permAdmin) {
+		return nil
+	}
+	switch owner := s.owner(id); owner {
+	case p.name:
+		return nil
+	case "":
+		return lushError{fmt.Errorf("command %d has no owner: only admins can do this", id)}
+	default:
+		return lushError{fmt.Errorf("command %d belongs to %s", id, owner)}
+	}
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		// the default roles can't be wrong
+		s.access, _ = newAccessControl(accessConfig{})
+		s.owners = map[liblush.CmdId]string{}
+	})
+}
@@ -0,0 +1,181 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/hraban/lush/liblush"
+)
+
+func TestAccessConfigErrors(t *testing.T) {
+	for _, config := range []accessConfig{
+		{Roles: map[string][]permission{"x": {"fly"}}},
+		{Tokens: map[string]tokenConfig{"alice": {"s3cret", "nobody"}}},
+		{Tokens: map[string]tokenConfig{"alice": {"", "viewer"}}},
+		{Addresses: map[string]string{"not an address": "viewer"}},
+		{Addresses: map[string]string{"10.0.0.1": "nobody"}},
+	} {
+		if _, err := newAccessControl(config); err == nil {
+			t.Errorf("expected error for %#v", config)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	s := newServer()
+	s.setToken("root")
+	var err error
+	s.access, err = newAccessControl(accessConfig{
+		Roles:  map[string][]permission{"auditor": {permView}},
+		Tokens: map[string]tokenConfig{"alice": {"s3cret", "operator"}},
+		Addresses: map[string]string{
+			"192.0.2.0/24": "viewer",
+			"192.0.2.1":    "admin",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path, token, addr string
+		code              int
+	}{
+		{"/search.json?q=x", "", "198.51.100.1:1234", 401},
+		{"/search.json?q=x", "s3cret", "198.51.100.1:1234", 200},
+		{"/files.json", "s3cret", "198.51.100.1:1234", 200},
+		{"/environ.json", "s3cret", "198.51.100.1:1234", 403},
+		{"/environ.json", "root", "198.51.100.1:1234", 200},
+		{"/search.json?q=x", "", "192.0.2.7:1234", 200},
+		{"/files.json", "", "192.0.2.7:1234", 403},
+		// most specific rule wins
+		{"/environ.json", "", "192.0.2.1:1234", 200},
+		// a wrong token is not overruled by the address
+		{"/search.json?q=x", "wrong", "192.0.2.7:1234", 401},
+	} {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.RemoteAddr = test.addr
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if rec := serveTest(s, req); rec.Code != test.code {
+			t.Errorf("%s with token %q from %s: expected %d, got %d",
+				test.path, test.token, test.addr, test.code, rec.Code)
+		}
+	}
+}
+
+func TestWsEventPermissions(t *testing.T) {
+	for name := range wsHandlers {
+		if _, ok := wsEventPermissions[name]; !ok {
+			t.Errorf("no permission for event %s", name)
+		}
+	}
+	for name := range wsClientHandlers {
+		if _, ok := wsEventPermissions[name]; !ok {
+			t.Errorf("no permission for event %s", name)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	s := newServer()
+	s.access.ownership = true
+	s.setOwner(1, "alice")
+	alice := principal{"alice", s.access.roles["operator"]}
+	bob := principal{"bob", s.access.roles["operator"]}
+	admin := principal{"admin", s.access.roles["admin"]}
+	if err := s.checkOwner(alice, 1); err != nil {
+		t.Errorf("owner refused: %v", err)
+	}
+	if err := s.checkOwner(bob, 1); err == nil {
+		t.Errorf("expected error for other operator")
+	}
+	if err := s.checkOwner(admin, 1); err != nil {
+		t.Errorf("admin refused: %v", err)
+	}
+	if err := s.checkOwner(alice, 2); err == nil {
+		t.Errorf("expected error for command without owner")
+	}
+	s.access.ownership = false
+	if err := s.checkOwner(bob, 1); err != nil {
+		t.Errorf("ownership enforced while disabled: %v", err)
+	}
+}
+
+func TestOwnedEvents(t *testing.T) {
+	for name := range wsOwnedEvents {
+		if wsHandlers[name] == nil && wsClientHandlers[name] == nil {
+			t.Errorf("ownership rule for unknown event %s", name)
+		}
+	}
+	s := newServer()
+	s.groups["app"] = &cmdGroup{Services: []groupService{{Id: 4}, {Id: 5}}}
+	for _, test := range []struct {
+		event, arg string
+		ids        []liblush.CmdId
+	}{
+		{"stop", "3", []liblush.CmdId{3}},
+		{"stop", "x", nil},
+		{"stdin", `{"nid":3,"text":"hi"}`, []liblush.CmdId{3}},
+		{"setprop", `{"name":"cmd3","prop":"name","value":"x"}`, []liblush.CmdId{3}},
+		{"setprop", `{"name":"session","prop":"x","value":"x"}`, nil},
+		{"connect", `{"from":3,"to":4,"stream":"stdout"}`, []liblush.CmdId{3, 4}},
+		{"connect", `{"from":3,"to":0,"stream":"stdout"}`, []liblush.CmdId{3}},
+		{"stopgroup", "app", []liblush.CmdId{4, 5}},
+	} {
+		ids := wsOwnedEvents[test.event](s, test.arg)
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s;%s: expected %v, got %v", test.event, test.arg, test.ids, ids)
+		}
+	}
+}
+
+func TestOwnershipHTTP(t *testing.T) {
+	s := newServer()
+	s.setToken("root")
+	var err error
+	s.access, err = newAccessControl(accessConfig{
+		Tokens: map[string]tokenConfig{
+			"alice": {"a", "operator"},
+			"bob":   {"b", "operator"},
+		},
+		Ownership: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCommand(s, cmdOptions{Cmd: "cat", owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.session.ReleaseCommand(c.Id())
+	for token, allowed := range map[string]bool{"b": false, "a": true, "root": true} {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%d/send?stream=stdin&data=x", c.Id()), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if rec := serveTest(s, req); (rec.Code != 403) != allowed {
+			t.Errorf("send with token %s: unexpected status %d", token, rec.Code)
+		}
+	}
+}
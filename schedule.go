@@ -0,0 +1,409 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Commands started periodically by the session, cron style.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// number of runs remembered per schedule
+const scheduleHistorySize = 100
+
+// commands of this many recent runs are kept per schedule, older ones are
+// released
+const scheduleKeptRuns = 10
+
+type scheduleSpec struct {
+	Name string `json:"name"`
+	// either a crontab line or a duration (e.g. "30s", "1h") between runs
+	Cron  string   `json:"cron,omitempty"`
+	Every string   `json:"every,omitempty"`
+	Cmd   string   `json:"cmd"`
+	Args  []string `json:"args"`
+	// what to do when the previous run is still going: skip (default),
+	// queue (start as soon as the previous one exits) or kill (stop the
+	// previous one, then start)
+	Overlap string `json:"overlap"`
+}
+
+type scheduledRun struct {
+	Scheduled time.Time     `json:"scheduled"`
+	Id        liblush.CmdId `json:"nid,omitempty"`
+	Skipped   bool          `json:"skipped,omitempty"`
+	// command could not be created or started
+	Error string `json:"error,omitempty"`
+}
+
+type schedule struct {
+	scheduleSpec
+	Id     int  `json:"id"`
+	Paused bool `json:"paused"`
+	// nil when paused
+	Next *time.Time `json:"next"`
+	cron *cronSpec
+	// when Cron is empty
+	every time.Duration
+	timer *time.Timer
+	// most recently started command
+	current liblush.Cmd
+	// a run is being created outside the lock
+	starting bool
+	// start a new run as soon as current exits
+	queued  bool
+	deleted bool
+	history []scheduledRun
+	// commands of the most recent runs, oldest first
+	kept []liblush.CmdId
+	// name of the client that created the schedule, owns its runs
+	owner string
+}
+
+type scheduler struct {
+	l         sync.Mutex
+	lastid    int
+	schedules map[int]*schedule
+}
+
+func (spec *scheduleSpec) parse() (*cronSpec, time.Duration, error) {
+	if spec.Cmd == "" {
+		return nil, 0, errors.New("schedule needs a command")
+	}
+	switch spec.Overlap {
+	case "":
+		spec.Overlap = "skip"
+	case "skip", "queue", "kill":
+	default:
+		return nil, 0, fmt.Errorf("unknown overlap policy: %q", spec.Overlap)
+	}
+	if spec.Cron != "" && spec.Every != "" {
+		return nil, 0, errors.New("schedule needs either cron or every, not both")
+	}
+	if spec.Cron != "" {
+		c, err := parseCron(spec.Cron)
+		return c, 0, err
+	}
+	d, err := time.ParseDuration(spec.Every)
+	if err != nil {
+		return nil, 0, fmt.Errorf("illegal interval: %v", err)
+	}
+	if d < time.Second {
+		return nil, 0, errors.New("interval must be at least one second")
+	}
+	return nil, d, nil
+}
+
+func isRunning(c liblush.Cmd) bool {
+	return c.Status().Started() != nil && c.Status().Exited() == nil
+}
+
+// set the timer for the next run. caller must hold the scheduler lock.
+func (sc *schedule) arm(s *server) {
+	var next time.Time
+	if sc.cron != nil {
+		next = sc.cron.Next(time.Now())
+		if next.IsZero() {
+			sc.Next = nil
+			return
+		}
+	} else {
+		next = time.Now().Add(sc.every)
+	}
+	sc.Next = &next
+	sc.timer = time.AfterFunc(next.Sub(time.Now()), func() {
+		s.schedules.fire(s, sc)
+	})
+}
+
+func (sc *schedule) record(run scheduledRun) {
+	sc.history = append(sc.history, run)
+	if len(sc.history) > scheduleHistorySize {
+		sc.history = sc.history[len(sc.history)-scheduleHistorySize:]
+	}
+}
+
+// create and start a new run, and release the command of the oldest run
+// that is no longer kept. caller must not hold the scheduler lock, and must
+// have set starting.
+func (sc *schedule) start(s *server, scheduled time.Time) {
+	run := scheduledRun{Scheduled: scheduled}
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              sc.Cmd,
+		Args:             sc.Args,
+		Name:             sc.Name,
+		StdoutScrollback: defaultScrollback,
+		StderrScrollback: defaultScrollback,
+		owner:            sc.owner,
+	})
+	if err == nil {
+		run.Id = c.Id()
+		c.Status().NotifyChange(func(status liblush.CmdStatus) error {
+			if status.Exited() != nil {
+				// can't take the lock here: this is also called from within
+				// Start()
+				go s.schedules.exited(s, sc, c)
+			}
+			return nil
+		})
+		err = c.Start()
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	s.schedules.l.Lock()
+	sc.starting = false
+	sc.record(run)
+	var old []liblush.CmdId
+	if c != nil {
+		sc.current = c
+		sc.kept = append(sc.kept, c.Id())
+		if n := len(sc.kept) - scheduleKeptRuns; n > 0 {
+			old = append(old, sc.kept[:n]...)
+			sc.kept = sc.kept[n:]
+		}
+	}
+	s.schedules.broadcast(s)
+	s.schedules.l.Unlock()
+	for _, id := range old {
+		// might have been released by a client already
+		wseventRelease(s, fmt.Sprint(id))
+	}
+}
+
+func (sched *scheduler) fire(s *server, sc *schedule) {
+	sched.l.Lock()
+	if sc.deleted || sc.Paused {
+		sched.l.Unlock()
+		return
+	}
+	now := time.Now()
+	busy := sc.starting || sc.current != nil && isRunning(sc.current)
+	if busy {
+		switch sc.Overlap {
+		case "skip":
+			sc.record(scheduledRun{Scheduled: now, Skipped: true})
+		case "kill":
+			if sc.current != nil {
+				sc.current.Signal(StopSignal)
+			}
+			sc.queued = true
+		case "queue":
+			sc.queued = true
+		}
+	} else {
+		sc.starting = true
+	}
+	sc.arm(s)
+	sched.broadcast(s)
+	sched.l.Unlock()
+	if !busy {
+		sc.start(s, now)
+	}
+}
+
+// previous run exited: start a queued run, if any
+func (sched *scheduler) exited(s *server, sc *schedule, c liblush.Cmd) {
+	sched.l.Lock()
+	if sc.current != c || !sc.queued || sc.starting || sc.deleted || sc.Paused {
+		sched.l.Unlock()
+		return
+	}
+	sc.queued = false
+	sc.starting = true
+	sched.l.Unlock()
+	sc.start(s, time.Now())
+}
+
+func (sched *scheduler) add(s *server, spec scheduleSpec, owner string) (*schedule, error) {
+	cron, every, err := spec.parse()
+	if err != nil {
+		return nil, err
+	}
+	if spec.Name == "" {
+		spec.Name = strings.Join(append([]string{spec.Cmd}, spec.Args...), " ")
+	}
+	sched.l.Lock()
+	defer sched.l.Unlock()
+	sched.lastid++
+	sc := &schedule{
+		scheduleSpec: spec,
+		Id:           sched.lastid,
+		cron:         cron,
+		every:        every,
+		owner:        owner,
+	}
+	sched.schedules[sc.Id] = sc
+	sc.arm(s)
+	return sc, nil
+}
+
+func (sched *scheduler) get(idstr string) (*schedule, error) {
+	id, _ := strconv.Atoi(idstr)
+	sc := sched.schedules[id]
+	if sc == nil {
+		return nil, lushError{errors.New("no such schedule: " + idstr)}
+	}
+	return sc, nil
+}
+
+// caller must hold the scheduler lock
+func (sched *scheduler) list() []*schedule {
+	ids := make([]int, 0, len(sched.schedules))
+	for id := range sched.schedules {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	list := make([]*schedule, len(ids))
+	for i, id := range ids {
+		list[i] = sched.schedules[id]
+	}
+	return list
+}
+
+// send all schedules to all clients. caller must hold the scheduler lock.
+func (sched *scheduler) broadcast(s *server) error {
+	return writePrefixedJson(&s.ctrlclients, "schedules;", sched.list())
+}
+
+// eg schedule;{"name":"disk","every":"5m","cmd":"df","args":["-h"]}
+// eg schedule;{"name":"backup","cron":"0 3 * * *","cmd":"backup.sh","overlap":"kill"}
+//
+// runs are owned by the client that created the schedule. only the commands of
+// the last few runs are kept.
+func wseventSchedule(s *server, client wsClient, specJSON string) error {
+	var spec scheduleSpec
+	err := json.Unmarshal([]byte(specJSON), &spec)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	_, err = s.schedules.add(s, spec, client.principal.name)
+	if err != nil {
+		return lushError{fmt.Errorf("illegal schedule: %v", err)}
+	}
+	return wseventSchedules(s, "")
+}
+
+// list all schedules with their next run time
+// eg schedules;
+func wseventSchedules(s *server, _ string) error {
+	s.schedules.l.Lock()
+	defer s.schedules.l.Unlock()
+	return s.schedules.broadcast(s)
+}
+
+// eg pauseschedule;3
+func wseventPauseschedule(s *server, idstr string) error {
+	s.schedules.l.Lock()
+	defer s.schedules.l.Unlock()
+	sc, err := s.schedules.get(idstr)
+	if err != nil {
+		return err
+	}
+	if !sc.Paused {
+		sc.Paused = true
+		sc.queued = false
+		sc.Next = nil
+		if sc.timer != nil {
+			sc.timer.Stop()
+		}
+	}
+	return s.schedules.broadcast(s)
+}
+
+// eg resumeschedule;3
+func wseventResumeschedule(s *server, idstr string) error {
+	s.schedules.l.Lock()
+	defer s.schedules.l.Unlock()
+	sc, err := s.schedules.get(idstr)
+	if err != nil {
+		return err
+	}
+	if sc.Paused {
+		sc.Paused = false
+		sc.arm(s)
+	}
+	return s.schedules.broadcast(s)
+}
+
+// delete a schedule. commands it started are not affected.
+// eg delschedule;3
+func wseventDelschedule(s *server, idstr string) error {
+	s.schedules.l.Lock()
+	defer s.schedules.l.Unlock()
+	sc, err := s.schedules.get(idstr)
+	if err != nil {
+		return err
+	}
+	sc.deleted = true
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+	delete(s.schedules.schedules, sc.Id)
+	return s.schedules.broadcast(s)
+}
+
+// past runs of a schedule, most recent last. the status of commands that have
+// not been released yet is included.
+// eg schedulehistory;3
+func wseventSchedulehistory(s *server, idstr string) error {
+	type runJson struct {
+		scheduledRun
+		Status *statusJson `json:"status,omitempty"`
+	}
+	s.schedules.l.Lock()
+	defer s.schedules.l.Unlock()
+	sc, err := s.schedules.get(idstr)
+	if err != nil {
+		return err
+	}
+	runs := make([]runJson, len(sc.history))
+	for i, run := range sc.history {
+		runs[i].scheduledRun = run
+		if run.Id == 0 {
+			continue
+		}
+		if c := s.session.GetCommand(run.Id); c != nil {
+			status := cmdstatus2json(c.Status())
+			runs[i].Status = &status
+		}
+	}
+	return writePrefixedJson(&s.ctrlclients, "schedulehistory;", map[string]interface{}{
+		"id":   sc.Id,
+		"name": sc.Name,
+		"runs": runs,
+	})
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.schedules = &scheduler{schedules: map[int]*schedule{}}
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleRuns(t *testing.T) {
+	s := newServer()
+	sc, err := s.schedules.add(s, scheduleSpec{Every: "1h", Cmd: "true"}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.schedules.l.Lock()
+	sc.timer.Stop()
+	s.schedules.l.Unlock()
+	for i := 0; i < scheduleKeptRuns+2; i++ {
+		s.schedules.l.Lock()
+		sc.starting = true
+		s.schedules.l.Unlock()
+		sc.start(s, time.Now())
+		s.schedules.l.Lock()
+		c := sc.current
+		s.schedules.l.Unlock()
+		if err := c.Wait(); err != nil {
+			t.Fatalf("run %d failed: %v", i, err)
+		}
+		if owner := s.owner(c.Id()); owner != "alice" {
+			t.Errorf("run %d owned by %q", i, owner)
+		}
+	}
+	if n := len(s.session.GetCommandIds()); n != scheduleKeptRuns {
+		t.Errorf("expected %d commands, got %d", scheduleKeptRuns, n)
+	}
+	if n := len(sc.history); n != scheduleKeptRuns+2 {
+		t.Errorf("expected %d runs in the history, got %d", scheduleKeptRuns+2, n)
+	}
+}
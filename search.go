@@ -0,0 +1,275 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Searching the scrollback of commands without sending it to the client.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/lush/vt100"
+	"github.com/hraban/web"
+)
+
+const (
+	defaultSearchMatches = 100
+	maxSearchMatches     = 1000
+	maxSearchContext     = 10
+	// longer lines are cut off in the results (not in the search)
+	maxSearchLineLength = 500
+)
+
+type searchOptions struct {
+	// 0 searches all commands
+	Id liblush.CmdId `json:"nid"`
+	// stdout or stderr, empty for both
+	Stream  string `json:"stream"`
+	Pattern string `json:"pattern"`
+	// pattern is a regular expression (RE2 syntax) rather than literal text
+	Regex      bool `json:"regex"`
+	IgnoreCase bool `json:"ignorecase"`
+	// search the output without escape codes. offsets are relative to the
+	// stripped output.
+	Strip bool `json:"strip"`
+	// number of lines before and after every match
+	Context    int `json:"context"`
+	MaxMatches int `json:"maxmatches"`
+}
+
+type searchMatch struct {
+	Id     liblush.CmdId `json:"nid"`
+	Stream string        `json:"stream"`
+	// byte offset and length of the match in the scrollback
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// line number in the scrollback, starting at 1. the scrollback only
+	// holds the tail of the output so this is not necessarily the line
+	// number in the entire output.
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+type searchResult struct {
+	Options searchOptions `json:"options"`
+	Matches []searchMatch `json:"matches"`
+	// more matches were found than returned
+	Truncated bool `json:"truncated"`
+}
+
+func (opts searchOptions) regexp() (*regexp.Regexp, error) {
+	if opts.Pattern == "" {
+		return nil, errors.New("empty search pattern")
+	}
+	expr := opts.Pattern
+	if !opts.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if opts.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func truncateLine(line string) string {
+	if len(line) > maxSearchLineLength {
+		return line[:maxSearchLineLength]
+	}
+	return line
+}
+
+func contextLines(lines []string) []string {
+	ctx := make([]string, len(lines))
+	for i, line := range lines {
+		ctx[i] = truncateLine(line)
+	}
+	return ctx
+}
+
+// all matches of re in text, at most max. returns false if there were more.
+func searchText(text string, re *regexp.Regexp, context, max int) ([]searchMatch, bool) {
+	matches := []searchMatch{}
+	lines := strings.Split(text, "\n")
+	offset := 0
+	for i, line := range lines {
+		for _, loc := range re.FindAllStringIndex(line, -1) {
+			if loc[0] == loc[1] {
+				// empty matches (e.g. ^) are not interesting
+				continue
+			}
+			if len(matches) >= max {
+				return matches, false
+			}
+			from := i - context
+			if from < 0 {
+				from = 0
+			}
+			to := i + 1 + context
+			if to > len(lines) {
+				to = len(lines)
+			}
+			matches = append(matches, searchMatch{
+				Offset: offset + loc[0],
+				Length: loc[1] - loc[0],
+				Line:   i + 1,
+				Text:   truncateLine(line),
+				Before: contextLines(lines[from:i]),
+				After:  contextLines(lines[i+1 : to]),
+			})
+		}
+		offset += len(line) + 1
+	}
+	return matches, true
+}
+
+func (s *server) search(opts searchOptions) (searchResult, error) {
+	res := searchResult{Matches: []searchMatch{}}
+	re, err := opts.regexp()
+	if err != nil {
+		return res, err
+	}
+	if opts.MaxMatches <= 0 {
+		opts.MaxMatches = defaultSearchMatches
+	}
+	if opts.MaxMatches > maxSearchMatches {
+		opts.MaxMatches = maxSearchMatches
+	}
+	if opts.Context < 0 {
+		opts.Context = 0
+	}
+	if opts.Context > maxSearchContext {
+		opts.Context = maxSearchContext
+	}
+	streams := []string{"stdout", "stderr"}
+	if opts.Stream != "" {
+		if opts.Stream != "stdout" && opts.Stream != "stderr" {
+			return res, errors.New("unknown stream: " + opts.Stream)
+		}
+		streams = []string{opts.Stream}
+	}
+	ids := s.session.GetCommandIds()
+	// same results (and the same cut at MaxMatches) for the same request
+	sort.Sort(cmdIds(ids))
+	if opts.Id != 0 {
+		if s.session.GetCommand(opts.Id) == nil {
+			return res, fmt.Errorf("no such command: %d", opts.Id)
+		}
+		ids = []liblush.CmdId{opts.Id}
+	}
+	res.Options = opts
+	for _, id := range ids {
+		c := s.session.GetCommand(id)
+		if c == nil {
+			// released in the meantime
+			continue
+		}
+		for _, streamname := range streams {
+			text, err := stringifyWriterTo(cmdStream(c, streamname).Scrollback())
+			if err != nil {
+				return res, err
+			}
+			if opts.Strip {
+				text = string(vt100.StripEscapes([]byte(text)))
+			}
+			left := opts.MaxMatches - len(res.Matches)
+			matches, complete := searchText(text, re, opts.Context, left)
+			for _, m := range matches {
+				m.Id = id
+				m.Stream = streamname
+				res.Matches = append(res.Matches, m)
+			}
+			if !complete {
+				res.Truncated = true
+				return res, nil
+			}
+		}
+	}
+	return res, nil
+}
+
+// search the scrollback of one command (nid) or all commands (nid 0 or
+// omitted)
+//
+//     search;{"nid":3,"stream":"stderr","pattern":"error: .*","regex":true,"context":2}
+//
+// reply: search;{"options":{...},"matches":[{"nid":3,"stream":"stderr","offset":1234,"length":18,"line":40,"text":"...","before":[...],"after":[...]}],"truncated":false}
+func wseventSearch(s *server, optionsJSON string) error {
+	var opts searchOptions
+	err := json.Unmarshal([]byte(optionsJSON), &opts)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	res, err := s.search(opts)
+	if err != nil {
+		return lushError{err}
+	}
+	return writePrefixedJson(&s.ctrlclients, "search;", res)
+}
+
+func parseSearchParams(params map[string]string) (opts searchOptions, err error) {
+	opts.Stream = params["stream"]
+	opts.Pattern = params["q"]
+	opts.Regex = params["regex"] != ""
+	opts.IgnoreCase = params["ignorecase"] != ""
+	opts.Strip = params["strip"] != ""
+	if str := params["nid"]; str != "" {
+		opts.Id, err = liblush.ParseCmdId(str)
+		if err != nil {
+			return
+		}
+	}
+	if str := params["context"]; str != "" {
+		opts.Context, err = strconv.Atoi(str)
+		if err != nil {
+			return
+		}
+	}
+	if str := params["max"]; str != "" {
+		opts.MaxMatches, err = strconv.Atoi(str)
+	}
+	return
+}
+
+// eg /search.json?q=error&nid=3&context=2
+func handleGetSearch(ctx *web.Context) (searchResult, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return searchResult{}, err
+	}
+	s := ctx.User.(*server)
+	opts, err := parseSearchParams(ctx.Params)
+	if err != nil {
+		return searchResult{}, web.WebError{400, err.Error()}
+	}
+	res, err := s.search(opts)
+	if err != nil {
+		return res, web.WebError{400, err.Error()}
+	}
+	ctx.ContentType("json")
+	return res, nil
+}
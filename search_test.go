@@ -0,0 +1,99 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hraban/lush/liblush"
+)
+
+func TestSearchText(t *testing.T) {
+	opts := searchOptions{Pattern: "ERR", IgnoreCase: true}
+	re, err := opts.regexp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "one\nerror two\nthree\nfour err\nfive"
+	matches, complete := searchText(text, re, 1, 10)
+	if !complete || len(matches) != 2 {
+		t.Fatalf("Expected 2 matches, got %#v", matches)
+	}
+	expected := searchMatch{
+		Offset: 4,
+		Length: 3,
+		Line:   2,
+		Text:   "error two",
+		Before: []string{"one"},
+		After:  []string{"three"},
+	}
+	if !reflect.DeepEqual(matches[0], expected) {
+		t.Errorf("Unexpected first match: %#v", matches[0])
+	}
+	if m := matches[1]; m.Offset != 25 || m.Line != 4 || text[m.Offset:m.Offset+m.Length] != "err" {
+		t.Errorf("Unexpected second match: %#v", m)
+	}
+	matches, complete = searchText(text, re, 0, 1)
+	if complete || len(matches) != 1 {
+		t.Errorf("Expected search to stop after 1 match: %#v", matches)
+	}
+}
+
+func TestSearchLiteral(t *testing.T) {
+	re, err := searchOptions{Pattern: "a.c"}.regexp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := searchText("abc\na.c", re, 0, 10)
+	if len(matches) != 1 || matches[0].Line != 2 {
+		t.Errorf("Expected only the literal match: %#v", matches)
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	s := newServer()
+	for i := 0; i < 5; i++ {
+		c, err := newCommand(s, cmdOptions{
+			Cmd:              "echo",
+			Args:             []string{"needle"},
+			StdoutScrollback: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := s.search(searchOptions{Pattern: "needle", MaxMatches: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 3 {
+		t.Fatalf("Expected 3 matches, got %#v", res.Matches)
+	}
+	for i, m := range res.Matches {
+		if m.Id != liblush.CmdId(i+1) {
+			t.Errorf("Expected matches in command order, got %d at %d", m.Id, i)
+		}
+	}
+}
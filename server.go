@@ -25,6 +25,8 @@ import (
 	"html/template"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"bitbucket.org/kardianos/osext"
 	"github.com/hraban/lush/liblush"
@@ -37,12 +39,64 @@ type server struct {
 	tmplts  *template.Template
 	web     *web.Server
 	// indexed data store for arbitrary session data from client
-	userdata    map[string]string
-	ctrlclients liblush.FlexibleMultiWriter
-	// true iff everybody is allowed access to "master commands". when false
-	// (default) only the first connecting IP will be granted access. all
-	// others will be restricted to "safe" actions.
-	everybodyMaster bool
+	userdata     map[string]string
+	userdatalock sync.Mutex
+	ctrlclients  liblush.FlexibleMultiWriter
+	// access token (or password) required from every client, empty if
+	// authentication is disabled
+	token string
+	// sessions that were logged out before they expired: nonce -> expiry
+	revoked     map[string]time.Time
+	revokedlock sync.Mutex
+	// command name -> argv it expands to (set by the rc file)
+	aliases map[string][]string
+	// errors encountered while evaluating the rc file, replayed to every
+	// websocket client that connects
+	rcerrors []string
+	// saved command templates
+	templates *templateStore
+	// periodically started commands
+	schedules *scheduler
+	// commands re-run periodically (watch mode)
+	watches     map[liblush.CmdId]*watch
+	watcheslock sync.Mutex
+	// commands re-run when files change
+	fswatches     map[liblush.CmdId]*fsTrigger
+	fswatcheslock sync.Mutex
+	// commands restarted when they exit
+	supervisors     map[liblush.CmdId]*supervisor
+	supervisorslock sync.Mutex
+	// services started from a Procfile, by group name
+	groups     map[string]*cmdGroup
+	groupslock sync.Mutex
+	// readiness probes and dependencies of commands
+	readiness     map[liblush.CmdId]*readiness
+	readinesslock sync.Mutex
+	// output streams parsed as JSON lines
+	records     map[streamKey]*recordBuffer
+	recordslock sync.Mutex
+	// terminal emulators fed with command output
+	terminals     map[liblush.CmdId]*emulator
+	terminalslock sync.Mutex
+	// presentation of escape codes in output (if not raw)
+	ansi     map[liblush.CmdId]string
+	ansilock sync.Mutex
+	// character sets of output streams (if not UTF-8)
+	encodings     map[streamKey]string
+	encodingslock sync.Mutex
+	// binary output detection per stream
+	binary     map[streamKey]*binaryDetector
+	binarylock sync.Mutex
+	// pending writes to stdin from websocket clients
+	stdinqueues     map[liblush.CmdId]*stdinQueue
+	stdinqueueslock sync.Mutex
+	// released commands are written here, nil to forget them
+	archive *archive
+	// roles and how clients get them
+	access *accessControl
+	// who created which command (if ownership is enforced)
+	owners     map[liblush.CmdId]string
+	ownerslock sync.Mutex
 }
 
 // name of this package (used to find the static resource files)
@@ -86,6 +140,7 @@ func newServer() *server {
 		root:    root,
 		web:     web.NewServer(),
 		tmplts:  tmplts,
+		aliases: map[string][]string{},
 	}
 	s.web.Config.StaticDirs = []string{root + "/static"}
 	s.web.User = s
@@ -0,0 +1,286 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Session state file: the commands, environment, PATH and userdata of the
+// session are saved periodically and on shutdown, and restored on startup.
+//
+// Finished and prepared (not yet started) commands come back with their
+// output, status and options. Commands that were still running cannot be
+// reattached; they come back as exited with the "lost" error.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// bump when the format changes incompatibly
+const stateVersion = 1
+
+var errLost = errors.New("lost: lush was stopped while the command was running")
+
+type savedStatus struct {
+	Started *time.Time `json:"started,omitempty"`
+	Exited  *time.Time `json:"exited,omitempty"`
+	Err     string     `json:"err,omitempty"`
+}
+
+type savedCommand struct {
+	// argv is stored in Cmd and Args, after alias expansion. only options
+	// that describe the command are kept, not those that make it do
+	// something (supervise, ready, after).
+	Options cmdOptions  `json:"options"`
+	Status  savedStatus `json:"status"`
+	Owner   string      `json:"owner,omitempty"`
+	// raw scrollback
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+}
+
+type sessionState struct {
+	Version  int               `json:"version"`
+	Saved    time.Time         `json:"saved"`
+	Cwd      string            `json:"cwd"`
+	Path     []string          `json:"path"`
+	Environ  map[string]string `json:"environ"`
+	UserData map[string]string `json:"userdata"`
+	Commands []savedCommand    `json:"commands"`
+}
+
+type cmdIds []liblush.CmdId
+
+func (ids cmdIds) Len() int           { return len(ids) }
+func (ids cmdIds) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids cmdIds) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+
+func defaultStatePath() string {
+	return filepath.Join(homeDir(), ".lush", "state.json")
+}
+
+func scrollbackBytes(stream liblush.OutStream) []byte {
+	var buf bytes.Buffer
+	stream.Scrollback().WriteTo(&buf)
+	return buf.Bytes()
+}
+
+func (s *server) saveCommand(c liblush.Cmd) savedCommand {
+	argv := c.Argv()
+	sc := savedCommand{
+		Options: cmdOptions{
+			Id:               c.Id(),
+			Cmd:              argv[0],
+			Args:             argv[1:],
+			Name:             c.Name(),
+			UserData:         c.UserData(),
+			StdoutScrollback: c.Stdout().Scrollback().Size(),
+			StderrScrollback: c.Stderr().Scrollback().Size(),
+			StdoutRecords:    s.recordsLimit(c.Id(), "stdout"),
+			StderrRecords:    s.recordsLimit(c.Id(), "stderr"),
+			StdoutTimestamps: c.Stdout().Timestamps(),
+			StderrTimestamps: c.Stderr().Timestamps(),
+			Terminal:         s.terminalOptions(c.Id()),
+			Ansi:             s.ansiMode(c.Id()),
+			StdoutEncoding:   s.streamEncoding(c.Id(), "stdout"),
+			StderrEncoding:   s.streamEncoding(c.Id(), "stderr"),
+			ForceText:        s.forceText(c.Id()),
+			StdinQueue:       c.Stdin().QueueLimit(),
+		},
+		Status: savedStatus{
+			Started: c.Status().Started(),
+			Exited:  c.Status().Exited(),
+		},
+		Owner:  s.owner(c.Id()),
+		Stdout: scrollbackBytes(c.Stdout()),
+		Stderr: scrollbackBytes(c.Stderr()),
+	}
+	if err := c.Status().Err(); err != nil {
+		sc.Status.Err = err.Error()
+	}
+	if to := pipedcmd(c.Stdout()); to != nil {
+		sc.Options.Stdoutto = to.Id()
+	}
+	if to := pipedcmd(c.Stderr()); to != nil {
+		sc.Options.Stderrto = to.Id()
+	}
+	return sc
+}
+
+func (s *server) sessionState() sessionState {
+	state := sessionState{
+		Version:  stateVersion,
+		Saved:    time.Now(),
+		Path:     getPath(),
+		Environ:  s.session.Environ(),
+		UserData: map[string]string{},
+	}
+	state.Cwd, _ = os.Getwd()
+	s.userdatalock.Lock()
+	for k, v := range s.userdata {
+		state.UserData[k] = v
+	}
+	s.userdatalock.Unlock()
+	ids := s.session.GetCommandIds()
+	sort.Sort(cmdIds(ids))
+	for _, id := range ids {
+		if c := s.session.GetCommand(id); c != nil {
+			state.Commands = append(state.Commands, s.saveCommand(c))
+		}
+	}
+	return state
+}
+
+func (s *server) saveState(path string) error {
+	data, err := json.Marshal(s.sessionState())
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first to never leave a half-written file
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// save the state every interval until the server exits
+func (s *server) saveStatePeriodically(path string, interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if err := s.saveState(path); err != nil {
+			log.Printf("Failed to save session state to %s: %v", path, err)
+		}
+	}
+}
+
+func (s *server) restoreCommand(sc savedCommand, saved time.Time) error {
+	status := liblush.PastStatus{
+		Started: sc.Status.Started,
+		Exited:  sc.Status.Exited,
+		Err:     sc.Status.Err,
+	}
+	if status.Started != nil && status.Exited == nil {
+		status.Exited = &saved
+		status.Err = errLost.Error()
+	}
+	options := sc.Options
+	options.owner = sc.Owner
+	c, err := s.session.RestoreCommand(options.Id, status,
+		append([]string{options.Cmd}, options.Args...))
+	if err != nil {
+		return err
+	}
+	err = initCommand(s, c, options)
+	if err != nil {
+		return err
+	}
+	// through the peekers as well, to rebuild the screen, records, &c
+	for _, out := range []struct {
+		stream liblush.OutStream
+		data   []byte
+	}{
+		{c.Stdout(), sc.Stdout},
+		{c.Stderr(), sc.Stderr},
+	} {
+		out.stream.Scrollback().Write(out.data)
+		out.stream.Peeker().Write(out.data)
+	}
+	return nil
+}
+
+// load the session from the state file. a missing file is not an error.
+// commands that fail to restore are logged and skipped.
+func (s *server) restoreState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state sessionState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("corrupt state file %s: %v", path, err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported state file version %d in %s", state.Version, path)
+	}
+	if state.Environ != nil {
+		for k := range s.session.Environ() {
+			if _, ok := state.Environ[k]; !ok {
+				s.session.Unsetenv(k)
+			}
+		}
+		for k, v := range state.Environ {
+			s.session.Setenv(k, v)
+		}
+	}
+	if len(state.Path) > 0 {
+		if err := setPath(state.Path); err != nil {
+			log.Print("Failed to restore PATH: ", err)
+		}
+	}
+	if state.Cwd != "" {
+		if err := s.session.Chdir(state.Cwd); err != nil {
+			log.Print("Failed to restore working directory: ", err)
+		}
+	}
+	s.userdatalock.Lock()
+	for k, v := range state.UserData {
+		s.userdata[k] = v
+	}
+	s.userdatalock.Unlock()
+	for _, sc := range state.Commands {
+		if err := s.restoreCommand(sc, state.Saved); err != nil {
+			log.Printf("Failed to restore command %d: %v", sc.Options.Id, err)
+		}
+	}
+	// only once every command exists
+	for _, sc := range state.Commands {
+		for stream, to := range map[string]liblush.CmdId{
+			"stdout": sc.Options.Stdoutto,
+			"stderr": sc.Options.Stderrto,
+		} {
+			if to == 0 || s.session.GetCommand(sc.Options.Id) == nil {
+				continue
+			}
+			err := connectCmdsById(s, sc.Options.Id, to, stream)
+			if err != nil {
+				log.Printf("Failed to restore %s pipe of command %d: %v", stream, sc.Options.Id, err)
+			}
+		}
+	}
+	return nil
+}
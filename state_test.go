@@ -0,0 +1,126 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveRestoreState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lushstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	s := newServer()
+	s.userdata["layout"] = "wide"
+	s.session.Setenv("LUSHSTATE", "saved")
+	done, err := newCommand(s, cmdOptions{
+		Cmd:              "echo",
+		Args:             []string{"hello"},
+		Name:             "greeting",
+		StdoutScrollback: 100,
+		UserData:         "pos",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = done.Run(); err != nil {
+		t.Fatal(err)
+	}
+	prepared, err := newCommand(s, cmdOptions{Cmd: "cat", Ansi: ansiStrip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = connectCmdsById(s, done.Id(), prepared.Id(), "stdout"); err != nil {
+		t.Fatal(err)
+	}
+	running, err := newCommand(s, cmdOptions{Cmd: "sleep", Args: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = running.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer running.Signal(os.Kill)
+	if err = s.saveState(path); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	s = newServer()
+	if err = s.restoreState(path); err != nil {
+		t.Fatalf("failed to restore state: %v", err)
+	}
+	if s.userdata["layout"] != "wide" {
+		t.Errorf("userdata not restored: %v", s.userdata)
+	}
+	if v := s.session.Getenv("LUSHSTATE"); v != "saved" {
+		t.Errorf("environment not restored: %q", v)
+	}
+	c := s.session.GetCommand(done.Id())
+	if c == nil {
+		t.Fatal("finished command not restored")
+	}
+	if c.Name() != "greeting" || c.UserData() != "pos" {
+		t.Errorf("metadata not restored: %q, %v", c.Name(), c.UserData())
+	}
+	if out, _ := stringifyWriterTo(c.Stdout().Scrollback()); out != "hello\n" {
+		t.Errorf("output not restored: %q", out)
+	}
+	if st := cmdstatus2json(c.Status()); st.Code != 2 {
+		t.Errorf("expected successful status, got %#v", st)
+	}
+	if to := pipedcmd(c.Stdout()); to == nil || to.Id() != prepared.Id() {
+		t.Errorf("pipe not restored: %v", to)
+	}
+	c = s.session.GetCommand(prepared.Id())
+	if c == nil {
+		t.Fatal("prepared command not restored")
+	}
+	if c.Status().Started() != nil {
+		t.Errorf("prepared command restored as started")
+	}
+	if mode := s.ansiMode(c.Id()); mode != ansiStrip {
+		t.Errorf("options not restored, ansi mode: %q", mode)
+	}
+	c = s.session.GetCommand(running.Id())
+	if c == nil {
+		t.Fatal("running command not restored")
+	}
+	if st := cmdstatus2json(c.Status()); !st.Lost || c.Status().Exited() == nil {
+		t.Errorf("running command not marked lost: %#v", st)
+	}
+	if id := s.session.NewCommand("true").Id(); id <= running.Id() {
+		t.Errorf("new command reuses restored id %d", id)
+	}
+}
+
+func TestRestoreMissingState(t *testing.T) {
+	s := newServer()
+	err := s.restoreState(filepath.Join(os.TempDir(), "lush-no-such-state.json"))
+	if err != nil {
+		t.Errorf("missing state file must not be an error: %v", err)
+	}
+}
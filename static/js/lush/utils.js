@@ -162,7 +162,8 @@ var guid = function () {
 
 // create full websocket uri from relative path
 var wsURI = function (path) {
-    return 'ws://' + document.location.host + path;
+    var scheme = document.location.protocol == 'https:' ? 'wss://' : 'ws://';
+    return scheme + document.location.host + path;
 };
 
 // Call given var whenever = function  the specified stream from this
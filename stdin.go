@@ -0,0 +1,171 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Writing to stdin of commands over the control websocket: keystrokes for
+// interactive programs.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// stdin events queued per command before the client has to wait
+const stdinQueueLen = 256
+
+type stdinOp struct {
+	data  []byte
+	close bool
+	// errors are reported to this client
+	client wsClient
+}
+
+// writes to stdin of one command in order of arrival, without blocking the
+// websocket of the client when the command is not reading
+type stdinQueue struct {
+	ops  chan stdinOp
+	done chan struct{}
+}
+
+func (q *stdinQueue) run(c liblush.Cmd) {
+	for {
+		select {
+		case <-q.done:
+			return
+		case op := <-q.ops:
+			var err error
+			if op.close {
+				err = c.Stdin().Close()
+			} else {
+				_, err = c.Stdin().WriteQueued(op.data)
+			}
+			if err != nil {
+				// nothing to do if the client is gone
+				writePrefixedJson(op.client, "error;",
+					fmt.Sprintf("stdin of command %d: %v", c.Id(), err))
+			}
+		}
+	}
+}
+
+func (s *server) getStdinQueue(c liblush.Cmd) *stdinQueue {
+	s.stdinqueueslock.Lock()
+	defer s.stdinqueueslock.Unlock()
+	q := s.stdinqueues[c.Id()]
+	if q == nil {
+		q = &stdinQueue{
+			ops:  make(chan stdinOp, stdinQueueLen),
+			done: make(chan struct{}),
+		}
+		s.stdinqueues[c.Id()] = q
+		go q.run(c)
+	}
+	return q
+}
+
+func (s *server) releaseStdinQueue(id liblush.CmdId) {
+	s.stdinqueueslock.Lock()
+	defer s.stdinqueueslock.Unlock()
+	if q := s.stdinqueues[id]; q != nil {
+		close(q.done)
+		delete(s.stdinqueues, id)
+	}
+}
+
+func (s *server) queueStdin(c liblush.Cmd, op stdinOp) error {
+	if c.Status().Exited() != nil {
+		return fmt.Errorf("command %d has exited", c.Id())
+	}
+	q := s.getStdinQueue(c)
+	select {
+	case q.ops <- op:
+		return nil
+	case <-q.done:
+		return fmt.Errorf("command %d was released", c.Id())
+	}
+}
+
+// write to stdin of a command. text is sent as is, data is base64 encoded
+// (for anything that is not UTF-8). writes and closes from one client arrive
+// in the order they were sent. errors are reported to the sending client
+// only.
+//
+// eg stdin;{"nid":3,"text":"print(1)\n"}
+// eg stdin;{"nid":3,"data":"AAEC"}
+func wseventStdin(s *server, client wsClient, reqJSON string) error {
+	var req struct {
+		Id   liblush.CmdId `json:"nid"`
+		Text string
+		Data string
+	}
+	err := json.Unmarshal([]byte(reqJSON), &req)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	c := s.session.GetCommand(req.Id)
+	if c == nil {
+		return lushError{fmt.Errorf("no such command: %d", req.Id)}
+	}
+	data := []byte(req.Text)
+	if req.Data != "" {
+		if req.Text != "" {
+			return lushError{errors.New("stdin: specify either text or data, not both")}
+		}
+		data, err = base64.StdEncoding.DecodeString(req.Data)
+		if err != nil {
+			return lushError{fmt.Errorf("stdin: illegal base64 data: %v", err)}
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	err = s.queueStdin(c, stdinOp{data: data, client: client})
+	if err != nil {
+		return lushError{err}
+	}
+	return nil
+}
+
+// close stdin of a command after everything written before by the stdin
+// event (end of file)
+//
+// eg closestdin;3
+func wseventClosestdin(s *server, client wsClient, idstr string) error {
+	c, err := getCmd(s, idstr)
+	if err != nil {
+		return lushError{err}
+	}
+	err = s.queueStdin(c, stdinOp{close: true, client: client})
+	if err != nil {
+		return lushError{err}
+	}
+	return nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.stdinqueues = map[liblush.CmdId]*stdinQueue{}
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWseventStdin(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{Cmd: "cat", StdoutScrollback: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// errors would be written to the client, none are expected
+	var client wsClient
+	events := []struct {
+		handler wsClientHandler
+		arg     string
+	}{
+		{wseventStdin, fmt.Sprintf(`{"nid":%d,"text":"one "}`, c.Id())},
+		{wseventStdin, fmt.Sprintf(`{"nid":%d,"data":"AHR3bw=="}`, c.Id())},
+		{wseventClosestdin, fmt.Sprint(c.Id())},
+	}
+	for _, ev := range events {
+		err = ev.handler(s, client, ev.arg)
+		if err != nil {
+			t.Fatalf("Error handling %q: %v", ev.arg, err)
+		}
+	}
+	done := make(chan bool)
+	go func() {
+		c.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stdin was not closed")
+	}
+	out, _ := stringifyWriterTo(c.Stdout().Scrollback())
+	if out != "one \x00two" {
+		t.Errorf("Unexpected output: %q", out)
+	}
+	err = wseventStdin(s, client, fmt.Sprintf(`{"nid":%d,"text":"late"}`, c.Id()))
+	if _, ok := err.(lushError); !ok {
+		t.Errorf("Expected error writing to exited command, got %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Supervised commands: automatically started again when they exit.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// a run that lasted at least this long was not a crash loop: start backing
+// off from scratch
+const backoffResetAfter = 10 * time.Second
+
+type supervisePolicy struct {
+	// "always" (default) or "on-failure"
+	Restart string `json:"restart"`
+	// give up after this many consecutive quick restarts (0: never)
+	MaxRetries int `json:"maxRetries"`
+	// seconds to wait before the first restart, doubled for every consecutive
+	// quick restart up to MaxBackoff
+	Backoff    float64 `json:"backoff"`
+	MaxBackoff float64 `json:"maxBackoff"`
+}
+
+type superviseInfo struct {
+	supervisePolicy
+	Restarts int  `json:"restarts"`
+	GaveUp   bool `json:"gaveUp"`
+	// nil unless a restart is pending
+	NextRestart *time.Time `json:"nextRestart"`
+}
+
+type supervisor struct {
+	cmd    liblush.Cmd
+	policy supervisePolicy
+	l      sync.Mutex
+	// total number of restarts
+	restarts int
+	// consecutive quick restarts
+	retries int
+	// no more restarts until explicitly started again
+	stopped bool
+	gaveUp  bool
+	// unsupervised (for good)
+	removed     bool
+	timer       *time.Timer
+	nextRestart *time.Time
+}
+
+func (p *supervisePolicy) validate() error {
+	switch p.Restart {
+	case "":
+		p.Restart = "always"
+	case "always", "on-failure":
+	default:
+		return fmt.Errorf("unknown restart policy: %q", p.Restart)
+	}
+	if p.MaxRetries < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("negative values not allowed in restart policy")
+	}
+	if p.Backoff == 0 {
+		p.Backoff = 1
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = 60
+	}
+	return nil
+}
+
+func (sup *supervisor) info() superviseInfo {
+	sup.l.Lock()
+	defer sup.l.Unlock()
+	return superviseInfo{
+		supervisePolicy: sup.policy,
+		Restarts:        sup.restarts,
+		GaveUp:          sup.gaveUp,
+		NextRestart:     sup.nextRestart,
+	}
+}
+
+func (sup *supervisor) notify(s *server) {
+	notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(sup.cmd.Id()),
+		Propname: "supervise",
+		Value:    sup.info(),
+	})
+}
+
+// the command exited (or failed to start): schedule a restart if the policy
+// says so
+func (sup *supervisor) exited(s *server) {
+	sup.l.Lock()
+	defer sup.l.Unlock()
+	if sup.stopped || sup.removed || sup.timer != nil {
+		return
+	}
+	status := sup.cmd.Status()
+	if sup.policy.Restart == "on-failure" && status.Success() {
+		return
+	}
+	if status.Started() != nil && status.Exited() != nil &&
+		status.Exited().Sub(*status.Started()) >= backoffResetAfter {
+		sup.retries = 0
+	}
+	if sup.policy.MaxRetries > 0 && sup.retries >= sup.policy.MaxRetries {
+		sup.gaveUp = true
+		go sup.notify(s)
+		return
+	}
+	delay := sup.policy.Backoff
+	for i := 0; i < sup.retries && delay < sup.policy.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > sup.policy.MaxBackoff {
+		delay = sup.policy.MaxBackoff
+	}
+	sup.retries++
+	d := time.Duration(delay * float64(time.Second))
+	next := time.Now().Add(d)
+	sup.nextRestart = &next
+	sup.timer = time.AfterFunc(d, func() { sup.restart(s) })
+	go sup.notify(s)
+}
+
+// spawn a fresh process under the same command
+func (sup *supervisor) restart(s *server) {
+	sup.l.Lock()
+	sup.timer = nil
+	sup.nextRestart = nil
+	if sup.stopped || sup.removed {
+		sup.l.Unlock()
+		return
+	}
+	sup.restarts++
+	sup.l.Unlock()
+	err := sup.cmd.Reset()
+	if err != nil {
+		s.web.Logger.Printf("supervisor %d: %v", sup.cmd.Id(), err)
+		return
+	}
+	// a failure to start is picked up by the status listener
+	sup.cmd.Start()
+	sup.notify(s)
+}
+
+// don't restart until explicitly started again
+func (sup *supervisor) stop() {
+	sup.l.Lock()
+	defer sup.l.Unlock()
+	sup.stopped = true
+	if sup.timer != nil {
+		sup.timer.Stop()
+		sup.timer = nil
+		sup.nextRestart = nil
+	}
+}
+
+// explicitly started again: restart when it exits, with a fresh backoff
+func (sup *supervisor) resume() {
+	sup.l.Lock()
+	defer sup.l.Unlock()
+	sup.stopped = false
+	sup.gaveUp = false
+	sup.retries = 0
+}
+
+func (s *server) getSupervisor(id liblush.CmdId) *supervisor {
+	s.supervisorslock.Lock()
+	defer s.supervisorslock.Unlock()
+	return s.supervisors[id]
+}
+
+// start supervising a command. from now on it is restarted when it exits,
+// according to the policy.
+func (s *server) supervise(c liblush.Cmd, policy supervisePolicy) error {
+	err := policy.validate()
+	if err != nil {
+		return err
+	}
+	sup := &supervisor{cmd: c, policy: policy}
+	s.supervisorslock.Lock()
+	defer s.supervisorslock.Unlock()
+	if s.supervisors[c.Id()] != nil {
+		return fmt.Errorf("command %d is already supervised", c.Id())
+	}
+	s.supervisors[c.Id()] = sup
+	c.Status().NotifyChange(func(status liblush.CmdStatus) error {
+		sup.l.Lock()
+		removed := sup.removed
+		sup.l.Unlock()
+		if removed {
+			return errors.New("no longer supervised")
+		}
+		if status.Exited() != nil || (status.Started() == nil && status.Err() != nil) {
+			// not synchronously: this is called from within Start()
+			go sup.exited(s)
+		}
+		return nil
+	})
+	if c.Status().Exited() != nil {
+		go sup.exited(s)
+	}
+	return nil
+}
+
+func (s *server) unsupervise(id liblush.CmdId) bool {
+	s.supervisorslock.Lock()
+	defer s.supervisorslock.Unlock()
+	sup := s.supervisors[id]
+	if sup == nil {
+		return false
+	}
+	sup.stop()
+	sup.l.Lock()
+	sup.removed = true
+	sup.l.Unlock()
+	delete(s.supervisors, id)
+	return true
+}
+
+// restart a command when it exits. reported as updates of the supervise
+// property.
+// eg supervise;{"nid":3,"restart":"on-failure","maxRetries":5,"backoff":1,"maxBackoff":60}
+func wseventSupervise(s *server, optionsJSON string) error {
+	var options struct {
+		Id liblush.CmdId `json:"nid"`
+		supervisePolicy
+	}
+	err := json.Unmarshal([]byte(optionsJSON), &options)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	c := s.session.GetCommand(options.Id)
+	if c == nil {
+		return fmt.Errorf("no such command: %d", options.Id)
+	}
+	err = s.supervise(c, options.supervisePolicy)
+	if err != nil {
+		return lushError{err}
+	}
+	s.getSupervisor(c.Id()).notify(s)
+	return nil
+}
+
+// stop restarting a command. does not stop the command itself.
+// eg unsupervise;3
+func wseventUnsupervise(s *server, idstr string) error {
+	id, _ := liblush.ParseCmdId(idstr)
+	if !s.unsupervise(id) {
+		return lushError{errors.New("command is not supervised: " + idstr)}
+	}
+	return notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(id),
+		Propname: "supervise",
+		Value:    nil,
+	})
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.supervisors = map[liblush.CmdId]*supervisor{}
+	})
+}
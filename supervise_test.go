@@ -0,0 +1,79 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuperviseMaxRetries(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd: "false",
+		Supervise: &supervisePolicy{
+			Restart:    "on-failure",
+			MaxRetries: 2,
+			Backoff:    0.01,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create supervised command: %v", err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatalf("failed to start supervised command: %v", err)
+	}
+	sup := s.getSupervisor(c.Id())
+	deadline := time.Now().Add(5 * time.Second)
+	for !sup.info().GaveUp && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	info := sup.info()
+	if !info.GaveUp {
+		t.Fatalf("supervisor did not give up: %#v", info)
+	}
+	if info.Restarts != 2 {
+		t.Errorf("expected 2 restarts, got %d", info.Restarts)
+	}
+}
+
+func TestSuperviseOnFailure(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{
+		Cmd:       "true",
+		Supervise: &supervisePolicy{Restart: "on-failure", Backoff: 0.01},
+	})
+	if err != nil {
+		t.Fatalf("failed to create supervised command: %v", err)
+	}
+	err = c.Run()
+	if err != nil {
+		t.Fatalf("failed to run supervised command: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if info := s.getSupervisor(c.Id()).info(); info.Restarts != 0 || info.NextRestart != nil {
+		t.Errorf("successful command should not be restarted: %#v", info)
+	}
+	if err = s.supervise(c, supervisePolicy{Restart: "sometimes"}); err == nil {
+		t.Errorf("expected error for unknown restart policy")
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Discovery of runnable tasks in the current directory: Makefile targets, npm
+// scripts and executables in ./scripts.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/hraban/web"
+)
+
+type task struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// make, npm or script
+	Source string   `json:"source"`
+	Argv   []string `json:"argv"`
+}
+
+// "target other-target: deps ## description". := and = are assignments.
+var makeRuleRegexp = regexp.MustCompile(`^([A-Za-z0-9_./-][^:=#]*?)\s*:([^=].*|)$`)
+
+// targets of a Makefile. the description is taken from a "## comment" on the
+// same line, or otherwise from the comment lines right above the rule.
+func parseMakefile(r io.Reader) ([]task, error) {
+	var tasks []task
+	seen := map[string]bool{}
+	var comment []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			comment = append(comment, strings.TrimSpace(strings.TrimLeft(line, "#")))
+			continue
+		}
+		m := makeRuleRegexp.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(line, "\t") {
+			comment = nil
+			continue
+		}
+		desc := strings.Join(comment, " ")
+		comment = nil
+		if i := strings.Index(m[2], "##"); i >= 0 {
+			desc = strings.TrimSpace(m[2][i+2:])
+		}
+		for _, target := range strings.Fields(m[1]) {
+			// special targets (.PHONY) and pattern rules (%.o) are no tasks
+			if strings.HasPrefix(target, ".") || strings.Contains(target, "%") || seen[target] {
+				continue
+			}
+			seen[target] = true
+			tasks = append(tasks, task{
+				Name:        target,
+				Description: desc,
+				Source:      "make",
+				Argv:        []string{"make", target},
+			})
+		}
+	}
+	return tasks, scanner.Err()
+}
+
+// scripts from package.json, described by their command line
+func parsePackageJson(r io.Reader) ([]task, error) {
+	var pkg struct {
+		Scripts map[string]string
+	}
+	err := json.NewDecoder(r).Decode(&pkg)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(pkg.Scripts))
+	for name := range pkg.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tasks := make([]task, len(names))
+	for i, name := range names {
+		tasks[i] = task{
+			Name:        name,
+			Description: pkg.Scripts[name],
+			Source:      "npm",
+			Argv:        []string{"npm", "run", name},
+		}
+	}
+	return tasks, nil
+}
+
+func isExecutable(fi os.FileInfo) bool {
+	if runtime.GOOS == "windows" {
+		switch strings.ToLower(filepath.Ext(fi.Name())) {
+		case ".exe", ".bat", ".cmd":
+			return true
+		}
+		return false
+	}
+	return fi.Mode()&0111 != 0
+}
+
+// first comment line after the #! line of a script, if any
+func scriptDescription(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 5 && scanner.Scan(); i++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#!") {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return strings.TrimSpace(strings.TrimLeft(line, "#"))
+		}
+		if strings.TrimSpace(line) != "" {
+			break
+		}
+	}
+	return ""
+}
+
+func scriptTasks(dir string) []task {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var tasks []task
+	for _, fi := range fis {
+		if fi.IsDir() || !isExecutable(fi) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		tasks = append(tasks, task{
+			Name:        fi.Name(),
+			Description: scriptDescription(path),
+			Source:      "script",
+			Argv:        []string{path},
+		})
+	}
+	return tasks
+}
+
+// all tasks found in dir. unreadable or malformed files are skipped.
+func discoverTasks(dir string) []task {
+	tasks := []task{}
+	if f, err := os.Open(filepath.Join(dir, "Makefile")); err == nil {
+		if found, err := parseMakefile(f); err == nil {
+			tasks = append(tasks, found...)
+		}
+		f.Close()
+	}
+	if f, err := os.Open(filepath.Join(dir, "package.json")); err == nil {
+		if found, err := parsePackageJson(f); err == nil {
+			tasks = append(tasks, found...)
+		}
+		f.Close()
+	}
+	tasks = append(tasks, scriptTasks(filepath.Join(dir, "scripts"))...)
+	return tasks
+}
+
+func cwdTasks() ([]task, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return discoverTasks(dir), nil
+}
+
+// eg tasks;
+func wseventTasks(s *server, _ string) error {
+	tasks, err := cwdTasks()
+	if err != nil {
+		return lushError{err}
+	}
+	return writePrefixedJson(&s.ctrlclients, "tasks;", tasks)
+}
+
+// create a command for a discovered task and start it. it belongs to the
+// client that ran it.
+//
+// eg runtask;{"source":"make","name":"test"}
+func wseventRuntask(s *server, client wsClient, reqJSON string) error {
+	var req struct {
+		Source, Name string
+		UserData     interface{}
+	}
+	err := json.Unmarshal([]byte(reqJSON), &req)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	tasks, err := cwdTasks()
+	if err != nil {
+		return lushError{err}
+	}
+	for _, t := range tasks {
+		if t.Source != req.Source || t.Name != req.Name {
+			continue
+		}
+		c, err := newCommand(s, cmdOptions{
+			Cmd:              t.Argv[0],
+			Args:             t.Argv[1:],
+			Name:             t.Source + ": " + t.Name,
+			StdoutScrollback: defaultScrollback,
+			StderrScrollback: defaultScrollback,
+			UserData:         req.UserData,
+			owner:            client.principal.name,
+		})
+		if err != nil {
+			return err
+		}
+		return wseventStart(s, fmt.Sprint(c.Id()))
+	}
+	return lushError{fmt.Errorf("no such task: %s %s", req.Source, req.Name)}
+}
+
+func handleGetTasks(ctx *web.Context) ([]task, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return nil, err
+	}
+	ctx.ContentType("json")
+	return cwdTasks()
+}
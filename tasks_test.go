@@ -0,0 +1,102 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMakefile(t *testing.T) {
+	const makefile = `.PHONY: all test
+# build everything
+all: lush
+
+lush: *.go ## the binary
+	go build
+
+VERSION := 1.0
+CFLAGS = -O2
+
+# run the tests
+# quickly
+test check:
+	go test
+
+%.o: %.c
+	$(CC) -c $<
+`
+	tasks, err := parseMakefile(strings.NewReader(makefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []task{
+		{"all", "build everything", "make", []string{"make", "all"}},
+		{"lush", "the binary", "make", []string{"make", "lush"}},
+		{"test", "run the tests quickly", "make", []string{"make", "test"}},
+		{"check", "run the tests quickly", "make", []string{"make", "check"}},
+	}
+	if !reflect.DeepEqual(tasks, expected) {
+		t.Errorf("Unexpected tasks: %#v", tasks)
+	}
+}
+
+func TestParsePackageJson(t *testing.T) {
+	const pkg = `{"name": "foo", "scripts": {"test": "mocha", "build": "tsc"}}`
+	tasks, err := parsePackageJson(strings.NewReader(pkg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []task{
+		{"build", "tsc", "npm", []string{"npm", "run", "build"}},
+		{"test", "mocha", "npm", []string{"npm", "run", "test"}},
+	}
+	if !reflect.DeepEqual(tasks, expected) {
+		t.Errorf("Unexpected tasks: %#v", tasks)
+	}
+}
+
+func TestScriptTasks(t *testing.T) {
+	if filepath.Separator != '/' {
+		t.Skip("executable bits are unix only")
+	}
+	dir, err := ioutil.TempDir("", "lush-tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "deploy"), []byte("#!/bin/sh\n# push to prod\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a script"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := scriptTasks(dir)
+	if len(tasks) != 1 || tasks[0].Name != "deploy" || tasks[0].Description != "push to prod" {
+		t.Errorf("Unexpected tasks: %#v", tasks)
+	}
+}
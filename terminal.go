@@ -0,0 +1,192 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Terminal emulation of command output, for programs that move the cursor
+// around (progress bars, full screen programs).
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/lush/vt100"
+	"github.com/hraban/web"
+)
+
+const (
+	defaultTerminalWidth      = 80
+	defaultTerminalHeight     = 24
+	defaultTerminalScrollback = 1000
+	// every cell of the screen is allocated up front, and so is every line of
+	// scrollback as it fills up
+	maxTerminalWidth      = 1000
+	maxTerminalHeight     = 1000
+	maxTerminalScrollback = 10000
+)
+
+type terminalOptions struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// lines kept after they scroll off the screen
+	Scrollback int `json:"scrollback"`
+}
+
+// stdout and stderr of a command written to one terminal, like a tty would
+type emulator struct {
+	options terminalOptions
+	term    *vt100.Terminal
+	// peeker on both streams
+	w io.WriteCloser
+}
+
+type terminalState struct {
+	Id         liblush.CmdId  `json:"nid"`
+	Screen     vt100.Screen   `json:"screen"`
+	Scrollback [][]vt100.Cell `json:"scrollback,omitempty"`
+}
+
+func (s *server) getTerminal(id liblush.CmdId) *vt100.Terminal {
+	s.terminalslock.Lock()
+	defer s.terminalslock.Unlock()
+	if em := s.terminals[id]; em != nil {
+		return em.term
+	}
+	return nil
+}
+
+func (s *server) terminalOptions(id liblush.CmdId) *terminalOptions {
+	s.terminalslock.Lock()
+	defer s.terminalslock.Unlock()
+	if em := s.terminals[id]; em != nil {
+		options := em.options
+		return &options
+	}
+	return nil
+}
+
+// (re)start emulating a terminal for this command. nil stops emulation. the
+// screen starts empty: output produced before is not replayed.
+func (s *server) setTerminal(c liblush.Cmd, options *terminalOptions) error {
+	if options != nil {
+		if options.Width < 0 || options.Height < 0 || options.Scrollback < 0 {
+			return errors.New("terminal dimensions must not be negative")
+		}
+		if options.Width > maxTerminalWidth || options.Height > maxTerminalHeight {
+			return fmt.Errorf("terminal can be at most %dx%d", maxTerminalWidth, maxTerminalHeight)
+		}
+		if options.Scrollback > maxTerminalScrollback {
+			return fmt.Errorf("terminal scrollback can be at most %d lines", maxTerminalScrollback)
+		}
+		if options.Width == 0 {
+			options.Width = defaultTerminalWidth
+		}
+		if options.Height == 0 {
+			options.Height = defaultTerminalHeight
+		}
+		if options.Scrollback == 0 {
+			options.Scrollback = defaultTerminalScrollback
+		}
+	}
+	s.terminalslock.Lock()
+	defer s.terminalslock.Unlock()
+	if em := s.terminals[c.Id()]; em != nil {
+		c.Stdout().Peeker().RemoveWriter(em.w)
+		c.Stderr().Peeker().RemoveWriter(em.w)
+		delete(s.terminals, c.Id())
+	}
+	if options == nil {
+		return nil
+	}
+	term := vt100.New(options.Width, options.Height, options.Scrollback)
+	em := &emulator{
+		options: *options,
+		term:    term,
+		w:       newNopWriteCloser(term),
+	}
+	c.Stdout().Peeker().AddWriter(em.w)
+	c.Stderr().Peeker().AddWriter(em.w)
+	s.terminals[c.Id()] = em
+	// programs that do not talk to a tty can still use this to size their
+	// output
+	c.Setenv("COLUMNS", strconv.Itoa(options.Width))
+	c.Setenv("LINES", strconv.Itoa(options.Height))
+	return nil
+}
+
+func (s *server) releaseTerminal(id liblush.CmdId) {
+	s.terminalslock.Lock()
+	defer s.terminalslock.Unlock()
+	delete(s.terminals, id)
+}
+
+func (s *server) terminalState(idstr string, scrollback bool) (terminalState, error) {
+	id, _ := liblush.ParseCmdId(idstr)
+	term := s.getTerminal(id)
+	if term == nil {
+		return terminalState{}, errors.New("no terminal emulation for command " + idstr)
+	}
+	state := terminalState{Id: id, Screen: term.Screen()}
+	if scrollback {
+		state.Scrollback = term.Scrollback()
+	}
+	return state, nil
+}
+
+// current screen of a command with terminal emulation (see the terminal
+// command option)
+//
+//     screen;3
+//
+// reply: screen;{"nid":3,"screen":{"width":80,"height":24,"cursorRow":2,"cursorCol":0,"cursorVisible":true,"altScreen":false,"cells":[[{"c":"a","fg":1,"bold":true},...],...]}}
+func wseventScreen(s *server, idstr string) error {
+	state, err := s.terminalState(idstr, false)
+	if err != nil {
+		return lushError{err}
+	}
+	return writePrefixedJson(&s.ctrlclients, "screen;", state)
+}
+
+// same as the screen ws event, including the scrollback if ?scrollback=1
+func handleGetScreen(ctx *web.Context, idstr string) (terminalState, error) {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return terminalState{}, err
+	}
+	scrollback, err := boolParam(ctx, "scrollback")
+	if err != nil {
+		return terminalState{}, err
+	}
+	s := ctx.User.(*server)
+	state, err := s.terminalState(idstr, scrollback)
+	if err != nil {
+		return state, web.WebError{404, err.Error()}
+	}
+	ctx.ContentType("json")
+	return state, nil
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.terminals = map[liblush.CmdId]*emulator{}
+	})
+}
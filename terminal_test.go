@@ -0,0 +1,48 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestTerminalLimits(t *testing.T) {
+	s := newServer()
+	for _, options := range []terminalOptions{
+		{Width: -1},
+		{Width: 100000, Height: 100000},
+		{Width: maxTerminalWidth + 1},
+		{Scrollback: maxTerminalScrollback + 1},
+	} {
+		options := options
+		_, err := newCommand(s, cmdOptions{Cmd: "echo", Terminal: &options})
+		if _, ok := err.(lushError); !ok {
+			t.Errorf("expected error for terminal %+v, got %v", options, err)
+		}
+	}
+	c, err := newCommand(s, cmdOptions{Cmd: "echo", Terminal: &terminalOptions{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options := s.terminalOptions(c.Id()); options == nil || options.Width != defaultTerminalWidth {
+		t.Errorf("expected default terminal, got %+v", options)
+	}
+}
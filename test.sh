@@ -1,6 +1,6 @@
 #!/bin/bash
 
-go test . ./liblush  || exit 1
+go test . ./liblush ./vt100  || exit 1
 
 phantompath="$(which phantomjs)"
 if [[ -z "$phantompath" ]]
@@ -11,7 +11,7 @@ fi
 
 # start a lush server
 go build || exit 1
-./lush -l 127.0.0.1:4737 &
+./lush -l 127.0.0.1:4737 -tls=false -noauth &
 lushpid=$!
 sleep 3
 
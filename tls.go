@@ -0,0 +1,219 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// HTTPS and wss. Without a certificate a self-signed one is generated once
+// and kept in ~/.lush, its fingerprint is printed at startup so it can be
+// checked when the browser complains.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+type tlsOptions struct {
+	// both empty for the self-signed certificate
+	CertFile, KeyFile string
+	// max-age of the Strict-Transport-Security header, 0 to not send it
+	HSTS time.Duration
+	// also listen for plain HTTP here and redirect it (empty for no)
+	RedirectAddr string
+}
+
+func defaultCertPaths() (certpath, keypath string) {
+	dir := filepath.Join(homeDir(), ".lush")
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// SHA-256 of the DER encoded certificate, as printed by openssl
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// names the certificate is valid for: localhost and this machine
+func selfSignedHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	return hosts
+}
+
+func writePem(path, blocktype string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blocktype, Bytes: der})
+	return ioutil.WriteFile(path, data, perm)
+}
+
+func generateCertificate(certpath, keypath string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"lush"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(keypath), 0700)
+	if err != nil {
+		return err
+	}
+	err = writePem(keypath, "EC PRIVATE KEY", keyder, 0600)
+	if err != nil {
+		return err
+	}
+	return writePem(certpath, "CERTIFICATE", der, 0644)
+}
+
+// load the configured certificate, or the self-signed one (generating it if
+// it doesn't exist yet)
+func loadCertificate(opts tlsOptions) (tls.Certificate, error) {
+	certpath, keypath := opts.CertFile, opts.KeyFile
+	if (certpath == "") != (keypath == "") {
+		return tls.Certificate{}, errors.New("need both a certificate and a key file")
+	}
+	if certpath == "" {
+		certpath, keypath = defaultCertPaths()
+		if _, err := os.Stat(certpath); os.IsNotExist(err) {
+			log.Print("Generating self-signed certificate ", certpath)
+			err = generateCertificate(certpath, keypath, selfSignedHosts())
+			if err != nil {
+				return tls.Certificate{}, fmt.Errorf("failed to generate certificate: %v", err)
+			}
+		}
+	}
+	return tls.LoadX509KeyPair(certpath, keypath)
+}
+
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// tells browsers to stick to HTTPS (HSTS)
+type secureHandler struct {
+	h    http.Handler
+	opts tlsOptions
+}
+
+func (sh secureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil && sh.opts.HSTS > 0 {
+		w.Header().Set("Strict-Transport-Security",
+			fmt.Sprintf("max-age=%d", int64(sh.opts.HSTS/time.Second)))
+	}
+	sh.h.ServeHTTP(w, r)
+}
+
+// plain HTTP listener that sends everybody to the HTTPS address. websockets
+// can't follow redirects: they are refused, so nothing is ever served
+// unencrypted.
+func redirectToHTTPS(tlsaddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsaddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebsocket(r) {
+			http.Error(w, "websockets are only served encrypted (wss://)", 403)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// serve HTTPS (and the redirect, if configured) until something fails
+func (s *server) runTLS(addr string, opts tlsOptions) error {
+	cert, err := loadCertificate(opts)
+	if err != nil {
+		return err
+	}
+	log.Print("TLS certificate fingerprint (SHA-256): ", certFingerprint(cert.Certificate[0]))
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 2)
+	go func() {
+		errc <- http.Serve(l, secureHandler{s.web, opts})
+	}()
+	if opts.RedirectAddr != "" {
+		go func() {
+			errc <- http.ListenAndServe(opts.RedirectAddr, redirectToHTTPS(addr))
+		}()
+	}
+	return <-errc
+}
@@ -0,0 +1,116 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lushtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := tlsOptions{
+		CertFile: filepath.Join(dir, "sub", "cert.pem"),
+		KeyFile:  filepath.Join(dir, "sub", "key.pem"),
+	}
+	err = generateCertificate(opts.CertFile, opts.KeyFile, []string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(opts.KeyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("private key must only be readable by its owner: %v %v", fi.Mode(), err)
+	}
+	cert, err := loadCertificate(opts)
+	if err != nil {
+		t.Fatal("failed to load generated certificate: ", err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := x.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	fp := certFingerprint(cert.Certificate[0])
+	if !regexp.MustCompile(`^([0-9A-F]{2}:){31}[0-9A-F]{2}$`).MatchString(fp) {
+		t.Errorf("unexpected fingerprint format: %q", fp)
+	}
+	_, err = loadCertificate(tlsOptions{CertFile: opts.CertFile})
+	if err == nil {
+		t.Error("expected error for certificate without key")
+	}
+}
+
+func TestSecureHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := secureHandler{ok, tlsOptions{HSTS: time.Hour}}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if hsts := rec.Header().Get("Strict-Transport-Security"); hsts != "max-age=3600" {
+		t.Errorf("unexpected HSTS header: %q", hsts)
+	}
+	h.opts.HSTS = 0
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if hsts := rec.Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("unexpected HSTS header while disabled: %q", hsts)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	h := redirectToHTTPS("localhost:8081")
+	req, _ := http.NewRequest("GET", "http://example.com:8080/3/?x=y", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	loc := rec.Header().Get("Location")
+	if rec.Code != 301 || loc != "https://example.com:8081/3/?x=y" {
+		t.Errorf("unexpected redirect: %d to %q", rec.Code, loc)
+	}
+	h = redirectToHTTPS(":443")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if loc := rec.Header().Get("Location"); loc != "https://example.com/3/?x=y" {
+		t.Errorf("unexpected redirect to default port: %q", loc)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("expected plain websocket to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Uploading files into the stdin of a command.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+	"github.com/hraban/web"
+)
+
+// minimum time between upload progress events
+const uploadProgressInterval = 500 * time.Millisecond
+
+type uploadProgress struct {
+	Id liblush.CmdId `json:"nid"`
+	// name of the uploaded file, if known
+	Name string `json:"name,omitempty"`
+	// bytes written to stdin so far
+	Bytes int64 `json:"bytes"`
+	// -1 if unknown
+	Total int64  `json:"total"`
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// stdin of a command as written to by clients: when the command has not been
+// started and its queue is full, fail instead of tying up the request
+type queuedWriter struct {
+	in liblush.InStream
+}
+
+func (w queuedWriter) Write(data []byte) (int, error) {
+	return w.in.WriteQueued(data)
+}
+
+// counts bytes written through it and reports progress to all websocket
+// clients now and then
+type progressWriter struct {
+	w        io.Writer
+	s        *server
+	progress uploadProgress
+	last     time.Time
+	l        sync.Mutex
+}
+
+func (pw *progressWriter) Write(data []byte) (int, error) {
+	n, err := pw.w.Write(data)
+	pw.l.Lock()
+	defer pw.l.Unlock()
+	pw.progress.Bytes += int64(n)
+	if time.Since(pw.last) >= uploadProgressInterval {
+		pw.last = time.Now()
+		writePrefixedJson(&pw.s.ctrlclients, "upload;", pw.progress)
+	}
+	return n, err
+}
+
+func (pw *progressWriter) finish(err error) uploadProgress {
+	pw.l.Lock()
+	defer pw.l.Unlock()
+	pw.progress.Done = true
+	if err != nil {
+		pw.progress.Error = err.Error()
+	}
+	// not an error if nobody is listening
+	writePrefixedJson(&pw.s.ctrlclients, "upload;", pw.progress)
+	return pw.progress
+}
+
+// the file in a multipart request, or the body itself otherwise
+func uploadBody(ctx *web.Context) (body io.Reader, name string, total int64, err error) {
+	mediatype, _, _ := mime.ParseMediaType(ctx.Request.Header.Get("Content-Type"))
+	if mediatype != "multipart/form-data" {
+		return ctx.Request.Body, "", ctx.Request.ContentLength, nil
+	}
+	if form := ctx.Request.MultipartForm; form != nil {
+		// already parsed by somebody else
+		for _, files := range form.File {
+			if len(files) > 0 {
+				f, err := files[0].Open()
+				if err != nil {
+					return nil, "", 0, err
+				}
+				return f, files[0].Filename, -1, nil
+			}
+		}
+		return nil, "", 0, web.WebError{400, "no file in upload"}
+	}
+	mr, err := ctx.Request.MultipartReader()
+	if err != nil {
+		return nil, "", 0, web.WebError{400, err.Error()}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", 0, web.WebError{400, "no file in upload"}
+		}
+		if err != nil {
+			return nil, "", 0, web.WebError{400, err.Error()}
+		}
+		if part.FileName() != "" {
+			return part, part.FileName(), -1, nil
+		}
+	}
+}
+
+// stream the request body (or the file of a multipart/form-data request) into
+// the stdin of a command, as fast as the command reads it. raw bodies should
+// not be sent as application/x-www-form-urlencoded. with ?close=1 stdin is
+// closed when the upload is complete. progress is broadcast while uploading:
+//
+//     upload;{"nid":3,"name":"dump.sql","bytes":1048576,"total":-1,"done":false}
+//
+// eg POST /3/upload?close=1
+func handlePostUpload(ctx *web.Context, idstr string) error {
+	if err := errorIfNotAllowed(ctx, permControl); err != nil {
+		return err
+	}
+	s := ctx.User.(*server)
+	c, err := getCmd(s, idstr)
+	if err != nil {
+		return web.WebError{404, err.Error()}
+	}
+	if err := errorIfNotOwner(ctx, c.Id()); err != nil {
+		return err
+	}
+	if c.Status().Exited() != nil {
+		return web.WebError{409, "command has exited: " + idstr}
+	}
+	closeStdin, err := boolParam(ctx, "close")
+	if err != nil {
+		return err
+	}
+	body, name, total, err := uploadBody(ctx)
+	if err != nil {
+		return err
+	}
+	if closer, ok := body.(io.Closer); ok && body != ctx.Request.Body {
+		defer closer.Close()
+	}
+	pw := &progressWriter{
+		w: queuedWriter{c.Stdin()},
+		s: s,
+		progress: uploadProgress{
+			Id:    c.Id(),
+			Name:  name,
+			Total: total,
+		},
+		last: time.Now(),
+	}
+	_, err = io.Copy(pw, body)
+	if err == nil && closeStdin {
+		err = c.Stdin().Close()
+	}
+	progress := pw.finish(err)
+	if err != nil {
+		return web.WebError{500, fmt.Sprintf("upload to stdin of %s failed after %d bytes: %v",
+			idstr, progress.Bytes, err)}
+	}
+	ctx.ContentType("json")
+	return json.NewEncoder(ctx).Encode(progress)
+}
@@ -0,0 +1,67 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func uploadTo(t *testing.T, s *server, url, contentType string, body *bytes.Buffer) {
+	req, _ := http.NewRequest("POST", url, body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	s.web.ServeHTTP(rec, req)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"done":true`) {
+		t.Errorf("Unexpected upload response %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUpload(t *testing.T) {
+	s := newServer()
+	c, err := newCommand(s, cmdOptions{Cmd: "cat", StdoutScrollback: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("/%d/upload", c.Id())
+	uploadTo(t, s, url, "application/octet-stream", bytes.NewBufferString("raw "))
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "not the file")
+	fw, _ := mw.CreateFormFile("file", "data.txt")
+	fw.Write([]byte("multipart"))
+	mw.Close()
+	uploadTo(t, s, url+"?close=1", mw.FormDataContentType(), &body)
+	c.Wait()
+	out, _ := stringifyWriterTo(c.Stdout().Scrollback())
+	if out != "raw multipart" {
+		t.Errorf("Unexpected output of cat: %q", out)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package vt100
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A color is either the default color of the terminal, one of the 256 indexed
+// colors (0-7 normal, 8-15 bright, then the 6x6x6 cube and a grey ramp) or a
+// 24-bit RGB color. The zero value is the default color.
+type Color uint32
+
+const DefaultColor Color = 0
+
+const (
+	indexedFlag = 1 << 24
+	rgbFlag     = 2 << 24
+)
+
+func IndexedColor(i uint8) Color {
+	return Color(indexedFlag | uint32(i))
+}
+
+func RGBColor(r, g, b uint8) Color {
+	return Color(rgbFlag | uint32(r)<<16 | uint32(g)<<8 | uint32(b))
+}
+
+func (c Color) Index() (i uint8, ok bool) {
+	if c&^0xffffff != indexedFlag {
+		return 0, false
+	}
+	return uint8(c), true
+}
+
+func (c Color) RGB() (r, g, b uint8, ok bool) {
+	if c&^0xffffff != rgbFlag {
+		return 0, 0, 0, false
+	}
+	return uint8(c >> 16), uint8(c >> 8), uint8(c), true
+}
+
+// indexed colors are encoded as their number, RGB colors as "#rrggbb" and the
+// default color as null
+func (c Color) MarshalJSON() ([]byte, error) {
+	if i, ok := c.Index(); ok {
+		return json.Marshal(i)
+	}
+	if r, g, b, ok := c.RGB(); ok {
+		return json.Marshal(fmt.Sprintf("#%02x%02x%02x", r, g, b))
+	}
+	return []byte("null"), nil
+}
+
+// Graphic rendition of a character. The zero value is plain text in default
+// colors.
+type Style struct {
+	Fg        Color `json:"fg,omitempty"`
+	Bg        Color `json:"bg,omitempty"`
+	Bold      bool  `json:"bold,omitempty"`
+	Faint     bool  `json:"faint,omitempty"`
+	Italic    bool  `json:"italic,omitempty"`
+	Underline bool  `json:"underline,omitempty"`
+	Blink     bool  `json:"blink,omitempty"`
+	Inverse   bool  `json:"inverse,omitempty"`
+	Hidden    bool  `json:"hidden,omitempty"`
+	Strike    bool  `json:"strike,omitempty"`
+}
+
+// parameters of an extended color (38 and 48): 5;n or 2;r;g;b. returns the
+// number of parameters consumed.
+func extendedColor(params []int) (c Color, n int, ok bool) {
+	if len(params) >= 2 && params[0] == 5 {
+		if params[1] < 0 || params[1] > 255 {
+			return DefaultColor, 2, false
+		}
+		return IndexedColor(uint8(params[1])), 2, true
+	}
+	if len(params) >= 4 && params[0] == 2 {
+		for _, p := range params[1:4] {
+			if p < 0 || p > 255 {
+				return DefaultColor, 4, false
+			}
+		}
+		return RGBColor(uint8(params[1]), uint8(params[2]), uint8(params[3])), 4, true
+	}
+	// malformed: the rest of the sequence is meaningless
+	return DefaultColor, len(params), false
+}
+
+// Update the style with the parameters of an SGR sequence (ESC [ ... m). No
+// parameters means reset. Unknown parameters are ignored.
+func (s *Style) ApplySGR(params []int) {
+	if len(params) == 0 {
+		*s = Style{}
+		return
+	}
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			*s = Style{}
+		case p == 1:
+			s.Bold = true
+		case p == 2:
+			s.Faint = true
+		case p == 3:
+			s.Italic = true
+		case p == 4:
+			s.Underline = true
+		case p == 5 || p == 6:
+			s.Blink = true
+		case p == 7:
+			s.Inverse = true
+		case p == 8:
+			s.Hidden = true
+		case p == 9:
+			s.Strike = true
+		case p == 22:
+			s.Bold = false
+			s.Faint = false
+		case p == 23:
+			s.Italic = false
+		case p == 24:
+			s.Underline = false
+		case p == 25:
+			s.Blink = false
+		case p == 27:
+			s.Inverse = false
+		case p == 28:
+			s.Hidden = false
+		case p == 29:
+			s.Strike = false
+		case 30 <= p && p <= 37:
+			s.Fg = IndexedColor(uint8(p - 30))
+		case p == 39:
+			s.Fg = DefaultColor
+		case 40 <= p && p <= 47:
+			s.Bg = IndexedColor(uint8(p - 40))
+		case p == 49:
+			s.Bg = DefaultColor
+		case 90 <= p && p <= 97:
+			s.Fg = IndexedColor(uint8(p - 90 + 8))
+		case 100 <= p && p <= 107:
+			s.Bg = IndexedColor(uint8(p - 100 + 8))
+		case p == 38 || p == 48:
+			c, n, ok := extendedColor(params[i+1:])
+			i += n
+			if !ok {
+				break
+			}
+			if p == 38 {
+				s.Fg = c
+			} else {
+				s.Bg = c
+			}
+		}
+	}
+}
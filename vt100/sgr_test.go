@@ -0,0 +1,58 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package vt100
+
+import (
+	"testing"
+)
+
+func TestApplySGR(t *testing.T) {
+	var s Style
+	s.ApplySGR([]int{1, 4, 38, 5, 208, 48, 2, 1, 2, 3})
+	if !s.Bold || !s.Underline || s.Fg != IndexedColor(208) || s.Bg != RGBColor(1, 2, 3) {
+		t.Errorf("Unexpected style: %+v", s)
+	}
+	s.ApplySGR([]int{22, 39, 91})
+	if s.Bold || s.Fg != IndexedColor(9) || !s.Underline {
+		t.Errorf("Unexpected style after partial reset: %+v", s)
+	}
+	s.ApplySGR([]int{0})
+	if s != (Style{}) {
+		t.Errorf("Expected reset style, got %+v", s)
+	}
+	s.ApplySGR([]int{38, 2, 300, 0, 0, 1})
+	if s.Fg != DefaultColor || !s.Bold {
+		t.Errorf("Invalid color should be ignored: %+v", s)
+	}
+}
+
+func TestColor(t *testing.T) {
+	if i, ok := IndexedColor(0).Index(); !ok || i != 0 {
+		t.Errorf("Black is not indexed color 0")
+	}
+	if _, ok := DefaultColor.Index(); ok {
+		t.Errorf("Default color is not an indexed color")
+	}
+	enc, _ := RGBColor(255, 0, 16).MarshalJSON()
+	if string(enc) != `"#ff0010"` {
+		t.Errorf("Unexpected RGB encoding: %s", enc)
+	}
+}
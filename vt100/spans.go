@@ -0,0 +1,185 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package vt100
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// Text in one style
+type Span struct {
+	Text string `json:"text"`
+	Style
+}
+
+// length of the escape sequence at the start of data (which starts with ESC),
+// 0 if it is not complete yet. final is the last byte of a CSI sequence, 0
+// for other sequences.
+func escapeLen(data []byte) (n int, final byte) {
+	if len(data) < 2 {
+		return 0, 0
+	}
+	switch data[1] {
+	case '[':
+		for i := 2; i < len(data); i++ {
+			if 0x40 <= data[i] && data[i] <= 0x7e {
+				return i + 1, data[i]
+			}
+		}
+		return 0, 0
+	case ']':
+		for i := 2; i < len(data); i++ {
+			if data[i] == 0x07 {
+				return i + 1, 0
+			}
+			if data[i] == 0x1b {
+				if i+1 < len(data) {
+					return i + 2, 0
+				}
+				return 0, 0
+			}
+		}
+		return 0, 0
+	case '(', ')', '*', '+':
+		if len(data) < 3 {
+			return 0, 0
+		}
+		return 3, 0
+	}
+	return 2, 0
+}
+
+// numeric parameters of an SGR sequence: ESC [ 1 ; 31 m -> [1 31]. nil if
+// the sequence has a private marker (not SGR).
+func sgrParams(seq []byte) ([]int, bool) {
+	body := seq[2 : len(seq)-1]
+	params := []int{0}
+	for _, b := range body {
+		switch {
+		case '0' <= b && b <= '9':
+			p := &params[len(params)-1]
+			if *p < 65535 {
+				*p = *p*10 + int(b-'0')
+			}
+		case b == ';' || b == ':':
+			if len(params) < maxParams {
+				params = append(params, 0)
+			}
+		default:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// number of bytes at the end of data that are the start of an incomplete
+// UTF-8 sequence
+func incompleteRune(data []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		b := data[len(data)-i]
+		if utf8.RuneStart(b) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// Splits a stream of output in styled spans of text. Escape sequences other
+// than SGR are dropped. Escape sequences and UTF-8 characters split over
+// multiple writes are handled. Not safe for concurrent use.
+type SpanParser struct {
+	style Style
+	// incomplete escape sequence or character at the end of the last chunk
+	pending []byte
+}
+
+// Spans in this chunk of output, in order. Adjacent text in the same style is
+// merged.
+func (p *SpanParser) Parse(data []byte) []Span {
+	if len(p.pending) > 0 {
+		data = append(p.pending, data...)
+		p.pending = nil
+	}
+	var spans []Span
+	var text bytes.Buffer
+	flush := func() {
+		if text.Len() == 0 {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Style == p.style {
+			spans[n-1].Text += text.String()
+		} else {
+			spans = append(spans, Span{text.String(), p.style})
+		}
+		text.Reset()
+	}
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, 0x1b)
+		if i < 0 {
+			if n := incompleteRune(data); n > 0 {
+				p.pending = append([]byte(nil), data[len(data)-n:]...)
+				data = data[:len(data)-n]
+			}
+			text.Write(data)
+			break
+		}
+		text.Write(data[:i])
+		data = data[i:]
+		n, final := escapeLen(data)
+		if n == 0 {
+			p.pending = append([]byte(nil), data...)
+			break
+		}
+		if final == 'm' {
+			if params, ok := sgrParams(data[:n]); ok {
+				flush()
+				p.style.ApplySGR(params)
+			}
+		}
+		data = data[n:]
+	}
+	flush()
+	return spans
+}
+
+// Remove all escape sequences from this text. An incomplete sequence at the
+// end is dropped as well.
+func StripEscapes(data []byte) []byte {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, 0x1b)
+		if i < 0 {
+			buf.Write(data)
+			break
+		}
+		buf.Write(data[:i])
+		n, _ := escapeLen(data[i:])
+		if n == 0 {
+			break
+		}
+		data = data[i+n:]
+	}
+	return buf.Bytes()
+}
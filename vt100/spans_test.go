@@ -0,0 +1,58 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package vt100
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpanParser(t *testing.T) {
+	var p SpanParser
+	spans := p.Parse([]byte("plain \x1b[1;32mgreen\x1b[0"))
+	expected := []Span{
+		{"plain ", Style{}},
+		{"green", Style{Fg: IndexedColor(2), Bold: true}},
+	}
+	if !reflect.DeepEqual(spans, expected) {
+		t.Errorf("Unexpected spans: %+v", spans)
+	}
+	// continue the sequence and split a UTF-8 character
+	spans = p.Parse([]byte("m\x1b[Kdone \xe2\x9c"))
+	if !reflect.DeepEqual(spans, []Span{{"done ", Style{}}}) {
+		t.Errorf("Unexpected spans after split sequence: %+v", spans)
+	}
+	spans = p.Parse([]byte("\x93\x1b]0;title\x07\x1b[38;2;1;2;3mrgb"))
+	expected = []Span{
+		{"✓", Style{}},
+		{"rgb", Style{Fg: RGBColor(1, 2, 3)}},
+	}
+	if !reflect.DeepEqual(spans, expected) {
+		t.Errorf("Unexpected spans after split character: %+v", spans)
+	}
+}
+
+func TestStripEscapes(t *testing.T) {
+	in := "\x1b[31mred\x1b[m \x1b(Bnormal\x1b]2;x\x1b\\ \x1b[?25hend\x1b["
+	if out := string(StripEscapes([]byte(in))); out != "red normal end" {
+		t.Errorf("Unexpected stripped text: %q", out)
+	}
+}
@@ -0,0 +1,590 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Terminal emulation for output of commands that expect a terminal: cursor
+// movement, erasing, colors and the alternate screen of VT100 / xterm.
+package vt100
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const tabWidth = 8
+
+// more parameters than this in one CSI sequence are dropped
+const maxParams = 32
+
+// One character on the screen
+type Cell struct {
+	Char rune
+	Style
+}
+
+func (c Cell) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Char string `json:"c"`
+		Style
+	}{string(c.Char), c.Style})
+}
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	// ESC ( and friends: select character set (ignored)
+	stateCharset
+	stateCSI
+	// operating system command: ESC ] ... BEL (ignored)
+	stateOSC
+	stateOSCEscape
+)
+
+type cursor struct {
+	row, col int
+	style    Style
+}
+
+// A virtual terminal. Write output to it and inspect the screen. Lines that
+// scroll off the top of the screen end up in the scrollback. Safe for
+// concurrent use.
+//
+// Output of commands is usually read from a pipe rather than a tty, so nobody
+// translates \n to \r\n: a line feed also returns the cursor to the first
+// column.
+type Terminal struct {
+	width, height int
+	lines         [][]Cell
+	// lines of the main screen while the alternate screen is active
+	mainLines     [][]Cell
+	scrollback    [][]Cell
+	maxScrollback int
+	cursor
+	saved cursor
+	// the cursor is past the last column: the next character wraps
+	wrapnext     bool
+	cursorHidden bool
+	// scroll region (inclusive)
+	top, bottom int
+	state       parserState
+	params      []int
+	// private parameter marker (e.g. ? in ESC [ ? 25 l), 0 if none
+	private rune
+	// incomplete UTF-8 sequence at the end of the last write
+	partial []byte
+	l       sync.Mutex
+}
+
+// Terminal of this size that keeps at most scrollback lines
+func New(width, height, scrollback int) *Terminal {
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	t := &Terminal{
+		width:         width,
+		height:        height,
+		maxScrollback: scrollback,
+	}
+	t.reset()
+	return t
+}
+
+func (t *Terminal) reset() {
+	t.lines = t.blankScreen()
+	t.mainLines = nil
+	t.cursor = cursor{}
+	t.saved = cursor{}
+	t.wrapnext = false
+	t.cursorHidden = false
+	t.top = 0
+	t.bottom = t.height - 1
+	t.state = stateGround
+}
+
+func (t *Terminal) blankLine() []Cell {
+	line := make([]Cell, t.width)
+	for i := range line {
+		line[i] = Cell{' ', Style{Bg: t.style.Bg}}
+	}
+	return line
+}
+
+func (t *Terminal) blankScreen() [][]Cell {
+	lines := make([][]Cell, t.height)
+	for i := range lines {
+		lines[i] = t.blankLine()
+	}
+	return lines
+}
+
+func (t *Terminal) Write(data []byte) (int, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	n := len(data)
+	if len(t.partial) > 0 {
+		data = append(t.partial, data...)
+		t.partial = nil
+	}
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			t.partial = append([]byte(nil), data...)
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		t.put(r)
+		data = data[size:]
+	}
+	return n, nil
+}
+
+func (t *Terminal) put(r rune) {
+	switch t.state {
+	case stateGround:
+		switch {
+		case r == 0x1b:
+			t.state = stateEscape
+		case r < 0x20 || r == 0x7f:
+			t.control(r)
+		default:
+			t.print(r)
+		}
+	case stateEscape:
+		t.state = stateGround
+		t.escape(r)
+	case stateCharset:
+		t.state = stateGround
+	case stateCSI:
+		switch {
+		case '0' <= r && r <= '9':
+			p := &t.params[len(t.params)-1]
+			if *p < 65535 {
+				*p = *p*10 + int(r-'0')
+			}
+		case r == ';' || r == ':':
+			if len(t.params) < maxParams {
+				t.params = append(t.params, 0)
+			}
+		case r == '?' || r == '>' || r == '=' || r == '<':
+			t.private = r
+		case 0x40 <= r && r <= 0x7e:
+			t.state = stateGround
+			t.csi(r)
+		case r == 0x1b:
+			t.state = stateEscape
+		case r < 0x20:
+			t.control(r)
+		}
+		// anything else (intermediate bytes) is ignored
+	case stateOSC:
+		switch r {
+		case 0x07:
+			t.state = stateGround
+		case 0x1b:
+			t.state = stateOSCEscape
+		}
+	case stateOSCEscape:
+		// ESC \ (string terminator)
+		t.state = stateGround
+	}
+}
+
+func (t *Terminal) control(r rune) {
+	switch r {
+	case '\r':
+		t.col = 0
+		t.wrapnext = false
+	case '\n', '\v', '\f':
+		t.col = 0
+		t.wrapnext = false
+		t.index()
+	case '\b':
+		if t.col > 0 {
+			t.col--
+		}
+		t.wrapnext = false
+	case '\t':
+		t.col = (t.col/tabWidth + 1) * tabWidth
+		if t.col >= t.width {
+			t.col = t.width - 1
+		}
+	}
+}
+
+func (t *Terminal) print(r rune) {
+	if t.wrapnext {
+		t.col = 0
+		t.index()
+		t.wrapnext = false
+	}
+	t.lines[t.row][t.col] = Cell{r, t.style}
+	if t.col == t.width-1 {
+		t.wrapnext = true
+	} else {
+		t.col++
+	}
+}
+
+func (t *Terminal) escape(r rune) {
+	switch r {
+	case '[':
+		t.state = stateCSI
+		t.params = append(t.params[:0], 0)
+		t.private = 0
+	case ']':
+		t.state = stateOSC
+	case '(', ')', '*', '+':
+		t.state = stateCharset
+	case '7':
+		t.saved = t.cursor
+	case '8':
+		t.cursor = t.saved
+		t.wrapnext = false
+	case 'D':
+		t.index()
+	case 'E':
+		t.col = 0
+		t.index()
+	case 'M':
+		t.reverseIndex()
+	case 'c':
+		t.reset()
+	}
+}
+
+// move down one line, scrolling if the cursor is at the bottom of the scroll
+// region
+func (t *Terminal) index() {
+	if t.row == t.bottom {
+		t.scrollUp(t.top, 1, true)
+	} else if t.row < t.height-1 {
+		t.row++
+	}
+}
+
+func (t *Terminal) reverseIndex() {
+	if t.row == t.top {
+		t.scrollDown(t.top, 1)
+	} else if t.row > 0 {
+		t.row--
+	}
+}
+
+// scroll lines from..bottom of the scroll region up by n lines. if keep is
+// set, lines scrolling off the top of the main screen are kept in the
+// scrollback.
+func (t *Terminal) scrollUp(from, n int, keep bool) {
+	if n > t.bottom-from+1 {
+		n = t.bottom - from + 1
+	}
+	for ; n > 0; n-- {
+		line := t.lines[from]
+		if keep && from == 0 && t.mainLines == nil && t.maxScrollback > 0 {
+			t.scrollback = append(t.scrollback, line)
+			if len(t.scrollback) > t.maxScrollback {
+				t.scrollback = t.scrollback[len(t.scrollback)-t.maxScrollback:]
+			}
+		}
+		copy(t.lines[from:t.bottom], t.lines[from+1:t.bottom+1])
+		t.lines[t.bottom] = t.blankLine()
+	}
+}
+
+func (t *Terminal) scrollDown(from, n int) {
+	if n > t.bottom-from+1 {
+		n = t.bottom - from + 1
+	}
+	for ; n > 0; n-- {
+		copy(t.lines[from+1:t.bottom+1], t.lines[from:t.bottom])
+		t.lines[from] = t.blankLine()
+	}
+}
+
+// i-th parameter, def if it is missing or 0
+func (t *Terminal) param(i, def int) int {
+	if i >= len(t.params) || t.params[i] == 0 {
+		return def
+	}
+	return t.params[i]
+}
+
+func (t *Terminal) csi(final rune) {
+	if t.private == '?' && (final == 'h' || final == 'l') {
+		for _, p := range t.params {
+			t.setMode(p, final == 'h')
+		}
+		return
+	}
+	if t.private != 0 {
+		return
+	}
+	n := t.param(0, 1)
+	switch final {
+	case 'A':
+		t.row -= n
+	case 'B', 'e':
+		t.row += n
+	case 'C', 'a':
+		t.col += n
+	case 'D':
+		t.col -= n
+	case 'E':
+		t.row += n
+		t.col = 0
+	case 'F':
+		t.row -= n
+		t.col = 0
+	case 'G', '`':
+		t.col = n - 1
+	case 'd':
+		t.row = n - 1
+	case 'H', 'f':
+		t.row = t.param(0, 1) - 1
+		t.col = t.param(1, 1) - 1
+	case 'J':
+		t.eraseDisplay(t.param(0, 0))
+	case 'K':
+		t.eraseLine(t.param(0, 0))
+	case '@':
+		t.insertChars(n)
+	case 'P':
+		t.deleteChars(n)
+	case 'X':
+		t.eraseChars(t.col, t.col+n)
+	case 'L':
+		t.insertLines(n)
+	case 'M':
+		t.deleteLines(n)
+	case 'S':
+		t.scrollUp(t.top, n, true)
+	case 'T':
+		t.scrollDown(t.top, n)
+	case 'm':
+		t.style.ApplySGR(t.params)
+		return
+	case 'r':
+		top := t.param(0, 1) - 1
+		bottom := t.param(1, t.height) - 1
+		if top < bottom && bottom < t.height {
+			t.top = top
+			t.bottom = bottom
+			t.row = 0
+			t.col = 0
+		}
+	case 's':
+		t.saved = t.cursor
+	case 'u':
+		t.cursor = t.saved
+	default:
+		return
+	}
+	t.wrapnext = false
+	t.clampCursor()
+}
+
+func (t *Terminal) clampCursor() {
+	if t.row < 0 {
+		t.row = 0
+	}
+	if t.row >= t.height {
+		t.row = t.height - 1
+	}
+	if t.col < 0 {
+		t.col = 0
+	}
+	if t.col >= t.width {
+		t.col = t.width - 1
+	}
+}
+
+// DEC private modes: alternate screen and cursor visibility
+func (t *Terminal) setMode(mode int, on bool) {
+	switch mode {
+	case 25:
+		t.cursorHidden = !on
+	case 47, 1047, 1049:
+		if on && t.mainLines == nil {
+			if mode == 1049 {
+				t.saved = t.cursor
+			}
+			t.mainLines = t.lines
+			t.lines = t.blankScreen()
+		} else if !on && t.mainLines != nil {
+			t.lines = t.mainLines
+			t.mainLines = nil
+			if mode == 1049 {
+				t.cursor = t.saved
+			}
+		}
+		t.wrapnext = false
+	}
+}
+
+// blank columns [from, to) of the current line
+func (t *Terminal) eraseChars(from, to int) {
+	if to > t.width {
+		to = t.width
+	}
+	line := t.lines[t.row]
+	blank := Cell{' ', Style{Bg: t.style.Bg}}
+	for i := from; i < to; i++ {
+		line[i] = blank
+	}
+}
+
+// 0: cursor to end of line, 1: start of line to cursor, 2: whole line
+func (t *Terminal) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		t.eraseChars(t.col, t.width)
+	case 1:
+		t.eraseChars(0, t.col+1)
+	case 2:
+		t.eraseChars(0, t.width)
+	}
+}
+
+// 0: cursor to end of screen, 1: start of screen to cursor, 2: whole screen,
+// 3: scrollback
+func (t *Terminal) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		t.eraseLine(0)
+		for i := t.row + 1; i < t.height; i++ {
+			t.lines[i] = t.blankLine()
+		}
+	case 1:
+		t.eraseLine(1)
+		for i := 0; i < t.row; i++ {
+			t.lines[i] = t.blankLine()
+		}
+	case 2:
+		t.lines = t.blankScreen()
+	case 3:
+		t.scrollback = nil
+	}
+}
+
+func (t *Terminal) insertChars(n int) {
+	line := t.lines[t.row]
+	if n > t.width-t.col {
+		n = t.width - t.col
+	}
+	copy(line[t.col+n:], line[t.col:])
+	t.eraseChars(t.col, t.col+n)
+}
+
+func (t *Terminal) deleteChars(n int) {
+	line := t.lines[t.row]
+	if n > t.width-t.col {
+		n = t.width - t.col
+	}
+	copy(line[t.col:], line[t.col+n:])
+	t.eraseChars(t.width-n, t.width)
+}
+
+// insert blank lines at the cursor, within the scroll region
+func (t *Terminal) insertLines(n int) {
+	if t.row < t.top || t.row > t.bottom {
+		return
+	}
+	t.scrollDown(t.row, n)
+	t.col = 0
+}
+
+func (t *Terminal) deleteLines(n int) {
+	if t.row < t.top || t.row > t.bottom {
+		return
+	}
+	// deleted lines never scrolled off the screen: they are gone
+	t.scrollUp(t.row, n, false)
+	t.col = 0
+}
+
+// Snapshot of the screen
+type Screen struct {
+	Width         int      `json:"width"`
+	Height        int      `json:"height"`
+	CursorRow     int      `json:"cursorRow"`
+	CursorCol     int      `json:"cursorCol"`
+	CursorVisible bool     `json:"cursorVisible"`
+	AltScreen     bool     `json:"altScreen"`
+	Cells         [][]Cell `json:"cells"`
+}
+
+func copyLines(lines [][]Cell) [][]Cell {
+	cp := make([][]Cell, len(lines))
+	for i, line := range lines {
+		cp[i] = append([]Cell(nil), line...)
+	}
+	return cp
+}
+
+func (t *Terminal) Screen() Screen {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return Screen{
+		Width:         t.width,
+		Height:        t.height,
+		CursorRow:     t.row,
+		CursorCol:     t.col,
+		CursorVisible: !t.cursorHidden,
+		AltScreen:     t.mainLines != nil,
+		Cells:         copyLines(t.lines),
+	}
+}
+
+// Lines that scrolled off the top of the main screen, oldest first
+func (t *Terminal) Scrollback() [][]Cell {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return copyLines(t.scrollback)
+}
+
+// Characters of a line without trailing whitespace
+func LineText(line []Cell) string {
+	runes := make([]rune, len(line))
+	for i, c := range line {
+		runes[i] = c.Char
+	}
+	return strings.TrimRight(string(runes), " ")
+}
+
+// Scrollback and screen as plain text. Trailing empty lines are left out.
+func (t *Terminal) Text() string {
+	t.l.Lock()
+	defer t.l.Unlock()
+	var lines []string
+	for _, line := range t.scrollback {
+		lines = append(lines, LineText(line))
+	}
+	for _, line := range t.lines {
+		lines = append(lines, LineText(line))
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,106 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+package vt100
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTerminalText(t *testing.T) {
+	term := New(20, 3, 100)
+	term.Write([]byte("downloading 10%\r"))
+	term.Write([]byte("downloading 99%\rdone\x1b[K\n"))
+	term.Write([]byte("two\nthree\nfour"))
+	expected := "done\ntwo\nthree\nfour"
+	if text := term.Text(); text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+	if sb := term.Scrollback(); len(sb) != 1 || LineText(sb[0]) != "done" {
+		t.Errorf("Unexpected scrollback: %v", sb)
+	}
+}
+
+func TestTerminalCursor(t *testing.T) {
+	term := New(10, 4, 0)
+	term.Write([]byte("\x1b[2J\x1b[3;4Hx\x1b[Ay\x1b[1;1Habc\x1b[1G\x1b[P\x1b[2@"))
+	screen := term.Screen()
+	lines := []string{"  bc", "    y", "   x", ""}
+	for i, line := range lines {
+		if got := LineText(screen.Cells[i]); got != line {
+			t.Errorf("Line %d: expected %q, got %q", i, line, got)
+		}
+	}
+	if screen.CursorRow != 0 || screen.CursorCol != 0 {
+		t.Errorf("Unexpected cursor position: %d,%d", screen.CursorRow, screen.CursorCol)
+	}
+}
+
+func TestTerminalAltScreen(t *testing.T) {
+	term := New(10, 2, 10)
+	term.Write([]byte("shell\n\x1b[?1049h\x1b[Hvim\x1b[?25l"))
+	screen := term.Screen()
+	if !screen.AltScreen || screen.CursorVisible || LineText(screen.Cells[0]) != "vim" {
+		t.Errorf("Unexpected alternate screen: %+v", screen)
+	}
+	term.Write([]byte("\x1b[?1049l\x1b[?25h"))
+	screen = term.Screen()
+	if screen.AltScreen || LineText(screen.Cells[0]) != "shell" || screen.CursorRow != 1 {
+		t.Errorf("Main screen not restored: %+v", screen)
+	}
+}
+
+func TestTerminalStyle(t *testing.T) {
+	term := New(10, 1, 0)
+	// split in the middle of an escape sequence and a UTF-8 sequence
+	term.Write([]byte("\x1b[1;3"))
+	term.Write([]byte("1m\xc3"))
+	term.Write([]byte("\xa9\x1b[0mx"))
+	cells := term.Screen().Cells[0]
+	if cells[0].Char != 'é' || !cells[0].Bold || cells[0].Fg != IndexedColor(1) {
+		t.Errorf("Unexpected styled cell: %+v", cells[0])
+	}
+	if cells[1].Char != 'x' || cells[1].Style != (Style{}) {
+		t.Errorf("Style not reset: %+v", cells[1])
+	}
+	enc, err := json.Marshal(cells[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(enc) != `[{"c":"é","fg":1,"bold":true},{"c":"x"}]` {
+		t.Errorf("Unexpected JSON encoding: %s", enc)
+	}
+}
+
+func TestTerminalScrollRegion(t *testing.T) {
+	term := New(5, 4, 10)
+	term.Write([]byte("head\x1b[2;3r\x1b[2Ha\nb\nc\x1b[4Hfoot"))
+	lines := []string{"head", "b", "c", "foot"}
+	screen := term.Screen()
+	for i, line := range lines {
+		if got := LineText(screen.Cells[i]); got != line {
+			t.Errorf("Line %d: expected %q, got %q", i, line, got)
+		}
+	}
+	if len(term.Scrollback()) != 0 {
+		t.Errorf("Lines scrolled out of a region are not finalized")
+	}
+}
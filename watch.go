@@ -0,0 +1,276 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+
+// Watch mode: re-run a command periodically and tell clients what changed in
+// its output, like watch -d.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// number of snapshots kept when not specified
+const defaultWatchKeep = 10
+
+type watchSnapshot struct {
+	Run    int        `json:"run"`
+	Time   time.Time  `json:"time"`
+	Output string     `json:"output"`
+	Status statusJson `json:"status"`
+}
+
+type watch struct {
+	cmd      liblush.Cmd
+	interval time.Duration
+	// max number of snapshots
+	keep      int
+	runs      int
+	snapshots []watchSnapshot
+	stop      chan bool
+	l         sync.Mutex
+	// held while a run is set up, so unwatch can wait for it
+	runl sync.Mutex
+}
+
+type watchInfo struct {
+	Interval float64 `json:"interval"`
+	Keep     int     `json:"keep"`
+	Runs     int     `json:"runs"`
+}
+
+func (w *watch) info() watchInfo {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return watchInfo{
+		Interval: w.interval.Seconds(),
+		Keep:     w.keep,
+		Runs:     w.runs,
+	}
+}
+
+func splitLines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
+
+// store the output of the run that just finished and broadcast its diff
+// against the previous one
+func (w *watch) snapshot(s *server) error {
+	output, err := stringifyWriterTo(w.cmd.Stdout().Scrollback())
+	if err != nil {
+		return err
+	}
+	w.l.Lock()
+	var prev string
+	if len(w.snapshots) > 0 {
+		prev = w.snapshots[len(w.snapshots)-1].Output
+	}
+	w.runs++
+	snap := watchSnapshot{
+		Run:    w.runs,
+		Time:   time.Now(),
+		Output: output,
+		Status: cmdstatus2json(w.cmd.Status()),
+	}
+	w.snapshots = append(w.snapshots, snap)
+	if len(w.snapshots) > w.keep {
+		w.snapshots = w.snapshots[len(w.snapshots)-w.keep:]
+	}
+	w.l.Unlock()
+	return writePrefixedJson(&s.ctrlclients, "watchdiff;", map[string]interface{}{
+		"nid":     w.cmd.Id(),
+		"run":     snap.Run,
+		"time":    snap.Time,
+		"status":  snap.Status,
+		"changes": diffLines(splitLines(prev), splitLines(output)),
+	})
+}
+
+func (w *watch) loop(s *server) {
+	defer s.unwatch(w.cmd.Id(), w)
+	for {
+		// whatever is running now (maybe started by a client) goes first
+		if w.cmd.Status().Started() != nil {
+			w.cmd.Wait()
+		}
+		ok, err := w.rerun(s)
+		if err != nil {
+			s.web.Logger.Printf("watch %d: %v", w.cmd.Id(), err)
+			return
+		}
+		if !ok {
+			return
+		}
+		// returns right away if it failed to start
+		w.cmd.Wait()
+		err = w.snapshot(s)
+		if err != nil {
+			s.web.Logger.Printf("watch %d: %v", w.cmd.Id(), err)
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// reset and start the command, false if the watch was stopped or the command
+// released. errors starting the command end up in its status.
+func (w *watch) rerun(s *server) (bool, error) {
+	w.runl.Lock()
+	defer w.runl.Unlock()
+	select {
+	case <-w.stop:
+		return false, nil
+	default:
+	}
+	if s.session.GetCommand(w.cmd.Id()) == nil {
+		// released
+		return false, nil
+	}
+	err := w.cmd.Reset()
+	if err != nil {
+		return false, err
+	}
+	// only the output of the latest run is kept
+	w.cmd.Stdout().Scrollback().Clear()
+	w.cmd.Stderr().Scrollback().Clear()
+	w.cmd.Start()
+	return true, nil
+}
+
+func (s *server) getWatch(id liblush.CmdId) *watch {
+	s.watcheslock.Lock()
+	defer s.watcheslock.Unlock()
+	return s.watches[id]
+}
+
+// stop watching a command. if w is not nil only stop if that is still the
+// active watch.
+func (s *server) unwatch(id liblush.CmdId, w *watch) bool {
+	s.watcheslock.Lock()
+	cur := s.watches[id]
+	if cur == nil || (w != nil && cur != w) {
+		s.watcheslock.Unlock()
+		return false
+	}
+	close(cur.stop)
+	delete(s.watches, id)
+	s.watcheslock.Unlock()
+	// a run that is being set up right now still starts, none after that
+	cur.runl.Lock()
+	cur.runl.Unlock()
+	return true
+}
+
+// start re-running a command every interval seconds (after the previous run
+// exits). every run is followed by a watchdiff event:
+//
+//     watchdiff;{"nid":3,"run":2,"time":"...","status":{...},"changes":[{"op":"add","line":4,"text":"..."}]}
+//
+// eg watch;{"nid":3,"interval":2,"keep":10}
+func wseventWatch(s *server, optionsJSON string) error {
+	var options struct {
+		Id       liblush.CmdId `json:"nid"`
+		Interval float64
+		Keep     int
+	}
+	err := json.Unmarshal([]byte(optionsJSON), &options)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	c := s.session.GetCommand(options.Id)
+	if c == nil {
+		return fmt.Errorf("no such command: %d", options.Id)
+	}
+	if options.Interval < 0.1 {
+		return lushError{errors.New("watch interval must be at least 0.1 seconds")}
+	}
+	if options.Keep <= 0 {
+		options.Keep = defaultWatchKeep
+	}
+	w := &watch{
+		cmd:      c,
+		interval: time.Duration(options.Interval * float64(time.Second)),
+		keep:     options.Keep,
+		stop:     make(chan bool),
+	}
+	s.watcheslock.Lock()
+	if s.watches[c.Id()] != nil {
+		s.watcheslock.Unlock()
+		return lushError{fmt.Errorf("command %d is already watched", c.Id())}
+	}
+	s.watches[c.Id()] = w
+	s.watcheslock.Unlock()
+	go w.loop(s)
+	return notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(c.Id()),
+		Propname: "watch",
+		Value:    w.info(),
+	})
+}
+
+// stop re-running a command. a run in progress is not interrupted.
+// eg unwatch;3
+func wseventUnwatch(s *server, idstr string) error {
+	id, _ := liblush.ParseCmdId(idstr)
+	if !s.unwatch(id, nil) {
+		return lushError{errors.New("command is not watched: " + idstr)}
+	}
+	return notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		Objname:  cmdId2Json(id),
+		Propname: "watch",
+		Value:    nil,
+	})
+}
+
+// last snapshots of a watched command, oldest first
+// eg watchhistory;3
+func wseventWatchhistory(s *server, idstr string) error {
+	id, _ := liblush.ParseCmdId(idstr)
+	w := s.getWatch(id)
+	if w == nil {
+		return lushError{errors.New("command is not watched: " + idstr)}
+	}
+	w.l.Lock()
+	snapshots := append([]watchSnapshot{}, w.snapshots...)
+	w.l.Unlock()
+	return writePrefixedJson(&s.ctrlclients, "watchhistory;", map[string]interface{}{
+		"nid":       id,
+		"snapshots": snapshots,
+	})
+}
+
+func init() {
+	serverinitializers = append(serverinitializers, func(s *server) {
+		s.watches = map[liblush.CmdId]*watch{}
+	})
+}
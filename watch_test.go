@@ -0,0 +1,134 @@
+// Copyright © 2014 Hraban Luyat <hraban@0brg.net>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to
+// deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+// sell copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+// FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+// IN THE SOFTWARE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hraban/lush/liblush"
+)
+
+// collects the watchdiff events sent to websocket clients
+type watchdiffRecorder chan string
+
+func (r watchdiffRecorder) Write(data []byte) (int, error) {
+	if msg := string(data); strings.HasPrefix(msg, "watchdiff;") {
+		r <- strings.TrimPrefix(msg, "watchdiff;")
+	}
+	return len(data), nil
+}
+
+type watchdiffJson struct {
+	Id      liblush.CmdId `json:"nid"`
+	Run     int           `json:"run"`
+	Changes []lineChange  `json:"changes"`
+}
+
+func nextWatchdiff(t *testing.T, r watchdiffRecorder) watchdiffJson {
+	var diff watchdiffJson
+	select {
+	case msg := <-r:
+		if err := json.Unmarshal([]byte(msg), &diff); err != nil {
+			t.Fatalf("Malformed watchdiff %q: %v", msg, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No watchdiff event")
+	}
+	return diff
+}
+
+// a watched command whose output differs on every run
+func newWatchedCommand(t *testing.T) (*server, liblush.Cmd, watchdiffRecorder) {
+	s := newServer()
+	r := make(watchdiffRecorder, 100)
+	s.ctrlclients.AddWriter(r)
+	c, err := newCommand(s, cmdOptions{
+		Cmd:              "sh",
+		Args:             []string{"-c", "echo same; echo $$"},
+		StdoutScrollback: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wseventWatch(s, fmt.Sprintf(`{"nid":%d,"interval":0.1}`, c.Id()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c, r
+}
+
+func TestWatchDiff(t *testing.T) {
+	s, c, r := newWatchedCommand(t)
+	first := nextWatchdiff(t, r)
+	if first.Id != c.Id() || first.Run != 1 || len(first.Changes) != 2 {
+		t.Errorf("Unexpected first watchdiff: %+v", first)
+	}
+	second := nextWatchdiff(t, r)
+	if second.Run != 2 {
+		t.Errorf("Unexpected run in second watchdiff: %+v", second)
+	}
+	// only the line with the pid changed
+	for _, change := range second.Changes {
+		if change.Text == "same" {
+			t.Errorf("Unchanged line in watchdiff: %+v", second)
+		}
+	}
+	if len(second.Changes) == 0 {
+		t.Errorf("No changes in second watchdiff")
+	}
+	if err := wseventUnwatch(s, fmt.Sprint(c.Id())); err != nil {
+		t.Fatal(err)
+	}
+	// a run in progress finishes, no new one starts
+	c.Wait()
+	started := c.Status().Started()
+	time.Sleep(300 * time.Millisecond)
+	if c.Status().Started() != started {
+		t.Errorf("Command re-run after unwatch")
+	}
+}
+
+func TestWatchRelease(t *testing.T) {
+	s, c, r := newWatchedCommand(t)
+	nextWatchdiff(t, r)
+	// the command can only be released between runs
+	var err error
+	for i := 0; i < 50; i++ {
+		c.Wait()
+		if err = s.releaseCommand(c.Id()); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to release watched command: %v", err)
+	}
+	if s.getWatch(c.Id()) != nil {
+		t.Errorf("Released command is still watched")
+	}
+	started := c.Status().Started()
+	time.Sleep(300 * time.Millisecond)
+	if c.Status().Started() != started {
+		t.Errorf("Released command was run again")
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,8 +37,6 @@ import (
 	"github.com/hraban/web"
 )
 
-var masterAddr string
-
 var addrRegexp = regexp.MustCompile(":\\d+$")
 
 // "1.2.3.4:60102" -> "1.2.3.4"
@@ -47,32 +46,21 @@ func fullAddrToBare(addrPlusIp string) (onlyAddr string) {
 	return addrRegexp.ReplaceAllString(addrPlusIp, "")
 }
 
-func remoteAddr(ctx *web.Context) string {
-	return fullAddrToBare(ctx.Request.RemoteAddr)
-}
-
-// claim that I am master. returns false if someone else already did
-func claimMaster(ctx *web.Context) bool {
-	if ctx.User.(*server).everybodyMaster {
-		return true
-	}
-	remote := remoteAddr(ctx)
-	if remote != masterAddr {
-		if masterAddr == "" {
-			masterAddr = remote
-		} else {
-			return false
-		}
+// a boolean query parameter: 1, true, 0, false &c. false if absent.
+func boolParam(ctx *web.Context, name string) (bool, error) {
+	str := ctx.Params[name]
+	if str == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, web.WebError{400, "invalid " + name + ": " + str}
 	}
-	return true
+	return b, nil
 }
 
-// would prefer this as a wrapper but yeah MACROS PLZ
-func errorIfNotMaster(ctx *web.Context) error {
-	if !claimMaster(ctx) {
-		return web.WebError{403, "go away you not master"}
-	}
-	return nil
+func remoteAddr(ctx *web.Context) string {
+	return fullAddrToBare(ctx.Request.RemoteAddr)
 }
 
 func redirect(ctx *web.Context, loc *url.URL) {
@@ -99,11 +87,17 @@ func getCmdWeb(s liblush.Session, idstr string) (liblush.Cmd, error) {
 }
 
 func handleGetRoot(ctx *web.Context) error {
+	if redirectIfUnauthenticated(ctx) {
+		return nil
+	}
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
 	s := ctx.User.(*server)
 	ch := make(chan metacmd)
 	go func() {
 		for _, id := range s.session.GetCommandIds() {
-			ch <- metacmd{s.session.GetCommand(id)}
+			ch <- metacmd{s.session.GetCommand(id), s}
 		}
 		close(ch)
 	}()
@@ -112,6 +106,12 @@ func handleGetRoot(ctx *web.Context) error {
 }
 
 func handleGetCmd(ctx *web.Context, idstr string) error {
+	if redirectIfUnauthenticated(ctx) {
+		return nil
+	}
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
 	type cmdctx struct {
 		Cmd          liblush.Cmd
 		Stdout       string
@@ -151,6 +151,9 @@ func handleGetCmd(ctx *web.Context, idstr string) error {
 }
 
 func handleGetCmdInfo(ctx *web.Context, idstr string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
 	id, _ := liblush.ParseCmdId(idstr)
 	s := ctx.User.(*server)
 	c := s.session.GetCommand(id)
@@ -160,11 +163,12 @@ func handleGetCmdInfo(ctx *web.Context, idstr string) error {
 	ctx.Header().Set("content-type", "application/json")
 	enc := json.NewEncoder(ctx)
 	var info = struct {
-		Started, Exited *time.Time
-		Error           string `json:",omitempty"`
+		Started, Exited, Ready *time.Time
+		Error                  string `json:",omitempty"`
 	}{
 		Started: c.Status().Started(),
 		Exited:  c.Status().Exited(),
+		Ready:   c.Status().Ready(),
 	}
 	if cerr := c.Status().Err(); cerr != nil {
 		info.Error = cerr.Error()
@@ -173,10 +177,13 @@ func handleGetCmdInfo(ctx *web.Context, idstr string) error {
 }
 
 func handlePostSend(ctx *web.Context, idstr string) error {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permControl); err != nil {
 		return err
 	}
 	id, _ := liblush.ParseCmdId(idstr)
+	if err := errorIfNotOwner(ctx, id); err != nil {
+		return err
+	}
 	s := ctx.User.(*server)
 	c := s.session.GetCommand(id)
 	if c == nil {
@@ -185,7 +192,7 @@ func handlePostSend(ctx *web.Context, idstr string) error {
 	if ctx.Params["stream"] != "stdin" {
 		return web.WebError{400, "must send to stdin"}
 	}
-	_, err := c.Stdin().Write([]byte(ctx.Params["data"]))
+	_, err := c.Stdin().WriteQueued([]byte(ctx.Params["data"]))
 	if err != nil {
 		return err
 	}
@@ -194,10 +201,13 @@ func handlePostSend(ctx *web.Context, idstr string) error {
 }
 
 func handlePostClose(ctx *web.Context, idstr string) error {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permControl); err != nil {
 		return err
 	}
 	id, _ := liblush.ParseCmdId(idstr)
+	if err := errorIfNotOwner(ctx, id); err != nil {
+		return err
+	}
 	s := ctx.User.(*server)
 	c := s.session.GetCommand(id)
 	if c == nil {
@@ -215,7 +225,7 @@ func handlePostClose(ctx *web.Context, idstr string) error {
 }
 
 func handleGetNewNames(ctx *web.Context) error {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permControl); err != nil {
 		return err
 	}
 	var bins []string
@@ -239,6 +249,9 @@ func handleGetNewNames(ctx *web.Context) error {
 }
 
 func handleWsStream(ctx *web.Context, idstr, streamname string) error {
+	if err := errorIfNotAllowed(ctx, permView); err != nil {
+		return err
+	}
 	id, _ := liblush.ParseCmdId(idstr)
 	s := ctx.User.(*server)
 	c := s.session.GetCommand(id)
@@ -267,7 +280,7 @@ func handlePostChdir(ctx *web.Context) error {
 
 // List of files nice for tab completion
 func handleGetFiles(ctx *web.Context) error {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permControl); err != nil {
 		return err
 	}
 	ctx.ContentType("json")
@@ -281,15 +294,33 @@ func handleGetFiles(ctx *web.Context) error {
 	return json.NewEncoder(ctx).Encode(paths)
 }
 
-// websocket control connection (all are considered equal)
+// websocket control connection. what a client may do depends on its role.
 func handleWsCtrl(ctx *web.Context) error {
 	s := ctx.User.(*server)
 	ws := newWsClient(ctx.WebsockConn)
+	p, ok := s.identify(ctx)
+	if !ok && crossSiteRequest(ctx.Request) {
+		writePrefixedJson(ws, "error;", "cross-site websocket connection refused")
+		return nil
+	}
+	if !ok {
+		writePrefixedJson(ws, "error;", "authentication required")
+		return nil
+	}
+	if !p.can(permView) {
+		writePrefixedJson(ws, "error;", "permission denied: view permission required")
+		return nil
+	}
+	ws.principal = p
 	// tell the client about its Id
 	_, err := fmt.Fprint(ws, "clientid;", ws.Id)
 	if err != nil {
 		return fmt.Errorf("Websocket write error: %v", err)
 	}
+	// this client missed any trouble during startup
+	for _, msg := range s.rcerrors {
+		writePrefixedJson(ws, "error;", msg)
+	}
 	// Subscribe this ws client to all future control events. Will be removed
 	// automatically when the first Write fails (FlexibleMultiWriter).
 	// Therefore, no need to worry about removing: client disconnects -> next
@@ -298,7 +329,6 @@ func handleWsCtrl(ctx *web.Context) error {
 	// notify all other clients that a new client has connected
 	wseventAllclients(s, "") // pretend somebody generated this event
 	// TODO: keep clients updated about disconnects, too
-	ws.isMaster = claimMaster(ctx)
 	for {
 		buf := make([]byte, 5000)
 		n, err := ws.Read(buf)
@@ -325,7 +355,7 @@ func handleWsCtrl(ctx *web.Context) error {
 }
 
 func handleGetEnviron(ctx *web.Context) (map[string]string, error) {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permAdmin); err != nil {
 		return nil, err
 	}
 	ctx.ContentType("json")
@@ -334,7 +364,7 @@ func handleGetEnviron(ctx *web.Context) (map[string]string, error) {
 }
 
 func handlePostSetenv(ctx *web.Context) error {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permAdmin); err != nil {
 		return err
 	}
 	s := ctx.User.(*server)
@@ -343,7 +373,7 @@ func handlePostSetenv(ctx *web.Context) error {
 }
 
 func handlePostUnsetenv(ctx *web.Context) error {
-	if err := errorIfNotMaster(ctx); err != nil {
+	if err := errorIfNotAllowed(ctx, permAdmin); err != nil {
 		return err
 	}
 	s := ctx.User.(*server)
@@ -354,18 +384,35 @@ func handlePostUnsetenv(ctx *web.Context) error {
 func init() {
 	serverinitializers = append(serverinitializers, func(s *server) {
 		s.userdata = map[string]string{}
-		// public handlers
+		s.revoked = map[string]time.Time{}
+		s.web.Get(`/login`, handleGetLogin)
+		s.web.Post(`/login`, handlePostLogin)
+		s.web.Post(`/logout`, handlePostLogout)
+		// all others require authentication (see auth.go)
 		s.web.Get(`/`, handleGetRoot)
 		s.web.Get(`/(\d+)/`, handleGetCmd)
 		s.web.Get(`/(\d+)/info.json`, handleGetCmdInfo)
+		s.web.Get(`/(\d+)/records/(\w+).json`, handleGetRecords)
+		s.web.Get(`/(\d+)/(\w+)\.txt`, handleGetOutput)
+		s.web.Get(`/(\d+)/(\w+)\.bin`, handleGetRawOutput)
+		s.web.Get(`/(\d+)/(\w+)\.hex`, handleGetHexdump)
+		s.web.Get(`/(\d+)/chunks/(\w+).json`, handleGetChunks)
+		s.web.Get(`/(\d+)/asciicast\.cast`, handleGetAsciicast)
+		s.web.Get(`/(\d+)/screen.json`, handleGetScreen)
+		s.web.Get(`/search.json`, handleGetSearch)
+		s.web.Get(`/archive.json`, handleGetArchive)
+		s.web.Get(`/archive/([\w-]+)\.json`, handleGetArchivedCmd)
+		s.web.Get(`/archive/([\w-]+)/(\w+)\.txt`, handleGetArchivedOutput)
+		s.web.Get(`/archive/([\w-]+)/(\w+)\.bin`, handleGetArchivedRawOutput)
 		s.web.Websocket(`/ctrl`, handleWsCtrl)
 		s.web.Websocket(`/(\d+)/stream/(\w+).bin`, handleWsStream)
-		// only master
 		s.web.Post(`/(\d+)/send`, handlePostSend)
 		s.web.Post(`/(\d+)/close`, handlePostClose)
+		s.web.Post(`/(\d+)/upload`, handlePostUpload)
 		s.web.Get(`/new/names.json`, handleGetNewNames)
 		s.web.Get(`/files.json`, handleGetFiles)
 		s.web.Get(`/environ.json`, handleGetEnviron)
+		s.web.Get(`/tasks.json`, handleGetTasks)
 		s.web.Post(`/setenv`, handlePostSetenv)
 		s.web.Post(`/unsetenv`, handlePostUnsetenv)
 	})
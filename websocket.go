@@ -43,8 +43,8 @@ import (
 
 // websocket client (value-struct). implements io.Writer
 type wsClient struct {
-	Id       uint32
-	isMaster bool
+	Id        uint32
+	principal principal
 	*websocket.Conn
 }
 
@@ -54,7 +54,7 @@ var totalWsClients uint32
 func newWsClient(conn *websocket.Conn) wsClient {
 	// Assign a (session-local) unique ID to this connection
 	id := atomic.AddUint32(&totalWsClients, 1)
-	return wsClient{id, false, conn}
+	return wsClient{id, principal{}, conn}
 }
 
 func getCmd(s *server, idstr string) (liblush.Cmd, error) {
@@ -67,7 +67,12 @@ func getCmd(s *server, idstr string) (liblush.Cmd, error) {
 	return c, err
 }
 
-// subscribe all websocket clients to stream data
+// subscribe all websocket clients to stream data, presented according to the
+// ansi property of the command: raw, strip or spans. in spans mode the data
+// is sent as styled spans instead:
+//
+//     spans;3;stdout;[{"text":"ok","fg":2,"bold":true},...]
+//
 // eg subscribe;3;stdout
 func wseventSubscribe(s *server, options string) error {
 	args := strings.Split(options, ";")
@@ -90,13 +95,31 @@ func wseventSubscribe(s *server, options string) error {
 		return errors.New("unknown stream: " + streamname)
 	}
 	// proxy stream data
-	w := newPrefixedWriter(&s.ctrlclients, []byte("stream;"+idstr+";"+streamname+";"))
-	// do not close websocket stream when command exits
-	wc := newNopWriteCloser(w)
-	stream.Peeker().AddWriter(wc)
+	var w io.Writer
+	switch mode := s.ansiMode(c.Id()); mode {
+	case ansiRaw:
+		w = newPrefixedWriter(&s.ctrlclients, []byte("stream;"+idstr+";"+streamname+";"))
+	case ansiStrip:
+		w = &stripWriter{w: newPrefixedWriter(&s.ctrlclients, []byte("stream;"+idstr+";"+streamname+";"))}
+	case ansiSpans:
+		w = &spansWriter{w: &s.ctrlclients, prefix: "spans;" + idstr + ";" + streamname + ";"}
+	default:
+		return errors.New("unknown ansi mode: " + mode)
+	}
+	// clients get whole UTF-8 characters only. closing this when the
+	// command exits does not close the websocket stream.
+	dw := newDecodingWriter(func() string {
+		return s.streamEncoding(c.Id(), streamname)
+	}, w)
+	// binary output is not sent unless forced
+	stream.Peeker().AddWriter(&binaryGate{bd: s.getBinaryDetector(c.Id(), streamname), w: dw})
 	return nil
 }
 
+// scrollback size of commands created by the server itself, rather than
+// explicitly by a client
+const defaultScrollback = 10000
+
 type cmdOptions struct {
 	// this one is actually only for updatecmd
 	Id               liblush.CmdId `json:"nid"`
@@ -104,52 +127,196 @@ type cmdOptions struct {
 	Args             []string
 	StdoutScrollback int
 	StderrScrollback int
+	// number of JSON records kept per stream, 0 to not parse the stream
+	StdoutRecords int
+	StderrRecords int
+	// remember when output was written (see asciicast export)
+	StdoutTimestamps bool
+	StderrTimestamps bool
 	UserData         interface{}
 	Stdoutto         liblush.CmdId
 	Stderrto         liblush.CmdId
+	// restart the command when it exits
+	Supervise *supervisePolicy
+	// condition for the command to be considered ready
+	Ready *readyOptions
+	// only start once these commands are ready
+	After *afterOptions
+	// emulate a terminal to keep track of the screen
+	Terminal *terminalOptions
+	// raw, spans or strip: how escape codes are presented to clients
+	Ansi string
+	// character set of the output: auto, utf-8 (default), latin-1,
+	// utf-16le or utf-16be. clients get UTF-8.
+	StdoutEncoding string
+	StderrEncoding string
+	// send output to clients as text even if it looks binary
+	ForceText bool
+	// bytes of stdin held until the command is started, 0 for the default
+	StdinQueue int
+	// name of the client that created the command (not settable by clients)
+	owner string
 }
 
 func cmdId2Json(id liblush.CmdId) string {
 	return fmt.Sprintf("cmd%d", id)
 }
 
-// eg new;{"cmd":"echo","args":["arg1","arg2"],...}
-func wseventNew(s *server, optionsJSON string) error {
-	var options cmdOptions
-	err := json.Unmarshal([]byte(optionsJSON), &options)
-	if err != nil {
-		return fmt.Errorf("malformed JSON: %v", err)
+// create a new command from these options and announce it to all connected
+// websocket clients
+func newCommand(s *server, options cmdOptions) (liblush.Cmd, error) {
+	argv := s.expandAlias(append([]string{options.Cmd}, options.Args...))
+	c := s.session.NewCommand(argv[0], argv[1:]...)
+	if err := initCommand(s, c, options); err != nil {
+		return nil, err
 	}
-	c := s.session.NewCommand(options.Cmd, options.Args...)
+	return c, nil
+}
+
+// set up a command that was just created in the session according to these
+// options and announce it. the command is released if an option is invalid.
+func initCommand(s *server, c liblush.Cmd, options cmdOptions) error {
 	c.Stdout().SetListener(liblush.Devnull)
 	c.Stderr().SetListener(liblush.Devnull)
+	s.detectBinary(c)
 	c.Stdout().Scrollback().Resize(options.StdoutScrollback)
 	c.Stderr().Scrollback().Resize(options.StderrScrollback)
 	c.SetName(options.Name)
 	c.SetUserData(options.UserData)
+	if options.owner != "" {
+		s.setOwner(c.Id(), options.owner)
+	}
+	if options.Supervise != nil {
+		err := s.supervise(c, *options.Supervise)
+		if err != nil {
+			s.releaseCommand(c.Id())
+			return lushError{err}
+		}
+	}
+	c.Stdout().SetTimestamps(options.StdoutTimestamps)
+	c.Stderr().SetTimestamps(options.StderrTimestamps)
+	for stream, limit := range map[string]int{
+		"stdout": options.StdoutRecords,
+		"stderr": options.StderrRecords,
+	} {
+		err := s.setRecordBuffer(c, stream, limit)
+		if err != nil {
+			s.releaseCommand(c.Id())
+			return lushError{err}
+		}
+	}
+	if err := s.setAnsiMode(c.Id(), options.Ansi); err != nil {
+		s.releaseCommand(c.Id())
+		return lushError{err}
+	}
+	s.setForceText(c.Id(), options.ForceText)
+	if options.StdinQueue > 0 {
+		c.Stdin().SetQueueLimit(options.StdinQueue)
+	}
+	if err := s.setStreamEncoding(c.Id(), "stdout", options.StdoutEncoding); err != nil {
+		s.releaseCommand(c.Id())
+		return lushError{err}
+	}
+	if err := s.setStreamEncoding(c.Id(), "stderr", options.StderrEncoding); err != nil {
+		s.releaseCommand(c.Id())
+		return lushError{err}
+	}
+	if options.Terminal != nil {
+		err := s.setTerminal(c, options.Terminal)
+		if err != nil {
+			s.releaseCommand(c.Id())
+			return lushError{err}
+		}
+	}
+	if options.Ready != nil {
+		err := s.setReadyProbe(c, options.Ready)
+		if err != nil {
+			s.releaseCommand(c.Id())
+			return lushError{err}
+		}
+	}
+	if options.After != nil {
+		err := s.setAfter(c, options.After)
+		if err != nil {
+			s.releaseCommand(c.Id())
+			return lushError{err}
+		}
+	}
 	// broadcast newcmd message to all connected websocket clients
 	w := newPrefixedWriter(&s.ctrlclients, []byte("newcmd;"))
-	md, err := metacmd{c}.Metadata()
-	if err != nil {
-		return err
-	}
-	err = json.NewEncoder(w).Encode(md)
+	md, err := metacmd{c, s}.Metadata()
 	if err != nil {
 		return err
 	}
+	// not an error if nobody is connected (e.g. during startup)
+	json.NewEncoder(w).Encode(md)
 	// subscribe everyone to status updates
 	c.Status().NotifyChange(func(status liblush.CmdStatus) error {
 		jsonstatus := cmdstatus2json(status)
+		if sup := s.getSupervisor(c.Id()); sup != nil {
+			jsonstatus.Restarts = sup.info().Restarts
+		}
 		s.web.Logger.Println("command", c.Id(), "with argv", c.Argv(), "changed status to", jsonstatus)
-		return notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
+		notifyPropertyUpdate(&s.ctrlclients, getPropResponse{
 			Objname:  cmdId2Json(c.Id()),
 			Propname: "status",
 			Value:    jsonstatus,
 		})
+		// keep listening even if nobody is connected right now: a command
+		// can be reset and started again
+		return nil
+	})
+	return nil
+}
+
+// free a command and everything the server keeps about it
+func (s *server) releaseCommand(id liblush.CmdId) error {
+	c := s.session.GetCommand(id)
+	if c != nil && isRunning(c) {
+		return errors.New("cannot free running command")
+	}
+	// no more runs from here on: they would outlive the command
+	s.unwatch(id, nil)
+	s.unfswatch(id, nil)
+	if c != nil && s.archive != nil {
+		// keep the command if it cannot be archived, rather than lose it
+		err := s.archiveCommand(c)
+		if err != nil {
+			return fmt.Errorf("failed to archive command %d: %v", id, err)
+		}
+	}
+	err := s.session.ReleaseCommand(id)
+	if err != nil {
+		return err
+	}
+	s.unsupervise(id)
+	s.releaseRecordBuffers(id)
+	s.releaseTerminal(id)
+	s.setAnsiMode(id, ansiRaw)
+	s.releaseStreamEncodings(id)
+	s.releaseBinaryDetectors(id)
+	s.releaseStdinQueue(id)
+	s.releaseOwner(id)
+	s.updateReadiness(id, func(r *readiness) {
+		*r = readiness{}
 	})
 	return nil
 }
 
+// eg new;{"cmd":"echo","args":["arg1","arg2"],...}
+//
+// the command is owned by the client that created it
+func wseventNew(s *server, client wsClient, optionsJSON string) error {
+	var options cmdOptions
+	err := json.Unmarshal([]byte(optionsJSON), &options)
+	if err != nil {
+		return fmt.Errorf("malformed JSON: %v", err)
+	}
+	options.owner = client.principal.name
+	_, err = newCommand(s, options)
+	return err
+}
+
 // eg setpath;["c:\foo\bar\bin", "c:\bin"]
 func wseventSetpath(s *server, pathJSON string) error {
 	var path []string
@@ -197,6 +364,24 @@ func wseventUpdatecmd(s *server, cmdmetaJSON string) error {
 	if cm["stderrScrollback"] != nil {
 		c.Stderr().Scrollback().Resize(options.StderrScrollback)
 	}
+	if cm["stdoutTimestamps"] != nil {
+		c.Stdout().SetTimestamps(options.StdoutTimestamps)
+	}
+	if cm["stderrTimestamps"] != nil {
+		c.Stderr().SetTimestamps(options.StderrTimestamps)
+	}
+	if cm["stdoutRecords"] != nil {
+		err := s.setRecordBuffer(c, "stdout", options.StdoutRecords)
+		if err != nil {
+			return lushError{err}
+		}
+	}
+	if cm["stderrRecords"] != nil {
+		err := s.setRecordBuffer(c, "stderr", options.StderrRecords)
+		if err != nil {
+			return lushError{err}
+		}
+	}
 	if cm["name"] != nil {
 		c.SetName(options.Name)
 	}
@@ -224,6 +409,52 @@ func wseventUpdatecmd(s *server, cmdmetaJSON string) error {
 	if cm["stderrto"] != nil {
 		connectCmdsById(s, options.Id, options.Stderrto, "stderr")
 	}
+	if _, ok := cm["ready"]; ok {
+		err := s.setReadyProbe(c, options.Ready)
+		if err != nil {
+			return lushError{err}
+		}
+	}
+	if _, ok := cm["after"]; ok {
+		err := s.setAfter(c, options.After)
+		if err != nil {
+			return lushError{err}
+		}
+	}
+	if cm["forceText"] != nil {
+		s.setForceText(c.Id(), options.ForceText)
+	}
+	if cm["stdinQueue"] != nil {
+		limit := options.StdinQueue
+		if limit <= 0 {
+			limit = liblush.DefaultStdinQueueLimit
+		}
+		c.Stdin().SetQueueLimit(limit)
+	}
+	if cm["stdoutEncoding"] != nil {
+		err := s.setStreamEncoding(c.Id(), "stdout", options.StdoutEncoding)
+		if err != nil {
+			return lushError{err}
+		}
+	}
+	if cm["stderrEncoding"] != nil {
+		err := s.setStreamEncoding(c.Id(), "stderr", options.StderrEncoding)
+		if err != nil {
+			return lushError{err}
+		}
+	}
+	if cm["ansi"] != nil {
+		err := s.setAnsiMode(c.Id(), options.Ansi)
+		if err != nil {
+			return lushError{err}
+		}
+	}
+	if _, ok := cm["terminal"]; ok {
+		err := s.setTerminal(c, options.Terminal)
+		if err != nil {
+			return lushError{err}
+		}
+	}
 	// obsolete:
 	// broadcast command update to all connected websocket clients
 	//w := newPrefixedWriter(&s.ctrlclients, []byte("updatecmd;"))
@@ -259,13 +490,18 @@ func wseventSetuserdata(s *server, argsjoined string) error {
 	if len(args) != 2 {
 		return errors.New("setuserdata requires two args")
 	}
+	s.userdatalock.Lock()
 	s.userdata[args[0]] = args[1]
+	s.userdatalock.Unlock()
 	// inform all connected clients about the updated userdata
 	return wseventGetuserdata(s, args[0])
 }
 
 func wseventGetuserdata(s *server, key string) error {
-	_, err := fmt.Fprintf(&s.ctrlclients, "userdata_%s;%s", key, s.userdata[key])
+	s.userdatalock.Lock()
+	value := s.userdata[key]
+	s.userdatalock.Unlock()
+	_, err := fmt.Fprintf(&s.ctrlclients, "userdata_%s;%s", key, value)
 	return err
 }
 
@@ -340,7 +576,12 @@ func wseventStart(s *server, idstr string) error {
 	if err != nil {
 		return err
 	}
-	err = c.Start()
+	if sup := s.getSupervisor(c.Id()); sup != nil {
+		// supervised commands can be started again after they were stopped
+		sup.resume()
+		c.Reset()
+	}
+	err = s.startCmd(c)
 	if err != nil && c.Status().Err() == nil {
 		// only explicitly notify non-status errors.
 		return lushError{fmt.Errorf("Couldn't start command: %v", err)}
@@ -373,6 +614,10 @@ func wseventStop(s *server, idstr string) error {
 	if err != nil {
 		return err
 	}
+	if sup := s.getSupervisor(c.Id()); sup != nil {
+		// stopped on purpose: don't restart
+		sup.stop()
+	}
 	err = c.Signal(StopSignal)
 	if err != nil {
 		// TODO: what to do with this error?
@@ -393,7 +638,7 @@ func wseventStop(s *server, idstr string) error {
 // cannot be executed while command is running.
 func wseventRelease(s *server, idstr string) error {
 	id, _ := liblush.ParseCmdId(idstr)
-	err := s.session.ReleaseCommand(id)
+	err := s.releaseCommand(id)
 	if err != nil {
 		return err
 	}
@@ -466,13 +711,25 @@ func wseventGetprop(s *server, reqstr string) error {
 		case "args":
 			r.Value = c.Argv()[1:]
 		case "status":
-			r.Value = cmdstatus2json(c.Status())
+			status := cmdstatus2json(c.Status())
+			if sup := s.getSupervisor(c.Id()); sup != nil {
+				status.Restarts = sup.info().Restarts
+			}
+			r.Value = status
 		case "userdata":
 			r.Value = c.UserData()
 		case "stdoutScrollback":
 			r.Value = c.Stdout().Scrollback().Size()
 		case "stderrScrollback":
 			r.Value = c.Stderr().Scrollback().Size()
+		case "stdoutTimestamps":
+			r.Value = c.Stdout().Timestamps()
+		case "stderrTimestamps":
+			r.Value = c.Stderr().Timestamps()
+		case "stdoutRecords":
+			r.Value = s.recordsLimit(c.Id(), "stdout")
+		case "stderrRecords":
+			r.Value = s.recordsLimit(c.Id(), "stderr")
 		case "stdoutto":
 			if tocmd := pipedcmd(c.Stdout()); tocmd != nil {
 				r.Value = tocmd.Id()
@@ -481,6 +738,42 @@ func wseventGetprop(s *server, reqstr string) error {
 			if tocmd := pipedcmd(c.Stderr()); tocmd != nil {
 				r.Value = tocmd.Id()
 			}
+		case "watch":
+			if w := s.getWatch(c.Id()); w != nil {
+				r.Value = w.info()
+			}
+		case "fswatch":
+			if t := s.getFswatch(c.Id()); t != nil {
+				r.Value = t.info()
+			}
+		case "supervise":
+			if sup := s.getSupervisor(c.Id()); sup != nil {
+				r.Value = sup.info()
+			}
+		case "ready":
+			r.Value = s.getReadiness(c.Id()).ready
+		case "after":
+			r.Value = s.getReadiness(c.Id()).after
+		case "terminal":
+			r.Value = s.terminalOptions(c.Id())
+		case "ansi":
+			r.Value = s.ansiMode(c.Id())
+		case "stdoutBinary":
+			r.Value = s.isBinary(c.Id(), "stdout")
+		case "stderrBinary":
+			r.Value = s.isBinary(c.Id(), "stderr")
+		case "forceText":
+			r.Value = s.forceText(c.Id())
+		case "stdoutEncoding":
+			r.Value = s.streamEncoding(c.Id(), "stdout")
+		case "stderrEncoding":
+			r.Value = s.streamEncoding(c.Id(), "stderr")
+		case "stdinQueue":
+			r.Value = c.Stdin().QueueLimit()
+		case "stdinQueued":
+			r.Value = c.Stdin().Queued()
+		case "owner":
+			r.Value = s.owner(c.Id())
 		default:
 			return errors.New("Unknown command property name: " + r.Propname)
 		}
@@ -593,30 +886,195 @@ func wseventExit(s *server, _ string) error {
 
 type wsHandler func(*server, string) error
 
-// for everybodeh
-var wsPublicHandlers = map[string]wsHandler{
-	"subscribe":   wseventSubscribe,
-	"getpath":     wseventGetpath,
-	"getuserdata": wseventGetuserdata,
-	"getprop":     wseventGetprop,
-	"allclients":  wseventAllclients,
+var wsHandlers = map[string]wsHandler{
+	"subscribe":       wseventSubscribe,
+	"getpath":         wseventGetpath,
+	"getuserdata":     wseventGetuserdata,
+	"getprop":         wseventGetprop,
+	"allclients":      wseventAllclients,
+	"templates":       wseventTemplates,
+	"schedules":       wseventSchedules,
+	"schedulehistory": wseventSchedulehistory,
+	"watchhistory":    wseventWatchhistory,
+	"groups":          wseventGroups,
+	"subscribegroup":  wseventSubscribegroup,
+	"tasks":           wseventTasks,
+	"records":         wseventRecords,
+	"search":          wseventSearch,
+	"chunks":          wseventChunks,
+	"screen":          wseventScreen,
+	"hexdump":         wseventHexdump,
+	"setuserdata":     wseventSetuserdata,
+	"setpath":         wseventSetpath,
+	"connect":         wseventConnect,
+	"start":           wseventStart,
+	"stop":            wseventStop,
+	"release":         wseventRelease,
+	"setprop":         wseventSetprop,
+	"delprop":         wseventDelprop,
+	"chdir":           wseventChdir,
+	"exit":            wseventExit,
+	"savetemplate":    wseventSavetemplate,
+	"deltemplate":     wseventDeltemplate,
+	"pauseschedule":   wseventPauseschedule,
+	"resumeschedule":  wseventResumeschedule,
+	"delschedule":     wseventDelschedule,
+	"watch":           wseventWatch,
+	"unwatch":         wseventUnwatch,
+	"fswatch":         wseventFswatch,
+	"unfswatch":       wseventUnfswatch,
+	"supervise":       wseventSupervise,
+	"unsupervise":     wseventUnsupervise,
+	"procfile":        wseventProcfile,
+	"startgroup":      wseventStartgroup,
+	"stopgroup":       wseventStopgroup,
+	"delgroup":        wseventDelgroup,
+	// obsolete
+	//"updatecmd":   wseventUpdatecmd,
 }
 
-// only master!
-var wsMasterHandlers = map[string]wsHandler{
+// handlers that need to know which client sent the event
+type wsClientHandler func(*server, wsClient, string) error
+
+var wsClientHandlers = map[string]wsClientHandler{
 	"new":         wseventNew,
-	"setuserdata": wseventSetuserdata,
-	"setpath":     wseventSetpath,
-	"connect":     wseventConnect,
-	"start":       wseventStart,
-	"stop":        wseventStop,
-	"release":     wseventRelease,
-	"setprop":     wseventSetprop,
-	"delprop":     wseventDelprop,
-	"chdir":       wseventChdir,
-	"exit":        wseventExit,
-	// obsolete
-	//"updatecmd":   wseventUpdatecmd,
+	"stdin":       wseventStdin,
+	"closestdin":  wseventClosestdin,
+	"instantiate": wseventInstantiate,
+	"runtask":     wseventRuntask,
+	"schedule":    wseventSchedule,
+}
+
+// permission required for every event. events not listed here are refused.
+var wsEventPermissions = map[string]permission{
+	"subscribe":       permView,
+	"getpath":         permView,
+	"getuserdata":     permView,
+	"getprop":         permView,
+	"allclients":      permView,
+	"templates":       permView,
+	"schedules":       permView,
+	"schedulehistory": permView,
+	"watchhistory":    permView,
+	"groups":          permView,
+	"subscribegroup":  permView,
+	"tasks":           permView,
+	"records":         permView,
+	"search":          permView,
+	"chunks":          permView,
+	"screen":          permView,
+	"hexdump":         permView,
+	"new":             permControl,
+	"stdin":           permControl,
+	"closestdin":      permControl,
+	"setuserdata":     permControl,
+	"connect":         permControl,
+	"start":           permControl,
+	"stop":            permControl,
+	"release":         permControl,
+	"setprop":         permControl,
+	"delprop":         permControl,
+	"instantiate":     permControl,
+	"schedule":        permControl,
+	"pauseschedule":   permControl,
+	"resumeschedule":  permControl,
+	"delschedule":     permControl,
+	"watch":           permControl,
+	"unwatch":         permControl,
+	"fswatch":         permControl,
+	"unfswatch":       permControl,
+	"supervise":       permControl,
+	"unsupervise":     permControl,
+	"startgroup":      permControl,
+	"stopgroup":       permControl,
+	"runtask":         permControl,
+	"setpath":         permAdmin,
+	"chdir":           permAdmin,
+	"exit":            permAdmin,
+	"savetemplate":    permAdmin,
+	"deltemplate":     permAdmin,
+	"procfile":        permAdmin,
+	"delgroup":        permAdmin,
+}
+
+// the commands an event changes, if ownership is enforced the client must own
+// all of them. a malformed argument yields none: the handler rejects it.
+type ownedCmds func(s *server, arg string) []liblush.CmdId
+
+// eg stop;3
+func ownedIdArg(s *server, idstr string) []liblush.CmdId {
+	id, err := liblush.ParseCmdId(idstr)
+	if err != nil {
+		return nil
+	}
+	return []liblush.CmdId{id}
+}
+
+// eg watch;{"nid":3,...}
+func ownedNidArg(s *server, reqJSON string) []liblush.CmdId {
+	var req struct {
+		Id liblush.CmdId `json:"nid"`
+	}
+	if json.Unmarshal([]byte(reqJSON), &req) != nil {
+		return nil
+	}
+	return []liblush.CmdId{req.Id}
+}
+
+// eg setprop;{"name":"cmd3",...}
+func ownedPropArg(s *server, reqJSON string) []liblush.CmdId {
+	var req getPropRequest
+	if json.Unmarshal([]byte(reqJSON), &req) != nil || !strings.HasPrefix(req.Objname, "cmd") {
+		return nil
+	}
+	return ownedIdArg(s, req.Objname[3:])
+}
+
+// eg connect;{"from":3,"to":4,...}
+func ownedConnectArg(s *server, reqJSON string) []liblush.CmdId {
+	var req struct {
+		From, To liblush.CmdId
+	}
+	if json.Unmarshal([]byte(reqJSON), &req) != nil {
+		return nil
+	}
+	if req.To == 0 {
+		// disconnecting only changes the first command
+		return []liblush.CmdId{req.From}
+	}
+	return []liblush.CmdId{req.From, req.To}
+}
+
+// eg stopgroup;myapp
+func ownedGroupArg(s *server, name string) []liblush.CmdId {
+	g, err := s.getGroup(name)
+	if err != nil {
+		return nil
+	}
+	var ids []liblush.CmdId
+	for _, svc := range g.Services {
+		ids = append(ids, svc.Id)
+	}
+	return ids
+}
+
+var wsOwnedEvents = map[string]ownedCmds{
+	"start":       ownedIdArg,
+	"stop":        ownedIdArg,
+	"release":     ownedIdArg,
+	"closestdin":  ownedIdArg,
+	"unsupervise": ownedIdArg,
+	"unwatch":     ownedIdArg,
+	"unfswatch":   ownedIdArg,
+	"stdin":       ownedNidArg,
+	"supervise":   ownedNidArg,
+	"watch":       ownedNidArg,
+	"fswatch":     ownedNidArg,
+	"setprop":     ownedPropArg,
+	"delprop":     ownedPropArg,
+	"connect":     ownedConnectArg,
+	"startgroup":  ownedGroupArg,
+	"stopgroup":   ownedGroupArg,
 }
 
 func parseAndHandleWsEvent(s *server, client wsClient, msg []byte) error {
@@ -624,24 +1082,33 @@ func parseAndHandleWsEvent(s *server, client wsClient, msg []byte) error {
 	if len(argv) != 2 {
 		return errors.New("parse error")
 	}
-	handler := wsPublicHandlers[argv[0]]
-	if handler == nil && client.isMaster {
-		handler = wsMasterHandlers[argv[0]]
+	name, arg := argv[0], argv[1]
+	handler := wsHandlers[name]
+	if clienthandler := wsClientHandlers[name]; clienthandler != nil {
+		handler = func(s *server, arg string) error {
+			return clienthandler(s, client, arg)
+		}
 	}
+	perm, known := wsEventPermissions[name]
 	var err error
-	if handler == nil {
-		var errmsg string
-		if client.isMaster {
-			errmsg = "unknown command"
-		} else {
-			errmsg = "unknown command (you're not master, maybe that's it?)"
-		}
-		s.web.Logger.Printf("ws client %d unknown event: %q", client.Id, argv[0])
+	if handler == nil || !known {
+		s.web.Logger.Printf("ws client %d unknown event: %q", client.Id, name)
 		// TODO: slightly different from lush error (shouldnt be displayed to
 		// user)
-		err = lushError{errors.New(errmsg)}
+		err = lushError{errors.New("unknown command")}
+	} else if !client.principal.can(perm) {
+		err = lushError{fmt.Errorf("permission denied: %s requires the %s permission", name, perm)}
 	} else {
-		err = handler(s, argv[1])
+		if owned := wsOwnedEvents[name]; owned != nil {
+			for _, id := range owned(s, arg) {
+				if err = s.checkOwner(client.principal, id); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = handler(s, arg)
+		}
 	}
 	if err != nil {
 		if le, ok := err.(lushError); ok {